@@ -18,22 +18,45 @@ package goon
 
 import (
 	"container/list"
+	"errors"
 	"reflect"
+	"strings"
 	"sync"
+
+	"google.golang.org/appengine/datastore"
 )
 
 var cachedValueOverhead int
 
+// ghostOverhead is the memory taken by a key that twoQPolicy remembers
+// after it was evicted, in addition to the length of the key string.
+var ghostOverhead int
+
 func init() {
 	// Calculate the platform dependant overhead size for keeping a value in cache
 	var elem list.Element
 	var ci cacheItem
-	cachedValueOverhead += int(reflect.TypeOf(elem).Size())   // list.Element in cache.accessed
-	cachedValueOverhead += int(reflect.TypeOf(&elem).Size())  // *list.Element in cache.elements
+	cachedValueOverhead += int(reflect.TypeOf(&ci).Size())    // *cacheItem in cache.elements
 	cachedValueOverhead += int(reflect.TypeOf(ci.key).Size()) // string in cache.elements as key
-	cachedValueOverhead += int(reflect.TypeOf(ci).Size())     // cacheItem pointed to by list.Element.Value
+	cachedValueOverhead += int(reflect.TypeOf(ci).Size())     // cacheItem pointed to by cache.elements
+	// The eviction policy has its own overhead, which is estimated based on the default LRU policy
+	cachedValueOverhead += int(reflect.TypeOf(elem).Size())   // list.Element in lruPolicy.accessed
+	cachedValueOverhead += int(reflect.TypeOf(&elem).Size())  // *list.Element in lruPolicy.elements
+	cachedValueOverhead += int(reflect.TypeOf(ci.key).Size()) // string in lruPolicy.elements as key
 	// In addition to the above overhead, the total cache value size must include
 	// the length of the key string in bytes and the cap of the value []byte
+
+	ghostOverhead += int(reflect.TypeOf(elem).Size())   // list.Element in twoQPolicy.ghostList
+	ghostOverhead += int(reflect.TypeOf(ci.key).Size()) // string boxed in the list.Element value
+	ghostOverhead += int(reflect.TypeOf(&elem).Size())  // *list.Element in twoQPolicy.ghosts
+	ghostOverhead += int(reflect.TypeOf(ci.key).Size()) // string in twoQPolicy.ghosts as key
+}
+
+// policySizer is implemented by eviction policies that hold on to memory
+// beyond the keys they track, which counts against the size of the cache.
+type policySizer interface {
+	// extraSize returns the size of that memory in bytes.
+	extraSize() int
 }
 
 type cacheItem struct {
@@ -42,17 +65,38 @@ type cacheItem struct {
 }
 
 type cache struct {
-	lock     sync.Mutex
-	elements map[string]*list.Element // access via key
-	accessed list.List                // most recently accessed in front
-	size     int                      // Total size of all the values in the cache
-	limit    int                      // Maximum size allowed
+	lock      sync.Mutex
+	elements  map[string]*cacheItem // access via key
+	policy    EvictionPolicy        // decides which value to evict
+	size      int                   // Total size of all the values in the cache
+	limit     int                   // Maximum size allowed
+	hits      uint64                // Number of lookups that found a value
+	misses    uint64                // Number of lookups that found nothing
+	evictions uint64                // Number of values removed to meet the limit
 }
 
 const defaultCacheLimit = 16 << 20 // 16 MiB
 
+// localCache is the local memory cache of a Goon,
+// implemented by both cache and shardedCache.
+type localCache interface {
+	Set(item *cacheItem)
+	SetMulti(items []*cacheItem)
+	Delete(key string)
+	DeleteMulti(keys []string)
+	Get(key string) []byte
+	GetMulti(keys []string) [][]byte
+	Flush()
+	Stats() CacheStats
+	Items() []*cacheItem
+}
+
 func newCache(limit int) *cache {
-	return &cache{elements: map[string]*list.Element{}, limit: limit}
+	return newCacheWithPolicy(limit, NewLRUPolicy())
+}
+
+func newCacheWithPolicy(limit int, policy EvictionPolicy) *cache {
+	return &cache{elements: map[string]*cacheItem{}, policy: policy, limit: limit}
 }
 
 func (c *cache) setLimit(limit int) {
@@ -62,35 +106,48 @@ func (c *cache) setLimit(limit int) {
 	c.lock.Unlock()
 }
 
+// totalSizeUnderLock returns the size of the values in the cache and of any
+// memory of the eviction policy that counts against the limit.
+// It must be called under cache.lock
+func (c *cache) totalSizeUnderLock() int {
+	if ps, ok := c.policy.(policySizer); ok {
+		return c.size + ps.extraSize()
+	}
+	return c.size
+}
+
 // meetLimit must be called under cache.lock
 func (c *cache) meetLimitUnderLock() {
-	for c.size > c.limit {
-		e := c.accessed.Back()
-		if e == nil {
+	for c.totalSizeUnderLock() > c.limit {
+		key, ok := c.policy.Evict()
+		if !ok {
 			break
 		}
-		c.deleteExistingUnderLock(e)
+		if ci, ok := c.elements[key]; ok {
+			c.deleteExistingUnderLock(ci)
+			c.evictions++
+		}
 	}
 }
 
 // setUnderLock must be called under cache.lock
 func (c *cache) setUnderLock(item *cacheItem) {
 	// Check if there's already an entry for this key
-	if e, ok := c.elements[item.key]; ok {
+	if ci, ok := c.elements[item.key]; ok {
 		// There already exists a value for this key, so update it
-		ci := e.Value.(*cacheItem)
 		c.size += cap(item.value) - cap(ci.value)
 		// Make sure that item.key is the same pointer as the map key,
 		// as this will ensure faster map lookup via pointer equality.
 		// Not doing so would also lead to double memory usage, as the two key
 		// pointers would be pointing to the same contents in different places.
 		item.key = ci.key
-		e.Value = item
-		c.accessed.MoveToFront(e)
+		c.elements[item.key] = item
+		c.policy.Access(item.key)
 	} else {
 		// Brand new key, so add it
 		c.size += cachedValueOverhead + len(item.key) + cap(item.value)
-		c.elements[item.key] = c.accessed.PushFront(item)
+		c.elements[item.key] = item
+		c.policy.Add(item.key)
 	}
 }
 
@@ -113,18 +170,18 @@ func (c *cache) SetMulti(items []*cacheItem) {
 }
 
 // deleteExistingUnderLock must be called under cache.lock
-// The specified element must be non-nil and be guaranteed to exist in the cache
-func (c *cache) deleteExistingUnderLock(e *list.Element) {
-	ci := e.Value.(*cacheItem)
+// The specified item must be non-nil and be guaranteed to exist in the cache
+// The eviction policy must no longer be tracking the item's key
+func (c *cache) deleteExistingUnderLock(ci *cacheItem) {
 	c.size -= cachedValueOverhead + len(ci.key) + cap(ci.value)
 	delete(c.elements, ci.key)
-	c.accessed.Remove(e)
 }
 
 // deleteUnderLock must be called under cache.lock
 func (c *cache) deleteUnderLock(key string) {
-	if e, ok := c.elements[key]; ok {
-		c.deleteExistingUnderLock(e)
+	if ci, ok := c.elements[key]; ok {
+		c.policy.Remove(ci.key)
+		c.deleteExistingUnderLock(ci)
 	}
 }
 
@@ -144,10 +201,12 @@ func (c *cache) DeleteMulti(keys []string) {
 
 // getUnderLock must be called under cache.lock
 func (c *cache) getUnderLock(key string) []byte {
-	if e, ok := c.elements[key]; ok {
-		c.accessed.MoveToFront(e)
-		return (e.Value.(*cacheItem)).value
+	if ci, ok := c.elements[key]; ok {
+		c.policy.Access(ci.key)
+		c.hits++
+		return ci.value
 	}
+	c.misses++
 	return nil
 }
 
@@ -173,7 +232,164 @@ func (c *cache) GetMulti(keys []string) [][]byte {
 func (c *cache) Flush() {
 	c.lock.Lock()
 	c.size = 0
-	c.elements = map[string]*list.Element{}
-	c.accessed.Init()
+	c.elements = map[string]*cacheItem{}
+	c.policy.Reset()
 	c.lock.Unlock()
 }
+
+func (c *cache) Stats() CacheStats {
+	c.lock.Lock()
+	stats := CacheStats{
+		Items:     len(c.elements),
+		Size:      c.totalSizeUnderLock(),
+		Limit:     c.limit,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	c.lock.Unlock()
+	return stats
+}
+
+// Items returns all the items, in the order given by EvictionPolicy.Walk.
+// The items are immutable, so they are safe to use after the lock is released.
+func (c *cache) Items() []*cacheItem {
+	c.lock.Lock()
+	items := make([]*cacheItem, 0, len(c.elements))
+	c.policy.Walk(func(key string) {
+		if ci, ok := c.elements[key]; ok {
+			items = append(items, ci)
+		}
+	})
+	c.lock.Unlock()
+	return items
+}
+
+// LocalCacheOptions configures the local memory cache of a Goon.
+type LocalCacheOptions struct {
+	// Limit is the maximum size of the cache in bytes, including overhead.
+	// Zero means the default of 16 MiB.
+	Limit int
+	// Policy returns a new EvictionPolicy for the cache.
+	// Nil means NewLRUPolicy.
+	Policy func() EvictionPolicy
+	// Shards is the number of independently locked parts that the cache
+	// is split into, which reduces lock contention when the Goon is shared
+	// by many goroutines. Every shard gets an equal part of Limit and
+	// its own Policy. Zero or one means a single unsharded cache.
+	Shards int
+}
+
+// ConfigureLocalCache replaces the local memory cache with a new empty one
+// that is configured by opts. Per-kind caches, see RegisterKindCache, are
+// recreated with the new Policy and Shards when they are next needed. It
+// must not be called while the Goon is in use by other goroutines. Goons
+// returned by FromContext start out with the default options.
+func (g *Goon) ConfigureLocalCache(opts LocalCacheOptions) {
+	if opts.Limit == 0 {
+		opts.Limit = defaultCacheLimit
+	}
+	g.kindCacheLock.Lock()
+	g.cacheOpts = opts
+	g.kindCaches.Store(map[string]localCache(nil))
+	g.kindCacheLock.Unlock()
+	g.cache = newLocalCache(opts.Limit, opts)
+}
+
+// newLocalCache returns an empty local memory cache with the given limit,
+// which is configured by the Policy and Shards of opts.
+func newLocalCache(limit int, opts LocalCacheOptions) localCache {
+	policy := NewLRUPolicy
+	if opts.Policy != nil {
+		policy = opts.Policy
+	}
+	if opts.Shards > 1 {
+		return newShardedCache(limit, opts.Shards, policy)
+	}
+	return newCacheWithPolicy(limit, policy())
+}
+
+// CacheStats describes the state of the local memory cache of a Goon.
+type CacheStats struct {
+	Items     int    // Number of cached values
+	Size      int    // Total size of the cache in bytes, including overhead
+	Limit     int    // Maximum size of the cache in bytes
+	Hits      uint64 // Number of lookups that found a value
+	Misses    uint64 // Number of lookups that found nothing
+	Evictions uint64 // Number of values removed to stay within Limit
+}
+
+// add adds the statistics of another cache to cs.
+func (cs *CacheStats) add(other CacheStats) {
+	cs.Items += other.Items
+	cs.Size += other.Size
+	cs.Limit += other.Limit
+	cs.Hits += other.Hits
+	cs.Misses += other.Misses
+	cs.Evictions += other.Evictions
+}
+
+// CacheStats returns the current statistics of the local memory cache,
+// summed up with the statistics of all the per-kind caches.
+func (g *Goon) CacheStats() CacheStats {
+	var stats CacheStats
+	for _, lc := range g.localCaches() {
+		stats.add(lc.Stats())
+	}
+	return stats
+}
+
+// CacheEntry is a decoded value of the local memory cache.
+type CacheEntry struct {
+	Key        string                 // The cache key, which contains the MemcacheKey of the entity
+	Size       int                    // Size of the serialized value in bytes
+	Exists     bool                   // Whether the entity exists, as non-existence is cached too
+	Properties datastore.PropertyList // The cached properties of the entity
+}
+
+// propertyListLoader allows deserializeStruct to decode into a property list.
+type propertyListLoader struct {
+	props datastore.PropertyList
+}
+
+func (pll *propertyListLoader) Load(props []datastore.Property) error {
+	pll.props = props
+	return nil
+}
+
+func (pll *propertyListLoader) Save() ([]datastore.Property, error) {
+	return pll.props, nil
+}
+
+// DumpLocalCache calls fn with every value of the local memory cache,
+// from the value least likely to be evicted to the most likely. With the
+// default LRU policy that is from the most recently accessed to the least.
+// Dumping doesn't count as accessing the values. The cache isn't locked
+// while fn runs, so the values may already be gone from the cache by the
+// time fn sees them.
+//
+// If fn returns an error, DumpLocalCache stops and returns that error.
+func (g *Goon) DumpLocalCache(fn func(e *CacheEntry) error) error {
+	var items []*cacheItem
+	for _, lc := range g.localCaches() {
+		items = append(items, lc.Items()...)
+	}
+	for _, item := range items {
+		if strings.HasPrefix(item.key, queryCacheKeyPrefix) {
+			continue // cached query results aren't entities
+		}
+		entry := &CacheEntry{Key: item.key, Size: len(item.value), Exists: true}
+		pll := &propertyListLoader{}
+		if err := deserializeStruct(pll, item.value); errors.Is(err, datastore.ErrNoSuchEntity) {
+			entry.Exists = false
+		} else if err != nil {
+			return err
+		} else {
+			entry.Properties = pll.props
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
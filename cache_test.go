@@ -18,6 +18,7 @@ package goon
 
 import (
 	"bytes"
+	"errors"
 	"reflect"
 	"testing"
 	"unsafe"
@@ -132,10 +133,16 @@ func TestCacheKeyLeak(t *testing.T) {
 		if ka := *(*uintptr)(unsafe.Pointer(&key)); ka != keyAddr {
 			t.Fatalf("map key has wrong pointer! %x vs %x", ka, keyAddr)
 		}
-		if ka := *(*uintptr)(unsafe.Pointer(&(elem.Value.(*cacheItem)).key)); ka != keyAddr {
+		if ka := *(*uintptr)(unsafe.Pointer(&elem.key)); ka != keyAddr {
 			t.Fatalf("element key has wrong pointer! %x vs %x", ka, keyAddr)
 		}
 	}
+	// The eviction policy must be holding on to the same key pointer
+	c.policy.Walk(func(key string) {
+		if ka := *(*uintptr)(unsafe.Pointer(&key)); ka != keyAddr {
+			t.Fatalf("policy key has wrong pointer! %x vs %x", ka, keyAddr)
+		}
+	})
 }
 
 func TestCacheLimit(t *testing.T) {
@@ -178,3 +185,89 @@ func TestCacheLimit(t *testing.T) {
 		t.Fatalf("Invalid bytes for items! %+v", vs)
 	}
 }
+
+func TestCacheStats(t *testing.T) {
+	c := newCache(defaultCacheLimit)
+
+	c.Set(&cacheItem{key: "foo", value: []byte{1, 2, 3}})
+	c.Set(&cacheItem{key: "bar", value: []byte{4, 5, 6}})
+	c.Get("foo")
+	c.GetMulti([]string{"foo", "bar", "baz"})
+
+	stats := c.Stats()
+	if stats.Items != 2 || stats.Hits != 3 || stats.Misses != 1 || stats.Evictions != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if stats.Size != c.size || stats.Limit != defaultCacheLimit {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Make room for only a single item
+	c.setLimit(cachedValueOverhead + 3 + 3)
+	stats = c.Stats()
+	if stats.Items != 1 || stats.Evictions != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	// The least recently accessed item must be the one evicted
+	if v := c.Get("bar"); !bytes.Equal(v, []byte{4, 5, 6}) {
+		t.Fatalf("Expected bar to survive, got %v", v)
+	}
+}
+
+func TestDumpLocalCache(t *testing.T) {
+	g := FromContext(offlineContext())
+
+	hi := &HasId{Id: 1, Name: "one"}
+	data, err := serializeStruct(hi)
+	if err != nil {
+		t.Fatalf("Unexpected error serializing: %v", err)
+	}
+	missing, err := serializeStruct(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error serializing: %v", err)
+	}
+	g.cache.Set(&cacheItem{key: "missing", value: missing})
+	g.cache.Set(&cacheItem{key: "exists", value: data})
+
+	var entries []*CacheEntry
+	err = g.DumpLocalCache(func(e *CacheEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error dumping: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", len(entries))
+	}
+	// The most recently accessed entry comes first
+	if e := entries[0]; e.Key != "exists" || !e.Exists || e.Size != len(data) {
+		t.Fatalf("Unexpected entry: %+v", e)
+	} else if len(e.Properties) != 1 || e.Properties[0].Name != "Name" || e.Properties[0].Value != "one" {
+		t.Fatalf("Unexpected properties: %+v", e.Properties)
+	}
+	if e := entries[1]; e.Key != "missing" || e.Exists || e.Properties != nil {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	// Dumping doesn't count as access
+	if stats := g.CacheStats(); stats.Hits != 0 || stats.Items != 2 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Errors from the callback stop the dump
+	errStop := errors.New("stop")
+	calls := 0
+	err = g.DumpLocalCache(func(e *CacheEntry) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Fatalf("Expected a single call and errStop, got %v calls and %v", calls, err)
+	}
+
+	// Corrupt data is reported
+	g.cache.Set(&cacheItem{key: "corrupt", value: []byte{1, 0, 0, 0x40}})
+	if err := g.DumpLocalCache(func(e *CacheEntry) error { return nil }); !errors.Is(err, ErrCorruptCacheData) {
+		t.Fatalf("Expected ErrCorruptCacheData, got %v", err)
+	}
+}
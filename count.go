@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// The prefix of the memcache keys of cached counts, which is followed by
+// a hash of the namespace, the kind generation and the query fingerprint.
+var countCacheKeyPrefix = fmt.Sprintf("g%Xc:", serializationFormatVersion)
+
+// The prefix of the memcache keys of approximate count shards,
+// which is followed by the namespace, the kind and the shard number.
+var countShardKeyPrefix = fmt.Sprintf("g%Xn:", serializationFormatVersion)
+
+// countShardBase is the value of a count shard that hasn't been changed.
+// Memcache doesn't decrement counters below zero, so the shards are kept
+// far above it, and a decrement doesn't get lost on a shard that only
+// had increments on other shards before it.
+const countShardBase = 1 << 40
+
+// defaultCountResync is used when KindCacheConfig.CountResync is zero.
+const defaultCountResync = time.Hour
+
+// countCache holds the count of a single query in memcache.
+type countCache struct {
+	g    *Goon
+	c    context.Context
+	kind string
+	key  string        // the memcache key of the count
+	ttl  time.Duration // how long the count is cached
+}
+
+// newCountCache returns the cache of the count of the query described by info,
+// which runs with the context c, or nil if the count must not be cached.
+func (g *Goon) newCountCache(c context.Context, info queryInfo) *countCache {
+	if g.inTransaction || !info.cacheable {
+		return nil
+	}
+	cfg, _ := kindCacheConfig(info.kind)
+	if cfg.CountCacheTTL <= 0 {
+		return nil
+	}
+	ns := contextNamespace(c)
+	gen, err := g.queryGeneration(c, "countCache", ns, info.kind)
+	if err != nil {
+		return nil
+	}
+	key := countCacheKeyPrefix + hashCacheKey(ns+"\x00"+strconv.FormatUint(gen, 10)+"\x00"+info.fingerprint)
+	return &countCache{g: g, c: c, kind: info.kind, key: key, ttl: cfg.CountCacheTTL}
+}
+
+// get returns the cached count of the query, if any.
+func (cc *countCache) get() (int, bool) {
+	tc, cf := context.WithTimeout(cc.c, memcacheGetTimeout(1))
+	item, err := memcache.Get(tc, cc.key)
+	cf()
+	if err == memcache.ErrCacheMiss {
+		cc.g.count("countCache", TierMemcache, MetricMiss, 1)
+		return 0, false
+	} else if err != nil {
+		cc.g.count("countCache", TierMemcache, MetricError, 1)
+		cc.g.error(cc.c, &LogEntry{Op: "countCache", Kind: cc.kind, Tier: TierMemcache, Err: err})
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(item.Value))
+	if err != nil {
+		cc.g.error(cc.c, &LogEntry{Op: "countCache", Kind: cc.kind, Tier: TierMemcache, Err: err})
+		return 0, false
+	}
+	cc.g.count("countCache", TierMemcache, MetricHit, 1)
+	return n, true
+}
+
+// set caches n as the count of the query.
+func (cc *countCache) set(n int) {
+	tc, cf := context.WithTimeout(cc.c, memcachePutTimeout(0))
+	err := memcache.Set(tc, &memcache.Item{Key: cc.key, Value: []byte(strconv.Itoa(n)), Expiration: cc.ttl})
+	cf()
+	if err != nil {
+		cc.g.count("countCache", TierMemcache, MetricError, 1)
+		cc.g.error(cc.c, &LogEntry{Op: "countCache", Kind: cc.kind, Tier: TierMemcache, Err: err})
+	} else {
+		cc.g.count("countCache", TierMemcache, MetricSet, 1)
+	}
+}
+
+// countShardKey returns the memcache key of shard of the approximate count
+// of kind in namespace ns. Shard -1 marks that the shards are in sync.
+func countShardKey(ns, kind string, shard int) string {
+	key := countShardKeyPrefix + ns + ":" + kind + ":" + strconv.Itoa(shard)
+	if len(key) > memcacheMaxKeySize {
+		key = hashCacheKey(key)
+	}
+	return key
+}
+
+// ApproximateCount returns the approximate number of entities of kind,
+// in the namespace of the Goon. The kind must be registered with
+// KindCacheConfig.CountShards.
+//
+// The count is kept in sharded memcache counters, which are increased by
+// Put and PutMulti for the entities they create, and decreased by Delete and
+// DeleteMulti for the entities they remove. Only puts of incomplete keys
+// count as creations, and every deleted key counts as a removal, unless the
+// kind is registered with KindCacheConfig.CountLookups, which tells those
+// apart by looking up complete keys before writing them. Concurrent writes
+// of the same key outside of a transaction may still both count it.
+// The counters are reset with an exact count of the entities every
+// KindCacheConfig.CountResync, and by the next ApproximateCount after
+// memcache has evicted any of them.
+// Writes that don't go through goon are only noticed after a reset.
+func (g *Goon) ApproximateCount(kind string) (int, error) {
+	return g.ApproximateCountContext(g.Context, kind)
+}
+
+// ApproximateCountContext is like ApproximateCount, but uses c instead of g.Context.
+func (g *Goon) ApproximateCountContext(c context.Context, kind string) (int, error) {
+	cfg, _ := kindCacheConfig(kind)
+	if cfg.CountShards <= 0 {
+		return 0, fmt.Errorf("goon: Kind %v isn't registered with CountShards", kind)
+	}
+	c, err := g.namespaceContext(c, "")
+	if err != nil {
+		return 0, err
+	}
+	ns := contextNamespace(c)
+	mckeys := make([]string, cfg.CountShards+1)
+	for i := range mckeys {
+		mckeys[i] = countShardKey(ns, kind, i-1)
+	}
+
+	tc, cf := context.WithTimeout(c, memcacheGetTimeout(len(mckeys)))
+	items, err := memcache.GetMulti(tc, mckeys)
+	cf()
+	if err != nil {
+		g.count("ApproximateCount", TierMemcache, MetricError, 1)
+		g.error(c, &LogEntry{Op: "ApproximateCount", Kind: kind, KeyCount: len(mckeys), Tier: TierMemcache, Err: err})
+	} else if n, ok := sumCountShards(items, mckeys); ok {
+		g.count("ApproximateCount", TierMemcache, MetricHit, 1)
+		return n, nil
+	}
+	g.count("ApproximateCount", TierMemcache, MetricMiss, 1)
+
+	// Reset the shards with an exact count
+	start := time.Now()
+	n, err := datastore.NewQuery(kind).KeysOnly().Count(c)
+	g.timing("ApproximateCount", TierDatastore, start)
+	if err != nil {
+		g.countMultiErr("ApproximateCount", TierDatastore, MetricResult, 0, err)
+		return 0, err
+	}
+	resync := cfg.CountResync
+	if resync <= 0 {
+		resync = defaultCountResync
+	}
+	reset := make([]*memcache.Item, len(mckeys))
+	for i, key := range mckeys {
+		value := uint64(countShardBase)
+		if i == 1 {
+			value += uint64(n)
+		}
+		reset[i] = &memcache.Item{Key: key, Value: []byte(strconv.FormatUint(value, 10)), Expiration: resync}
+	}
+	tc, cf = context.WithTimeout(c, memcachePutTimeout(0))
+	err = memcache.SetMulti(tc, reset)
+	cf()
+	if err != nil {
+		g.count("ApproximateCount", TierMemcache, MetricError, 1)
+		g.error(c, &LogEntry{Op: "ApproximateCount", Kind: kind, KeyCount: len(reset), Tier: TierMemcache, Err: err})
+	} else {
+		g.count("ApproximateCount", TierMemcache, MetricSet, len(reset))
+	}
+	return n, nil
+}
+
+// sumCountShards returns the approximate count held by the count shards
+// items of mckeys, where the first key is the in-sync marker, and reports
+// whether all of them were found.
+func sumCountShards(items map[string]*memcache.Item, mckeys []string) (int, bool) {
+	if items[mckeys[0]] == nil {
+		return 0, false
+	}
+	var sum int64
+	for _, key := range mckeys[1:] {
+		item := items[key]
+		if item == nil {
+			return 0, false
+		}
+		v, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		sum += int64(v) - countShardBase
+	}
+	if sum < 0 {
+		sum = 0
+	}
+	return int(sum), true
+}
+
+// keyExistence is whether the entity of a key existed before a write,
+// as far as the approximate counts are concerned.
+type keyExistence int8
+
+const (
+	existenceUnknown keyExistence = iota // the key isn't looked up, or the lookup failed
+	entityAbsent
+	entityPresent
+)
+
+// lookupCountedKeys returns whether the entities of the complete keys of kinds
+// registered with KindCacheConfig.CountLookups exist, so that a write only
+// counts the entities it actually creates or deletes. Returns nil if none of
+// the keys are looked up.
+func (g *Goon) lookupCountedKeys(c context.Context, keys []*datastore.Key) []keyExistence {
+	var counted []int
+	for i, key := range keys {
+		if cfg, _ := kindCacheConfig(key.Kind()); cfg.CountShards > 0 && cfg.CountLookups && !key.Incomplete() {
+			counted = append(counted, i)
+		}
+	}
+	if len(counted) == 0 {
+		return nil
+	}
+	existence := make([]keyExistence, len(keys))
+	for lo := 0; lo < len(counted); lo += datastoreGetMultiMaxItems {
+		hi := lo + datastoreGetMultiMaxItems
+		if hi > len(counted) {
+			hi = len(counted)
+		}
+		lookupKeys := make([]*datastore.Key, 0, hi-lo)
+		for _, i := range counted[lo:hi] {
+			lookupKeys = append(lookupKeys, keys[i])
+		}
+		err := datastore.GetMulti(c, lookupKeys, make([]datastore.PropertyList, len(lookupKeys)))
+		g.countMultiErr("countLookup", TierDatastore, MetricHit, len(lookupKeys), err)
+		merr, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			g.error(c, &LogEntry{Op: "countLookup", Kind: keysKind(lookupKeys), KeyCount: len(lookupKeys), Tier: TierDatastore, Err: err, Message: "datastore.GetMulti failed - approximate counts may be off until the next resync"})
+			continue
+		}
+		for j, i := range counted[lo:hi] {
+			switch {
+			case err == nil || merr[j] == nil:
+				existence[i] = entityPresent
+			case errors.Is(merr[j], datastore.ErrNoSuchEntity):
+				existence[i] = entityAbsent
+			}
+		}
+	}
+	return existence
+}
+
+// adjustApproximateCounts adds delta to the approximate counts of the kinds
+// of keys for every key, or defers that until the transaction is committed.
+// Only kinds registered with KindCacheConfig.CountShards are adjusted.
+func (g *Goon) adjustApproximateCounts(c context.Context, op string, keys []*datastore.Key, delta int64) {
+	deltas := make(map[queryKind]int64)
+	for _, key := range keys {
+		if cfg, _ := kindCacheConfig(key.Kind()); cfg.CountShards > 0 {
+			deltas[queryKind{ns: key.Namespace(), kind: key.Kind()}] += delta
+		}
+	}
+	if len(deltas) == 0 {
+		return
+	}
+	if g.inTransaction {
+		g.txnCacheLock.Lock()
+		for qk, d := range deltas {
+			g.countDeltas[qk] += d
+		}
+		g.txnCacheLock.Unlock()
+		return
+	}
+	g.incrementCountShards(c, op, deltas)
+}
+
+// incrementCountShards adds deltas to a random shard of every kind,
+// on behalf of operation op. If the shard is missing, because memcache has
+// evicted it or the count was never read, then the in-sync marker is deleted
+// instead, so that the next ApproximateCount resets the shards.
+func (g *Goon) incrementCountShards(c context.Context, op string, deltas map[queryKind]int64) {
+	for qk, d := range deltas {
+		cfg, _ := kindCacheConfig(qk.kind)
+		if d == 0 || cfg.CountShards <= 0 {
+			continue
+		}
+		tc, cf := context.WithTimeout(c, memcacheGetTimeout(1))
+		_, err := memcache.IncrementExisting(tc, countShardKey(qk.ns, qk.kind, rand.Intn(cfg.CountShards)), d)
+		if err == memcache.ErrCacheMiss {
+			if err = memcache.Delete(tc, countShardKey(qk.ns, qk.kind, -1)); err == memcache.ErrCacheMiss {
+				err = nil
+			}
+		}
+		cf()
+		if err != nil {
+			g.count(op, TierMemcache, MetricError, 1)
+			g.error(c, &LogEntry{Op: op, Kind: qk.kind, Tier: TierMemcache, Err: err, Message: "memcache.Increment failed - approximate counts may be off until the next resync"})
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestSumCountShards(t *testing.T) {
+	mckeys := []string{countShardKey("", "A", -1), countShardKey("", "A", 0), countShardKey("", "A", 1)}
+	item := func(v uint64) *memcache.Item {
+		return &memcache.Item{Value: []byte(strconv.FormatUint(v, 10))}
+	}
+	items := map[string]*memcache.Item{
+		mckeys[0]: item(1),
+		mckeys[1]: item(countShardBase + 10),
+		mckeys[2]: item(countShardBase - 3),
+	}
+	if n, ok := sumCountShards(items, mckeys); !ok || n != 7 {
+		t.Fatalf("Expected 7, got %v %v", n, ok)
+	}
+	items[mckeys[2]] = item(countShardBase - 30)
+	if n, ok := sumCountShards(items, mckeys); !ok || n != 0 {
+		t.Fatalf("Expected a negative sum to be 0, got %v %v", n, ok)
+	}
+	// Any missing key means that the shards must be reset
+	for _, key := range mckeys {
+		partial := make(map[string]*memcache.Item)
+		for k, v := range items {
+			if k != key {
+				partial[k] = v
+			}
+		}
+		if _, ok := sumCountShards(partial, mckeys); ok {
+			t.Fatalf("Expected a failure without %v", key)
+		}
+	}
+
+	if key := countShardKey(strings.Repeat("n", 300), "A", 1); len(key) > memcacheMaxKeySize {
+		t.Fatalf("Expected a short key, got %v", key)
+	}
+	if _, err := FromContext(offlineContext()).ApproximateCount("HasId"); err == nil {
+		t.Fatalf("Expected an error for an unregistered kind")
+	}
+}
+
+type CountedKind struct {
+	Id   int64 `datastore:"-" goon:"id"`
+	Name string
+}
+
+func TestCountCache(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{"CountedKind": {CountCacheTTL: time.Minute, CountShards: 4}})()
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	keys, err := g.PutMulti([]*CountedKind{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*CountedKind{{Id: keys[0].IntID()}, {Id: keys[1].IntID()}, {Id: keys[2].IntID()}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+
+	// The second count comes from memcache
+	q := datastore.NewQuery("CountedKind")
+	for i := 0; i < 2; i++ {
+		if n, err := g.Count(q); err != nil || n != 3 {
+			t.Fatalf("Expected 3, got %v (%v)", n, err)
+		}
+	}
+	if hits := mc.Counter("countCache", TierMemcache, MetricHit); hits != 1 {
+		t.Fatalf("Expected 1 count cache hit, got %v", hits)
+	}
+
+	// Writes of the kind invalidate the cached count
+	if err := g.Delete(&CountedKind{Id: keys[0].IntID()}); err != nil {
+		t.Fatalf("Unexpected error on Delete: %v", err)
+	}
+	if err := g.Get(&CountedKind{Id: keys[0].IntID()}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected ErrNoSuchEntity, got %v", err)
+	}
+	if n, err := g.Count(q); err != nil || n != 2 {
+		t.Fatalf("Expected 2 after Delete, got %v (%v)", n, err)
+	}
+
+	// The first approximate count is exact, after which writes adjust it
+	if n, err := g.ApproximateCount("CountedKind"); err != nil || n != 2 {
+		t.Fatalf("Expected an approximate count of 2, got %v (%v)", n, err)
+	}
+	if _, err := g.PutMulti([]*CountedKind{{Name: "d"}, {Name: "e"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.Delete(&CountedKind{Id: keys[1].IntID()}); err != nil {
+		t.Fatalf("Unexpected error on Delete: %v", err)
+	}
+	err = g.RunInTransaction(func(tg *Goon) error {
+		_, err := tg.Put(&CountedKind{Name: "f"})
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction: %v", err)
+	}
+	if n, err := g.ApproximateCount("CountedKind"); err != nil || n != 4 {
+		t.Fatalf("Expected an approximate count of 4, got %v (%v)", n, err)
+	}
+	if hits := mc.Counter("ApproximateCount", TierMemcache, MetricHit); hits != 1 {
+		t.Fatalf("Expected 1 approximate count hit, got %v", hits)
+	}
+	if n := mc.Counter("countLookup", TierDatastore, MetricHit); n != 0 {
+		t.Fatalf("Expected no lookups without CountLookups, got %v", n)
+	}
+
+	// A write that finds a shard evicted makes the next count exact again
+	for shard := 0; shard < 4; shard++ {
+		memcache.Delete(c, countShardKey("", "CountedKind", shard))
+	}
+	if _, err := g.Put(&CountedKind{Name: "g"}); err != nil {
+		t.Fatalf("Unexpected error on Put: %v", err)
+	}
+	if n, err := g.ApproximateCount("CountedKind"); err != nil || n != 5 {
+		t.Fatalf("Expected an approximate count of 5, got %v (%v)", n, err)
+	}
+	if misses := mc.Counter("ApproximateCount", TierMemcache, MetricMiss); misses != 2 {
+		t.Fatalf("Expected 2 approximate count misses, got %v", misses)
+	}
+}
+
+type CountedName struct {
+	Name  string `datastore:"-" goon:"id"`
+	Value int64
+}
+
+func TestApproximateCountStringIds(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{"CountedName": {CountShards: 4, CountLookups: true}})()
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	expect := func(step string, expected int) {
+		t.Helper()
+		if n, err := g.ApproximateCount("CountedName"); err != nil || n != expected {
+			t.Fatalf("Expected an approximate count of %v after %v, got %v (%v)", expected, step, n, err)
+		}
+	}
+	expect("the start", 0)
+
+	// With CountLookups only puts that create an entity and deletes that remove one are counted
+	if _, err := g.PutMulti([]*CountedName{{Name: "a"}, {Name: "b"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	expect("creating a and b", 2)
+	if _, err := g.Put(&CountedName{Name: "a", Value: 1}); err != nil {
+		t.Fatalf("Unexpected error on Put: %v", err)
+	}
+	expect("updating a", 2)
+	if err := g.Delete(&CountedName{Name: "a"}); err != nil {
+		t.Fatalf("Unexpected error on Delete: %v", err)
+	}
+	expect("deleting a", 1)
+	if err := g.DeleteMulti([]*CountedName{{Name: "a"}, {Name: "missing"}}); err != nil {
+		t.Fatalf("Unexpected error on DeleteMulti: %v", err)
+	}
+	expect("deleting missing entities", 1)
+	err = g.RunInTransaction(func(tg *Goon) error {
+		_, err := tg.PutMulti([]*CountedName{{Name: "b", Value: 2}, {Name: "c"}})
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction: %v", err)
+	}
+	expect("updating b and creating c in a transaction", 2)
+	if n, err := g.Count(datastore.NewQuery("CountedName")); err != nil || n != 2 {
+		t.Fatalf("Expected an exact count of 2, got %v (%v)", n, err)
+	}
+}
@@ -29,13 +29,16 @@ Key Specifications
 
 For both the Key and KeyError functions, src must be a S or *S for some
 struct type S. The key is extracted based on various fields of S. If a field
-of type int64 or string has a struct tag named goon with value "id", it is
-used as the key's id. If a field of type *datastore.Key has a struct tag
-named goon with value "parent", it is used as the key's parent. If a field
-of type string has a struct tag named goon with value "kind", it is used
-as the key's kind. The "kind" field supports an optional second parameter
-which is the default kind name. If no kind field exists, the struct's name
-is used. These fields should all have their datastore field marked as "-".
+of any integer or string type has a struct tag named goon with value "id", it
+is used as the key's id. Integer ids must fit into an int64. Other id types,
+e.g. UUIDs, must implement encoding.TextMarshaler and
+encoding.TextUnmarshaler, and are used as string ids, where the zero value
+means an incomplete key. If a field of type *datastore.Key has a struct tag
+named goon with value "parent", it is used as the key's parent. If a field of
+type string has a struct tag named goon with value "kind", it is used as the
+key's kind. The "kind" field supports an optional second parameter which is
+the default kind name. If no kind field exists, the struct's name is used.
+These fields should all have their datastore field marked as "-".
 
 Example, with kind User:
 	type User struct {
@@ -61,6 +64,47 @@ An example with both parent and kind:
 		Data   []byte
 	}
 
+The parent field may also hold another goon entity, either as a struct
+pointer or as a struct value. The parent key is then derived from that
+entity, which must have a complete key, and a nil pointer or a zero value
+means no parent. When goon sets the key of a struct, it fills in the key
+fields of the parent entity too:
+
+	type Comment struct {
+		Id   int64 `datastore:"-" goon:"id"`
+		Post *Post `datastore:"-" goon:"parent"`
+		Text string
+	}
+
+Key fields may also be declared in anonymous embedded structs, or pointers
+to them, which allows sharing them between types. A field of the outer
+struct takes precedence over one of the same tag in an embedded struct, and
+two fields with the same tag at the same depth are an error. A nil embedded
+pointer is treated as if its fields were empty, and is allocated when goon
+sets the key:
+
+	type Base struct {
+		Id     int64          `datastore:"-" goon:"id"`
+		Parent *datastore.Key `datastore:"-" goon:"parent"`
+	}
+	type Comment struct {
+		Base
+		Text string
+	}
+
+If a field of type string has a struct tag named goon with value
+"namespace", it is used as the key's namespace. Without such a field,
+or if it is empty, the namespace is taken from the parent key, then from
+Goon.Namespace and finally from the context. A key is always in the same
+namespace as its parent. Goon.Namespace also applies to queries, so a single
+context can serve many tenants:
+
+	type Invoice struct {
+		Id     int64  `datastore:"-" goon:"id"`
+		Tenant string `datastore:"-" goon:"namespace"`
+		Total  int64
+	}
+
 Features
 
 Datastore interaction with: Get, GetMulti, Put, PutMulti, Delete, DeleteMulti, Queries.
@@ -125,6 +169,65 @@ goon:
 	g := &Group{Id: 1}
 	err := n.Get(g)
 
+Contexts
+
+Goon operations use Goon.Context. Every operation also has a variant that
+takes a context, e.g. GetMultiContext, which allows cancelling a single call
+or giving it a deadline without losing the local memory cache of the Goon.
+The memcache timeouts are derived from that context, so they never outlast it.
+
+	ctx, cancel := context.WithTimeout(g.Context, 100*time.Millisecond)
+	defer cancel()
+	err := g.GetMultiContext(ctx, users)
+
+Query Builder
+
+NewQuery builds a query from a sample struct, taking the kind from it like
+Key does, and the ancestor from its parent field. The property names given
+to Filter and Order are checked against the datastore names of the struct's
+fields, so that a typo results in a *QueryFieldError instead of no results:
+
+	var comments []*Comment
+	_, err := g.NewQuery(&Comment{Post: post}).Filter("Likes >", 10).Order("-Likes").GetAll(&comments)
+
+Typed API
+
+The Goon methods accept any value and check its shape at runtime. The generic
+functions Get, GetMulti, Put, PutMulti, Delete and DeleteMulti, together with
+Query, TypedQuery and TypedIterator, check the entity type at compile time
+instead, and return typed results:
+
+	g := goon.NewGoon(r)
+	users, keys, err := goon.Query[User](g, datastore.NewQuery("User")).GetAll()
+
+Pagination
+
+Page runs a query one page at a time, for handlers that show results in pages.
+It returns a token for the next page, which is URL-safe and signed with
+PageTokenKey, so it can be handed to clients as is. Page refuses to run
+until PageTokenKey is set:
+
+	goon.PageTokenKey = []byte("a long random secret")
+
+	var posts []*Post
+	page, err := g.Page(datastore.NewQuery("Post").Order("-Date"), 20, r.FormValue("page"), &posts)
+	if err == nil && page.HasMore {
+		// link to ?page=page.Next
+	}
+
+Multi Queries
+
+GetAllMultiQuery runs several queries concurrently, e.g. one per ancestor or
+namespace shard, and merges their results by a sort order, without repeated
+keys and up to a global limit. The results are cached like with GetAll:
+
+	mq := goon.MultiQuery{
+		Queries: []*datastore.Query{q.Ancestor(a), q.Ancestor(b)},
+		Orders:  []string{"-Date"},
+		Limit:   20,
+	}
+	keys, err := g.GetAllMultiQuery(mq, &posts)
+
 Memcache Control Variance
 
 Memcache is generally fast. When it is slow, goon will timeout the memcache
@@ -142,5 +245,112 @@ the Save() method once and only once per Put/PutMulti call and never elsewhere.
 Similarly the Load() method is guaranteed to be called once and only once per
 Get/GetMulti/GetAll/Next call and never elsewhere.
 
+Cache Invalidation
+
+When something other than goon writes to the datastore, the caches keep
+serving the old entities. InvalidateKeys and InvalidateEntities remove
+specific entities from the local memory cache and memcache, so that the
+next Get fetches them from the datastore. Inside a transaction the removal
+happens once the transaction is committed.
+
+Logging
+
+Everything goon logs goes through Goon.Logger as a structured *LogEntry,
+carrying the operation, kind, key count and storage tier involved.
+The default DefaultLogger writes to appengine/log. Set Goon.Logger to route
+the entries into another logging pipeline, or to inspect them in tests.
+
+Metrics
+
+Set Goon.Metrics to receive counters and timings at every storage tier
+decision, e.g. how many keys GetMulti found in the local cache, memcache
+or the datastore, and how often memcache timed out. MetricsCollector is
+an in-memory implementation, which can also export its contents in the
+Prometheus text format via WritePrometheus.
+
+Tracing
+
+Set Goon.Tracer to have goon open child spans around the local cache
+lookup, the memcache GetMulti loop, every datastore GetMulti batch and every
+memcache population task. The spans carry key counts and payload sizes.
+Adapting a Tracer to any tracing library only requires implementing StartSpan.
+
+Local Cache
+
+The local memory cache evicts the least recently used values by default.
+A single large GetAll can push the whole hot working set out of such a cache,
+so ConfigureLocalCache allows choosing another EvictionPolicy, such as the
+scan-resistant New2QPolicy, and changing the cache size limit.
+
+	g := goon.NewGoon(r)
+	g.ConfigureLocalCache(goon.LocalCacheOptions{Policy: goon.New2QPolicy})
+
+The entities of a kind can be given a byte budget of their own in the local
+memory cache, so that a single large kind can't evict everything else.
+Kinds can also be kept out of the local memory cache or memcache entirely,
+e.g. because they are sensitive or huge:
+
+	goon.RegisterKindCache("Report", goon.KindCacheConfig{LocalBudget: 1 << 20})
+	goon.RegisterKindCache("Secret", goon.KindCacheConfig{NoLocalCache: true, NoMemcache: true})
+
+The results of GetAll ancestor queries can be cached too, as lists of keys,
+with the entities themselves loaded via GetMulti. Every Put and Delete of the
+kind invalidates the cached results of that kind, by increasing a per-kind
+generation counter in memcache which is part of the cache keys. Reading that
+counter costs a memcache round trip per GetAll. Queries without an ancestor
+are eventually consistent and could cache stale results, so they always run
+against the datastore:
+
+	goon.RegisterKindCache("Article", goon.KindCacheConfig{CacheQueries: true})
+
+Queries that are iterated with Run, RunPrefetch or ForEach are always run
+against the datastore, as their results are consumed incrementally.
+
+Counts can be cached in memcache for a while, and are invalidated by writes
+the same way. For dashboards that only need a rough number, ApproximateCount
+reads sharded memcache counters that Put and Delete keep up to date,
+recounting the kind exactly every CountResync:
+
+	goon.RegisterKindCache("Article", goon.KindCacheConfig{CountCacheTTL: time.Minute, CountShards: 8})
+
+GetAllByKeys runs a query as keys-only and loads the entities via GetMulti,
+which is cheaper than GetAll when most of the entities are already cached.
+
+RunPrefetch is like Run for large scans: it fetches the next batch of results
+in a goroutine while the current one is consumed, with Next or NextBatch, and
+caches every batch with a single SetMulti instead of one Set per entity. The
+goroutine starts with the first Next, and the Iterator must be closed with
+Close to stop it:
+
+	t := g.RunPrefetch(datastore.NewQuery("User"), 500)
+	defer t.Close()
+
+ForEach streams the results of a query into a callback with the same
+batching, so that even huge exports use a bounded amount of memory. The
+callback can stop early with ErrStopIteration, and can save a cursor to
+resume from later:
+
+	var u User
+	err := g.ForEach(datastore.NewQuery("User"), &u, func(key *datastore.Key, cursor func() (datastore.Cursor, error)) error {
+		return export(&u)
+	})
+
+Projection and distinct queries work with GetAll and Run, but only set the
+projected fields and the goon key fields of the results. Such partial
+entities are never cached, and neither are the results of the queries.
+
+When a single Goon is shared by many goroutines, LocalCacheOptions.Shards
+splits the cache into independently locked shards to reduce lock contention.
+GetMulti takes the lock of every shard that holds one of its keys, so
+sharding only pays off when the goroutines run on multiple CPUs.
+
+Errors
+
+Errors created by goon can be inspected with errors.Is and errors.As.
+For example, errors.Is(err, goon.ErrInvalidKeyStruct) reports whether the
+goon key fields of a struct are declared incorrectly, and errors.As with a
+*goon.KeyFieldError reveals which struct and tag are at fault.
+NotFound also works with wrapped errors.
+
 */
 package goon
@@ -18,11 +18,11 @@ package goon
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"reflect"
-	"strings"
 	"sync"
 	"time"
 
@@ -36,7 +36,7 @@ type KindNameResolver func(src interface{}) string
 
 // ### Entity serialization ###
 
-const serializationFormatVersion = 5 // Increase this whenever the format changes
+const serializationFormatVersion = 6 // Increase this whenever the format changes
 
 // The entities are encoded to bytes with little endian ordering, as follows:
 //
@@ -180,7 +180,7 @@ func fromUnixMicro(t int64) time.Time {
 func serializeProperty(buf *bytes.Buffer, p *datastore.Property) error {
 	nameLen := len(p.Name)
 	if nameLen > propMaxNameLength {
-		return fmt.Errorf("Maximum property name length is %d, but received %d", propMaxNameLength, nameLen)
+		return fmt.Errorf("%w: maximum length is %d, but received %d", ErrPropertyNameTooLong, propMaxNameLength, nameLen)
 	}
 	writeInt16(buf, nameLen)
 	if nameLen > 0 {
@@ -320,7 +320,7 @@ func serializeProperty(buf *bytes.Buffer, p *datastore.Property) error {
 		unsupported = true
 	}
 	if unsupported {
-		return fmt.Errorf("unsupported datastore.Property value type: " + v.Type().String())
+		return &PropertyError{Name: p.Name, Type: v.Type().String()}
 	}
 	return nil
 }
@@ -329,7 +329,7 @@ func deserializeProperty(buf *bytes.Buffer, prop *datastore.Property) error {
 	next := func(n int) ([]byte, error) {
 		b := buf.Next(n)
 		if bLen := len(b); bLen != n {
-			return b, fmt.Errorf("Buffer EOF, expected %d bytes but got %v", n, bLen)
+			return b, fmt.Errorf("%w: buffer EOF, expected %d bytes but got %v", ErrCorruptCacheData, n, bLen)
 		}
 		return b, nil
 	}
@@ -490,7 +490,7 @@ func deserializeProperty(buf *bytes.Buffer, prop *datastore.Property) error {
 			}
 		}
 	default:
-		return fmt.Errorf("Unrecognized value type %d", valueType)
+		return fmt.Errorf("%w: unrecognized value type %d", ErrCorruptCacheData, valueType)
 	}
 
 	return nil
@@ -502,7 +502,7 @@ func serializeStruct(src interface{}) ([]byte, error) {
 		return serializeProperties(nil, false)
 	}
 	if k := reflect.Indirect(reflect.ValueOf(src)).Type().Kind(); k != reflect.Struct {
-		return nil, fmt.Errorf("goon: Expected struct, got instead: %v", k)
+		return nil, &TypeError{Expected: "struct", Got: k.String()}
 	}
 
 	var err error
@@ -550,10 +550,12 @@ func serializeProperties(props []datastore.Property, exists bool) ([]byte, error
 // deserializeStruct takes portable bytes b, generated by serializeStruct, and assigns correct values to struct dst.
 func deserializeStruct(dst interface{}, b []byte) error {
 	if len(b) == 0 {
-		return fmt.Errorf("goon: Expected some data to deserialize, got none.")
+		return fmt.Errorf("%w: expected some data to deserialize, got none", ErrCorruptCacheData)
+	} else if len(b) < 4 {
+		return fmt.Errorf("%w: expected a 4 byte header, got %v bytes", ErrCorruptCacheData, len(b))
 	}
 	if k := reflect.Indirect(reflect.ValueOf(dst)).Type().Kind(); k != reflect.Struct {
-		return fmt.Errorf("goon: Expected struct, got instead: %v", k)
+		return &TypeError{Expected: "struct", Got: k.String()}
 	}
 
 	// Deserialize the header
@@ -578,7 +580,7 @@ func deserializeStruct(dst interface{}, b []byte) error {
 // deserializeProperties takes a slice of properties and assigns correct values to struct dst.
 func deserializeProperties(dst interface{}, props []datastore.Property) error {
 	if k := reflect.Indirect(reflect.ValueOf(dst)).Type().Kind(); k != reflect.Struct {
-		return fmt.Errorf("goon: Expected struct, got instead: %v", k)
+		return &TypeError{Expected: "struct", Got: k.String()}
 	}
 	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
 		return pls.Load(props)
@@ -587,15 +589,21 @@ func deserializeProperties(dst interface{}, props []datastore.Property) error {
 }
 
 // getStructKey returns the key of the struct based in its reflected or
-// specified kind and id. The second return parameter is true if src has a
-// string id.
-func (g *Goon) getStructKey(src interface{}) (key *datastore.Key, hasStringId bool, err error) {
+// specified kind and id, created with the context c. The second return
+// parameter is true if src has a string id.
+func (g *Goon) getStructKey(c context.Context, src interface{}) (key *datastore.Key, hasStringId bool, err error) {
 	v := reflect.Indirect(reflect.ValueOf(src))
 	t := v.Type()
 	k := t.Kind()
 
 	if k != reflect.Struct {
-		err = fmt.Errorf("goon: Expected struct, got instead: %v", k)
+		err = &TypeError{Expected: "struct", Got: k.String()}
+		return
+	}
+
+	kf := getKeyFields(t)
+	if kf.err != nil {
+		err = kf.err
 		return
 	}
 
@@ -603,66 +611,121 @@ func (g *Goon) getStructKey(src interface{}) (key *datastore.Key, hasStringId bo
 	var stringID string
 	var intID int64
 	var kind string
-
-	for i := 0; i < v.NumField(); i++ {
-		tf := t.Field(i)
-		vf := v.Field(i)
-
-		tag := tf.Tag.Get("goon")
-		tagValues := strings.Split(tag, ",")
-		if len(tagValues) > 0 {
-			tagValue := tagValues[0]
-			if tagValue == "id" {
-				switch vf.Kind() {
-				case reflect.Int64:
-					if intID != 0 || stringID != "" {
-						err = fmt.Errorf("goon: Only one field may be marked id")
-						return
-					}
-					intID = vf.Int()
-				case reflect.String:
-					if intID != 0 || stringID != "" {
-						err = fmt.Errorf("goon: Only one field may be marked id")
-						return
-					}
-					stringID = vf.String()
-					hasStringId = true
-				default:
-					err = fmt.Errorf("goon: ID field must be int64 or string in %v", t.Name())
-					return
-				}
-			} else if tagValue == "kind" {
-				if vf.Kind() == reflect.String {
-					if kind != "" {
-						err = fmt.Errorf("goon: Only one field may be marked kind")
-						return
-					}
-					kind = vf.String()
-					if kind == "" && len(tagValues) > 1 && tagValues[1] != "" {
-						kind = tagValues[1]
-					}
-				}
-			} else if tagValue == "parent" {
-				dskeyType := reflect.TypeOf(&datastore.Key{})
-				if vf.Type().ConvertibleTo(dskeyType) {
-					if parent != nil {
-						err = fmt.Errorf("goon: Only one field may be marked parent")
-						return
-					}
-					parent = vf.Convert(dskeyType).Interface().(*datastore.Key)
-				}
+	var namespace string
+
+	// Fields inside nil embedded struct pointers are treated as empty
+	if kf.id != nil {
+		hasStringId = kf.idType == idString || kf.idType == idText
+		if vf, ok := fieldByIndex(v, kf.id.index, false); ok {
+			if stringID, intID, err = getId(vf, kf.idType); err != nil {
+				return
 			}
 		}
 	}
+	if kf.kind != nil {
+		if vf, ok := fieldByIndex(v, kf.kind.index, false); ok {
+			kind = vf.String()
+		}
+		if kind == "" {
+			kind = kf.kindDefault
+		}
+	}
+	if kf.parent != nil {
+		if vf, ok := fieldByIndex(v, kf.parent.index, false); ok {
+			if parent, err = g.getParentKey(c, vf, kf.parentType); err != nil {
+				return
+			}
+		}
+	}
+	if kf.namespace != nil {
+		if vf, ok := fieldByIndex(v, kf.namespace.index, false); ok {
+			namespace = vf.String()
+		}
+	}
 
 	// if kind has not been manually set, fetch it from src's type
 	if kind == "" {
 		kind = g.KindNameResolver(src)
 	}
-	key = datastore.NewKey(g.Context, kind, stringID, intID, parent)
+	if parent != nil {
+		// the key must be in the same namespace as its parent
+		if namespace != "" && namespace != parent.Namespace() {
+			err = &KeyFieldError{Struct: t.Name(), Tag: "namespace", Reason: "Namespace must match the namespace of the parent"}
+			return
+		}
+		c, err = appengine.Namespace(c, parent.Namespace())
+	} else {
+		c, err = g.namespaceContext(c, namespace)
+	}
+	if err != nil {
+		return
+	}
+	key = datastore.NewKey(c, kind, stringID, intID, parent)
 	return
 }
 
+// getParentKey returns the parent key held by the parent field vf of type pt.
+// Parent entities have their key derived recursively, and must have a complete key.
+func (g *Goon) getParentKey(c context.Context, vf reflect.Value, pt parentType) (*datastore.Key, error) {
+	switch pt {
+	case parentStructPtr:
+		if vf.IsNil() {
+			return nil, nil
+		}
+	case parentStruct:
+		if vf.IsZero() {
+			return nil, nil
+		}
+	default:
+		return vf.Convert(keyType).Interface().(*datastore.Key), nil
+	}
+	parent, _, err := g.getStructKey(c, vf.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if parent.Incomplete() {
+		return nil, &KeyFieldError{Struct: vf.Type().String(), Tag: "parent", Reason: "Parent entity must have a complete key"}
+	}
+	return parent, nil
+}
+
+// setParent stores the key parent in the parent field vf of type pt.
+// Parent entities have their key fields set recursively, allocating them if needed.
+func (g *Goon) setParent(vf reflect.Value, pt parentType, parent *datastore.Key) error {
+	switch pt {
+	case parentStructPtr:
+		if parent == nil {
+			vf.Set(reflect.Zero(vf.Type()))
+			return nil
+		}
+		if vf.IsNil() {
+			vf.Set(reflect.New(vf.Type().Elem()))
+		}
+		return g.setStructKey(vf.Interface(), parent)
+	case parentStruct:
+		if parent == nil {
+			vf.Set(reflect.Zero(vf.Type()))
+			return nil
+		}
+		return g.setStructKey(vf.Addr().Interface(), parent)
+	}
+	vf.Set(reflect.ValueOf(parent).Convert(vf.Type()))
+	return nil
+}
+
+// namespaceContext returns c with the namespace ns.
+// If ns is empty, then Goon.Namespace is used instead, and if that is empty
+// too, then c is left with the namespace it already has.
+func (g *Goon) namespaceContext(c context.Context, ns string) (context.Context, error) {
+	if ns == "" {
+		ns = g.Namespace
+	}
+	if ns == "" {
+		return c, nil
+	}
+	return appengine.Namespace(c, ns)
+}
+
 // DefaultKindName is the default implementation to determine the Kind
 // an Entity has. Returns the basic Type of the src (no package name included).
 func DefaultKindName(src interface{}) string {
@@ -678,7 +741,7 @@ func (g *Goon) setStructKey(src interface{}, key *datastore.Key) error {
 	k := t.Kind()
 
 	if k != reflect.Ptr {
-		return fmt.Errorf("goon: Expected pointer to struct, got instead: %v", k)
+		return &TypeError{Expected: "pointer to struct", Got: k.String()}
 	}
 
 	v = reflect.Indirect(v)
@@ -686,63 +749,43 @@ func (g *Goon) setStructKey(src interface{}, key *datastore.Key) error {
 	k = t.Kind()
 
 	if k != reflect.Struct {
-		return fmt.Errorf(fmt.Sprintf("goon: Expected struct, got instead: %v", k))
-	}
-
-	idSet := false
-	kindSet := false
-	parentSet := false
-	for i := 0; i < v.NumField(); i++ {
-		tf := t.Field(i)
-		vf := v.Field(i)
-
-		if !vf.CanSet() {
-			continue
-		}
-
-		tag := tf.Tag.Get("goon")
-		tagValues := strings.Split(tag, ",")
-		if len(tagValues) > 0 {
-			tagValue := tagValues[0]
-			if tagValue == "id" {
-				if idSet {
-					return fmt.Errorf("goon: Only one field may be marked id")
-				}
-
-				switch vf.Kind() {
-				case reflect.Int64:
-					vf.SetInt(key.IntID())
-					idSet = true
-				case reflect.String:
-					vf.SetString(key.StringID())
-					idSet = true
-				}
-			} else if tagValue == "kind" {
-				if kindSet {
-					return fmt.Errorf("goon: Only one field may be marked kind")
-				}
-				if vf.Kind() == reflect.String {
-					if (len(tagValues) <= 1 || key.Kind() != tagValues[1]) && g.KindNameResolver(src) != key.Kind() {
-						vf.Set(reflect.ValueOf(key.Kind()))
-					}
-					kindSet = true
-				}
-			} else if tagValue == "parent" {
-				if parentSet {
-					return fmt.Errorf("goon: Only one field may be marked parent")
-				}
-				dskeyType := reflect.TypeOf(&datastore.Key{})
-				vfType := vf.Type()
-				if vfType.ConvertibleTo(dskeyType) {
-					vf.Set(reflect.ValueOf(key.Parent()).Convert(vfType))
-					parentSet = true
-				}
+		return &TypeError{Expected: "struct", Got: k.String()}
+	}
+
+	kf := getKeyFields(t)
+	if kf.err != nil {
+		return kf.err
+	}
+	// Nil embedded struct pointers on the way to the fields are allocated
+	var idField reflect.Value
+	ok := kf.id != nil && kf.id.settable
+	if ok {
+		idField, ok = fieldByIndex(v, kf.id.index, true)
+	}
+	if !ok {
+		return &KeyFieldError{Struct: t.Name(), Tag: "id", Reason: "Could not set id field"}
+	}
+	if err := setId(idField, kf.idType, key); err != nil {
+		return err
+	}
+	if kf.kind != nil && kf.kind.settable {
+		if key.Kind() != kf.kindDefault && g.KindNameResolver(src) != key.Kind() {
+			if vf, ok := fieldByIndex(v, kf.kind.index, true); ok {
+				vf.SetString(key.Kind())
 			}
 		}
 	}
-
-	if !idSet {
-		return fmt.Errorf("goon: Could not set id field")
+	if kf.parent != nil && kf.parent.settable {
+		if vf, ok := fieldByIndex(v, kf.parent.index, true); ok {
+			if err := g.setParent(vf, kf.parentType, key.Parent()); err != nil {
+				return err
+			}
+		}
+	}
+	if kf.namespace != nil && kf.namespace.settable {
+		if vf, ok := fieldByIndex(v, kf.namespace.index, true); ok {
+			vf.SetString(key.Namespace())
+		}
 	}
 
 	return nil
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidType is returned when a value of an unsupported type is given
+	// to goon, e.g. a non-pointer to Get or a non-slice to GetMulti.
+	// The actual error is usually a *TypeError wrapping ErrInvalidType.
+	ErrInvalidType = errors.New("goon: invalid type")
+	// ErrInvalidKeyStruct is returned when the goon key fields of a struct
+	// are declared incorrectly, e.g. when more than one field is marked id.
+	// The actual error is usually a *KeyFieldError wrapping ErrInvalidKeyStruct.
+	ErrInvalidKeyStruct = errors.New("goon: invalid key struct")
+	// ErrIncompleteKey is returned when an operation requires a complete key,
+	// but the struct given to it only results in an incomplete key.
+	ErrIncompleteKey = errors.New("goon: incomplete key")
+	// ErrUnsupportedPropertyType is returned when a property can't be serialized,
+	// because its value type isn't supported by the datastore.
+	// The actual error is usually a *PropertyError wrapping ErrUnsupportedPropertyType.
+	ErrUnsupportedPropertyType = errors.New("goon: unsupported property type")
+	// ErrPropertyNameTooLong is returned when a property name is longer
+	// than what the goon serialization format supports.
+	ErrPropertyNameTooLong = errors.New("goon: property name too long")
+	// ErrCorruptCacheData is returned when cached entity data or cached query
+	// results can't be deserialized.
+	ErrCorruptCacheData = errors.New("goon: corrupt cache data")
+	// ErrUnknownQueryField is returned when a QueryBuilder filters or orders by
+	// a property that the struct it was built from doesn't have.
+	// The actual error is usually a *QueryFieldError wrapping ErrUnknownQueryField.
+	ErrUnknownQueryField = errors.New("goon: unknown query field")
+	// ErrInvalidPageToken is returned by Page when the page token is malformed,
+	// was tampered with, or belongs to a query of another kind or namespace.
+	ErrInvalidPageToken = errors.New("goon: invalid page token")
+	// ErrInvalidPageSize is returned by Page when the page size isn't positive.
+	ErrInvalidPageSize = errors.New("goon: invalid page size")
+	// ErrNoPageTokenKey is returned by Page when PageTokenKey isn't set,
+	// as the page tokens could be forged without it.
+	ErrNoPageTokenKey = errors.New("goon: PageTokenKey is not set")
+	// ErrInvalidMultiQuery is returned by GetAllMultiQuery when the MultiQuery
+	// is inconsistent or asks for something that merging doesn't support.
+	ErrInvalidMultiQuery = errors.New("goon: invalid MultiQuery")
+	// ErrStopIteration can be returned by the function given to ForEach
+	// to stop the iteration early, which ForEach doesn't return.
+	ErrStopIteration = errors.New("goon: stop iteration")
+)
+
+// TypeError describes a value that goon received, but can't work with.
+type TypeError struct {
+	Expected string // Description of what was expected, e.g. "pointer to a struct"
+	Got      string // Description of what was received instead
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("goon: Expected %v, got instead: %v", e.Expected, e.Got)
+}
+
+// Unwrap returns ErrInvalidType.
+func (e *TypeError) Unwrap() error {
+	return ErrInvalidType
+}
+
+// KeyFieldError describes a struct whose goon key fields are invalid.
+type KeyFieldError struct {
+	Struct string // Name of the struct type
+	Tag    string // The offending goon tag, e.g. "id"
+	Reason string // Human readable description of the problem
+}
+
+func (e *KeyFieldError) Error() string {
+	if e.Struct == "" {
+		return "goon: " + e.Reason
+	}
+	return fmt.Sprintf("goon: %v in %v", e.Reason, e.Struct)
+}
+
+// Unwrap returns ErrInvalidKeyStruct.
+func (e *KeyFieldError) Unwrap() error {
+	return ErrInvalidKeyStruct
+}
+
+// PropertyError describes a property whose value can't be serialized.
+type PropertyError struct {
+	Name string // Name of the property
+	Type string // Type of the property value
+}
+
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("goon: unsupported datastore.Property value type: %v (property %q)", e.Type, e.Name)
+}
+
+// Unwrap returns ErrUnsupportedPropertyType.
+func (e *PropertyError) Unwrap() error {
+	return ErrUnsupportedPropertyType
+}
+
+// QueryFieldError describes a query property that doesn't exist in a struct.
+type QueryFieldError struct {
+	Struct string // Name of the struct type
+	Field  string // The property name used in the query
+	Op     string // The query operation, e.g. "Filter" or "Order"
+}
+
+func (e *QueryFieldError) Error() string {
+	return fmt.Sprintf("goon: %v on unknown property %q of %v", e.Op, e.Field, e.Struct)
+}
+
+// Unwrap returns ErrUnknownQueryField.
+func (e *QueryFieldError) Unwrap() error {
+	return ErrUnknownQueryField
+}
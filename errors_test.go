@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type badIdType struct {
+	Id float64 `datastore:"-" goon:"id"`
+}
+
+func TestErrorTypes(t *testing.T) {
+	g := FromContext(offlineContext())
+
+	// Key struct errors
+	_, err := g.KeyError(TwoId{IntId: 1, StringId: "1"})
+	if !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected ErrInvalidKeyStruct, got %v", err)
+	}
+	var kfe *KeyFieldError
+	if !errors.As(err, &kfe) {
+		t.Fatalf("Expected *KeyFieldError, got %T", err)
+	} else if kfe.Tag != "id" || kfe.Struct != "TwoId" {
+		t.Fatalf("Unexpected KeyFieldError contents: %+v", kfe)
+	}
+	if _, err := g.KeyError(badIdType{Id: 1}); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected ErrInvalidKeyStruct, got %v", err)
+	}
+
+	// Type errors
+	var te *TypeError
+	if err := g.Get(HasId{Id: 1}); !errors.Is(err, ErrInvalidType) || !errors.As(err, &te) {
+		t.Fatalf("Expected *TypeError, got %v", err)
+	}
+	if _, err := g.KeyError(5); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Expected ErrInvalidType, got %v", err)
+	}
+	if err := g.GetMulti(&HasId{}); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Expected ErrInvalidType, got %v", err)
+	}
+
+	// Incomplete keys
+	if err := g.GetMulti([]*HasId{{Id: 0}}); !errors.Is(err, ErrIncompleteKey) {
+		t.Fatalf("Expected ErrIncompleteKey, got %v", err)
+	}
+	if _, err := g.PutMulti([]*HasString{{}}); !errors.Is(err, ErrIncompleteKey) {
+		t.Fatalf("Expected ErrIncompleteKey, got %v", err)
+	}
+
+	// Property errors
+	buf := &bytes.Buffer{}
+	err = serializeProperty(buf, &datastore.Property{Name: "Foo", Value: int32(5)})
+	var pe *PropertyError
+	if !errors.Is(err, ErrUnsupportedPropertyType) || !errors.As(err, &pe) {
+		t.Fatalf("Expected *PropertyError, got %v", err)
+	} else if pe.Name != "Foo" || pe.Type != "int32" {
+		t.Fatalf("Unexpected PropertyError contents: %+v", pe)
+	}
+
+	// Cache data errors
+	if err := deserializeStruct(&HasId{}, nil); !errors.Is(err, ErrCorruptCacheData) {
+		t.Fatalf("Expected ErrCorruptCacheData, got %v", err)
+	}
+	if err := deserializeStruct(&HasId{}, []byte{0xff}); !errors.Is(err, ErrCorruptCacheData) {
+		t.Fatalf("Expected ErrCorruptCacheData for a truncated header, got %v", err)
+	}
+	if err := deserializeStruct(&HasId{}, []byte{1, 0, 0, 0x40}); !errors.Is(err, ErrCorruptCacheData) {
+		t.Fatalf("Expected ErrCorruptCacheData, got %v", err)
+	}
+}
+
+func TestWrappedErrors(t *testing.T) {
+	merr := appengine.MultiError{nil, fmt.Errorf("wrapped: %w", datastore.ErrNoSuchEntity)}
+	wrapped := fmt.Errorf("context: %w", merr)
+
+	if NotFound(wrapped, 0) {
+		t.Fatalf("Expected index 0 to be found")
+	}
+	if !NotFound(wrapped, 1) {
+		t.Fatalf("Expected index 1 to be not found")
+	}
+	if NotFound(wrapped, 2) || NotFound(wrapped, -1) {
+		t.Fatalf("Expected out of range indices to be found")
+	}
+
+	// realError must keep the MultiError form for wrapped ErrNoSuchEntity
+	single := appengine.MultiError{merr[1], merr[1]}
+	if _, ok := realError(single).(appengine.MultiError); !ok {
+		t.Fatalf("Expected realError to return a MultiError")
+	}
+
+	// .. and for wrapped *datastore.ErrFieldMismatch
+	fm := fmt.Errorf("wrapped: %w", &datastore.ErrFieldMismatch{FieldName: "Foo"})
+	if !errFieldMismatch(fm) {
+		t.Fatalf("Expected errFieldMismatch to see through wrapping")
+	}
+	if _, ok := realError(appengine.MultiError{fm, fm}).(appengine.MultiError); !ok {
+		t.Fatalf("Expected realError to return a MultiError")
+	}
+
+	// Identical errors still collapse into a single error
+	other := errors.New("other")
+	if err := realError(appengine.MultiError{other, other}); err != other {
+		t.Fatalf("Expected %v, got %v", other, err)
+	}
+}
@@ -1,10 +1,15 @@
 module github.com/mjibson/goon
 
-go 1.9
+go 1.18
 
 require (
 	github.com/golang/protobuf v1.2.0
 	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
 	google.golang.org/appengine v1.3.0
 )
+
+require (
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+)
@@ -19,25 +19,24 @@ package goon
 import (
 	"context"
 	"encoding/ascii85"
+	"errors"
 	"fmt"
 	"net/http"
-	"path/filepath"
 	"reflect"
-	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/blake2b"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
 var (
-	// LogErrors issues appengine.Context.Errorf on any error.
+	// LogErrors decides whether DefaultLogger issues log.Errorf on any error.
 	LogErrors = true
-	// LogTimeoutErrors issues appengine.Context.Warningf on memcache timeout errors.
+	// LogTimeoutErrors decides whether DefaultLogger issues log.Warningf on memcache timeout errors.
 	LogTimeoutErrors = false
 
 	// MemcachePutTimeoutThreshold is the number of bytes after which the large
@@ -73,16 +72,44 @@ var (
 // Goon holds the app engine context and the request memory cache.
 type Goon struct {
 	Context       context.Context
-	cache         *cache
+	cache         localCache
+	cacheOpts     LocalCacheOptions
+	kindCacheLock sync.Mutex   // serializes changes of kindCaches and cacheOpts
+	kindCaches    atomic.Value // map[string]localCache, replaced as a whole so that lookups don't need a lock
 	inTransaction bool
-	txnCacheLock  sync.Mutex // protects toDelete / toDeleteMC
+	txnCacheLock  sync.Mutex // protects toDelete / toDeleteMC / toBump / countDeltas
 	toDelete      map[string]struct{}
 	toDeleteMC    map[string]struct{}
+	toBump        map[queryKind]struct{}
+	countDeltas   map[queryKind]int64
 	// KindNameResolver is used to determine what Kind to give an Entity.
 	// Defaults to DefaultKindName
 	KindNameResolver KindNameResolver
+	// Logger receives all the messages that goon logs.
+	// Defaults to DefaultLogger
+	Logger Logger
+	// Metrics receives counters and timings of the storage tiers.
+	// Defaults to nil, which means no metrics are collected.
+	Metrics Metrics
+	// Tracer creates spans around the calls to the storage tiers.
+	// Defaults to nil, which means nothing is traced.
+	Tracer Tracer
+	// Namespace is used for the keys of structs that don't get a namespace
+	// from a goon:"namespace" field or from their parent key, and for queries.
+	// Defaults to an empty string, which means the namespace of Context.
+	Namespace string
 }
 
+// Tier identifies one of the storage tiers that goon uses.
+type Tier string
+
+// The storage tiers, from fastest to slowest.
+const (
+	TierLocal     Tier = "local"
+	TierMemcache  Tier = "memcache"
+	TierDatastore Tier = "datastore"
+)
+
 // MemcacheKey returns the string form of the provided datastore key.
 var MemcacheKey = func(k *datastore.Key) string {
 	return k.Encode()
@@ -91,38 +118,51 @@ var MemcacheKey = func(k *datastore.Key) string {
 // Versioning, so that incompatible changes to the cache system won't cause problems
 var cacheKeyPrefix = fmt.Sprintf("g%X:", serializationFormatVersion)
 
+// The prefix of cache keys in a namespace, which is followed by the namespace and a colon.
+// Namespaces can't contain colons, so these keys never collide with cacheKeyPrefix keys.
+var cacheKeyNamespacePrefix = fmt.Sprintf("g%X@", serializationFormatVersion)
+
 // cacheKey returns the fully legal string key used for cache systems
 func cacheKey(k *datastore.Key) string {
 	// By default we just use the prefix + MemcacheKey result
 	key := cacheKeyPrefix + MemcacheKey(k)
+	// Keys in a namespace also include the namespace, because MemcacheKey may not
+	if ns := k.Namespace(); ns != "" {
+		key = cacheKeyNamespacePrefix + ns + ":" + MemcacheKey(k)
+	}
 	// However if the resulting key length exceeds the maximum allowed ..
 	if len(key) > memcacheMaxKeySize {
 		// .. then we need to shorten it while still staying unique.
-		// We pass the key through the BLAKE2b hash function,
-		// which is cryptographically secure but also very fast.
-		// We request an output of 24 bytes (192-bit) for speed reasons.
-		h, err := blake2b.New(24, nil)
-		if err != nil {
-			panic(fmt.Sprintf("Unexpected error initializing blake2b: %v", err))
-		}
-		h.Write([]byte(key))
-		hash := h.Sum(make([]byte, 0, 24))
-		// After hashing, we encode the results with ascii85.
-		// Ascii85 works in 4 byte chunks, generating 5 letters for each.
-		// Which means we turn our 24 byte hash into a 30 letter string.
-		//
-		// We want letters instead of using the hash directly for debug reasons.
-		// As it will be easier for people to observe & manage keys manually.
-		//
-		// We aim the length of 30, because 32 is the maximum length
-		// where the Go std map does key lookups directly without hashing.
-		encoded := make([]byte, 30, 30)
-		ascii85.Encode(encoded, hash)
-		key = string(encoded)
+		key = hashCacheKey(key)
 	}
 	return key
 }
 
+// hashCacheKey returns a unique 30 letter string for key.
+func hashCacheKey(key string) string {
+	// We pass the key through the BLAKE2b hash function,
+	// which is cryptographically secure but also very fast.
+	// We request an output of 24 bytes (192-bit) for speed reasons.
+	h, err := blake2b.New(24, nil)
+	if err != nil {
+		panic(fmt.Sprintf("Unexpected error initializing blake2b: %v", err))
+	}
+	h.Write([]byte(key))
+	hash := h.Sum(make([]byte, 0, 24))
+	// After hashing, we encode the results with ascii85.
+	// Ascii85 works in 4 byte chunks, generating 5 letters for each.
+	// Which means we turn our 24 byte hash into a 30 letter string.
+	//
+	// We want letters instead of using the hash directly for debug reasons.
+	// As it will be easier for people to observe & manage keys manually.
+	//
+	// We aim the length of 30, because 32 is the maximum length
+	// where the Go std map does key lookups directly without hashing.
+	encoded := make([]byte, 30, 30)
+	ascii85.Encode(encoded, hash)
+	return string(encoded)
+}
+
 // Returns the duration that should be used for a memcache.GetMulti timeout.
 func memcacheGetTimeout(keyCount int) time.Duration {
 	// Takes the number of keys given to memcache.GetMulti,
@@ -179,67 +219,28 @@ func FromContext(c context.Context) *Goon {
 		Context:          c,
 		cache:            newCache(defaultCacheLimit),
 		KindNameResolver: DefaultKindName,
+		Logger:           DefaultLogger,
 	}
 }
 
-func (g *Goon) error(err error) {
-	if !LogErrors {
-		return
-	}
-	_, filename, line, ok := runtime.Caller(1)
-	if ok {
-		log.Errorf(g.Context, "goon - %s:%d - %v", filepath.Base(filename), line, err)
-	} else {
-		log.Errorf(g.Context, "goon - %v", err)
-	}
-}
-
-func (g *Goon) timeoutError(err error) {
-	if LogTimeoutErrors {
-		log.Warningf(g.Context, "goon memcache timeout: %v", err)
-	}
-}
-
-func (g *Goon) memcacheDeleteError(err error) {
-	if err == nil || !LogErrors {
-		return
-	}
-	if me, ok := err.(appengine.MultiError); ok {
-		for i := range me {
-			if me[i] != nil && me[i] != memcache.ErrCacheMiss {
-				err = me[i]
-				goto reportError
-			}
-		}
-		return
-	}
-reportError:
-	_, filename, line, ok := runtime.Caller(1)
-	if ok {
-		log.Errorf(g.Context, "goon - %s:%d - memcache.DeleteMulti failed: %v - the goon cache may be out of sync now!", filepath.Base(filename), line, err)
-	} else {
-		log.Errorf(g.Context, "goon - memcache.DeleteMulti failed: %v - the goon cache may be out of sync now!", err)
-	}
-}
-
-func (g *Goon) extractKeys(src interface{}, putRequest bool) ([]*datastore.Key, error) {
+func (g *Goon) extractKeys(c context.Context, src interface{}, putRequest bool) ([]*datastore.Key, error) {
 	v := reflect.Indirect(reflect.ValueOf(src))
 	if v.Kind() != reflect.Slice {
-		return nil, fmt.Errorf("goon: value must be a slice or pointer-to-slice")
+		return nil, &TypeError{Expected: "slice or pointer-to-slice", Got: v.Kind().String()}
 	}
 	l := v.Len()
 
 	keys := make([]*datastore.Key, l)
 	for i := 0; i < l; i++ {
 		vi := v.Index(i)
-		key, hasStringId, err := g.getStructKey(vi.Interface())
+		key, hasStringId, err := g.getStructKey(c, vi.Interface())
 		if err != nil {
 			return nil, err
 		}
 		if !putRequest && key.Incomplete() {
-			return nil, fmt.Errorf("goon: cannot find a key for struct - %v", vi.Interface())
+			return nil, fmt.Errorf("%w: cannot find a key for struct - %v", ErrIncompleteKey, vi.Interface())
 		} else if putRequest && key.Incomplete() && hasStringId {
-			return nil, fmt.Errorf("goon: empty string id on put")
+			return nil, fmt.Errorf("%w: empty string id on put", ErrIncompleteKey)
 		}
 		keys[i] = key
 	}
@@ -265,7 +266,7 @@ func (g *Goon) Kind(src interface{}) string {
 
 // KeyError returns the key of src based on its properties.
 func (g *Goon) KeyError(src interface{}) (*datastore.Key, error) {
-	key, _, err := g.getStructKey(src)
+	key, _, err := g.getStructKey(g.Context, src)
 	return key, err
 }
 
@@ -276,14 +277,31 @@ func (g *Goon) KeyError(src interface{}) (*datastore.Key, error) {
 // Otherwise similar to appengine/datastore.RunInTransaction:
 // https://developers.google.com/appengine/docs/go/datastore/reference#RunInTransaction
 func (g *Goon) RunInTransaction(f func(tg *Goon) error, opts *datastore.TransactionOptions) error {
+	return g.RunInTransactionContext(g.Context, f, opts)
+}
+
+// RunInTransactionContext is like RunInTransaction, but the transaction
+// context tg.Context is derived from c instead of g.Context.
+//
+// The *Context methods of tg, e.g. tg.PutMultiContext(c, src), stay in the
+// transaction whatever context they are given: they take only the deadline
+// and cancellation of c, and everything else, including the namespace, from
+// tg.Context.
+func (g *Goon) RunInTransactionContext(c context.Context, f func(tg *Goon) error, opts *datastore.TransactionOptions) error {
 	var ng *Goon
-	err := datastore.RunInTransaction(g.Context, func(tc context.Context) error {
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
 		ng = &Goon{
 			Context:          tc,
 			inTransaction:    true,
 			toDelete:         make(map[string]struct{}),
 			toDeleteMC:       make(map[string]struct{}),
+			toBump:           make(map[queryKind]struct{}),
+			countDeltas:      make(map[queryKind]int64),
 			KindNameResolver: g.KindNameResolver,
+			Logger:           g.Logger,
+			Metrics:          g.Metrics,
+			Tracer:           g.Tracer,
+			Namespace:        g.Namespace,
 		}
 		return f(ng)
 	}, opts)
@@ -296,27 +314,71 @@ func (g *Goon) RunInTransaction(f func(tg *Goon) error, opts *datastore.Transact
 			for k := range ng.toDeleteMC {
 				memkeys = append(memkeys, k)
 			}
-			g.memcacheDeleteError(memcache.DeleteMulti(g.Context, memkeys))
+			start := time.Now()
+			g.memcacheDeleteError(c, &LogEntry{Op: "RunInTransaction", KeyCount: len(memkeys), Err: memcache.DeleteMulti(c, memkeys)})
+			g.timing("RunInTransaction", TierMemcache, start)
+			g.count("RunInTransaction", TierMemcache, MetricDelete, len(memkeys))
+		}
+		if len(ng.toDelete) > 0 {
+			cachekeys := make([]string, 0, len(ng.toDelete))
+			for k := range ng.toDelete {
+				cachekeys = append(cachekeys, k)
+			}
+			g.localDeleteMulti(cachekeys)
+		}
+		g.count("RunInTransaction", TierLocal, MetricDelete, len(ng.toDelete))
+		if len(ng.toBump) > 0 {
+			qks := make([]queryKind, 0, len(ng.toBump))
+			for qk := range ng.toBump {
+				qks = append(qks, qk)
+			}
+			g.incrementQueryGenerations(c, "RunInTransaction", qks)
 		}
-		for k := range ng.toDelete {
-			g.cache.Delete(k)
+		if len(ng.countDeltas) > 0 {
+			g.incrementCountShards(c, "RunInTransaction", ng.countDeltas)
 		}
 	} else {
-		g.error(err)
+		g.error(c, &LogEntry{Op: "RunInTransaction", Tier: TierDatastore, Err: err})
 	}
 
 	return err
 }
 
+// txnContext joins the context of a transactional Goon with the context
+// given to one of its methods. Values, which include the transaction, come
+// from txn, while the deadline and cancellation come from the embedded context.
+type txnContext struct {
+	context.Context
+	txn context.Context
+}
+
+func (tc txnContext) Value(key interface{}) interface{} {
+	return tc.txn.Value(key)
+}
+
+// callContext returns the context to use for an operation that was given c.
+// That's c itself, unless g is in a transaction, see RunInTransactionContext.
+func (g *Goon) callContext(c context.Context) context.Context {
+	if !g.inTransaction {
+		return c
+	}
+	return txnContext{Context: c, txn: g.Context}
+}
+
 // Put saves the entity src into the datastore based on src's key k. If k
 // is an incomplete key, the returned key will be a unique key generated by
 // the datastore.
 func (g *Goon) Put(src interface{}) (*datastore.Key, error) {
+	return g.PutContext(g.Context, src)
+}
+
+// PutContext is like Put, but uses c instead of g.Context.
+func (g *Goon) PutContext(c context.Context, src interface{}) (*datastore.Key, error) {
 	v := reflect.ValueOf(src)
 	if v.Kind() != reflect.Ptr {
-		return nil, fmt.Errorf("goon: expected pointer to a struct, got %#v", src)
+		return nil, &TypeError{Expected: "pointer to a struct", Got: fmt.Sprintf("%#v", src)}
 	}
-	ks, err := g.PutMulti([]interface{}{src})
+	ks, err := g.PutMultiContext(c, []interface{}{src})
 	if err != nil {
 		if me, ok := err.(appengine.MultiError); ok {
 			return nil, me[0]
@@ -331,14 +393,24 @@ func (g *Goon) Put(src interface{}) (*datastore.Key, error) {
 // src must be a *[]S, *[]*S, *[]I, []S, []*S, or []I, for some struct type S,
 // or some interface type I. If *[]I or []I, each element must be a struct pointer.
 func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
-	keys, err := g.extractKeys(src, true) // allow incomplete keys on a Put request
+	return g.PutMultiContext(g.Context, src)
+}
+
+// PutMultiContext is like PutMulti, but uses c instead of g.Context,
+// e.g. to cancel the operation or to give it a deadline.
+// The local memory cache is the same as with PutMulti.
+func (g *Goon) PutMultiContext(c context.Context, src interface{}) ([]*datastore.Key, error) {
+	c = g.callContext(c)
+	keys, err := g.extractKeys(c, src, true) // allow incomplete keys on a Put request
 	if err != nil {
 		return nil, err
 	}
 
+	existence := g.lookupCountedKeys(c, keys)
 	v := reflect.Indirect(reflect.ValueOf(src))
 	mu := new(sync.Mutex)
 	multiErr, any := make(appengine.MultiError, len(keys)), false
+	created := make([]bool, len(keys)) // whether the put created a new entity
 	goroutines := (len(keys)-1)/datastorePutMultiMaxItems + 1
 	var wg sync.WaitGroup
 	wg.Add(goroutines)
@@ -350,14 +422,17 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 			if hi > len(keys) {
 				hi = len(keys)
 			}
-			rkeys, pmerr := datastore.PutMulti(g.Context, keys[lo:hi], v.Slice(lo, hi).Interface())
+			start := time.Now()
+			rkeys, pmerr := datastore.PutMulti(c, keys[lo:hi], v.Slice(lo, hi).Interface())
+			g.timing("PutMulti", TierDatastore, start)
+			g.countMultiErr("PutMulti", TierDatastore, MetricSet, hi-lo, pmerr)
 			if pmerr != nil {
 				mu.Lock()
 				any = true // this flag tells PutMulti to return multiErr later
 				mu.Unlock()
 				merr, ok := pmerr.(appengine.MultiError)
 				if !ok {
-					g.error(pmerr)
+					g.error(c, &LogEntry{Op: "PutMulti", Kind: keysKind(keys[lo:hi]), KeyCount: hi - lo, Tier: TierDatastore, Err: pmerr})
 					for j := lo; j < hi; j++ {
 						multiErr[j] = pmerr
 					}
@@ -374,6 +449,9 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 				if key.Incomplete() {
 					g.setStructKey(vi, rkeys[i])
 					keys[lo+i] = rkeys[i]
+					created[lo+i] = true
+				} else if existence != nil && existence[lo+i] == entityAbsent {
+					created[lo+i] = true
 				}
 			}
 		}(i)
@@ -389,17 +467,17 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 			cachekeys = append(cachekeys, cacheKey(key))
 		}
 	}
-	if g.inTransaction {
-		g.txnCacheLock.Lock()
-		for _, ck := range cachekeys {
-			g.toDelete[ck] = struct{}{}
-			g.toDeleteMC[ck] = struct{}{}
+	// The write has succeeded, so cache failures don't fail it. Both calls
+	// log and count their memcache errors.
+	g.invalidateCacheKeys(c, "PutMulti", keysKind(keys), cachekeys)
+	g.bumpQueryGenerations(c, "PutMulti", keys)
+	createdKeys := make([]*datastore.Key, 0, len(keys))
+	for i, key := range keys {
+		if created[i] {
+			createdKeys = append(createdKeys, key)
 		}
-		g.txnCacheLock.Unlock()
-	} else {
-		g.cache.DeleteMulti(cachekeys)
-		g.memcacheDeleteError(memcache.DeleteMulti(g.Context, cachekeys))
 	}
+	g.adjustApproximateCounts(c, "PutMulti", createdKeys, 1)
 
 	if any {
 		return keys, realError(multiErr)
@@ -407,9 +485,79 @@ func (g *Goon) PutMulti(src interface{}) ([]*datastore.Key, error) {
 	return keys, nil
 }
 
-// FlushLocalCache clears the local memory cache.
+// FlushLocalCache clears the local memory cache, including all per-kind caches.
 func (g *Goon) FlushLocalCache() {
-	g.cache.Flush()
+	for _, lc := range g.localCaches() {
+		lc.Flush()
+	}
+}
+
+// InvalidateKeys removes the entities of keys from the local memory cache
+// and memcache, so that the next Get fetches them from the datastore.
+// This is useful when something other than this Goon, e.g. another system,
+// has written to the datastore. Inside a transaction the removal is
+// deferred until the transaction is successfully committed.
+//
+// The returned error is a memcache failure, in which case memcache
+// may still contain some of the entities.
+func (g *Goon) InvalidateKeys(keys []*datastore.Key) error {
+	return g.InvalidateKeysContext(g.Context, keys)
+}
+
+// InvalidateKeysContext is like InvalidateKeys, but uses c instead of g.Context.
+func (g *Goon) InvalidateKeysContext(c context.Context, keys []*datastore.Key) error {
+	cachekeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		cachekeys = append(cachekeys, cacheKey(key))
+	}
+	err := g.invalidateCacheKeys(c, "InvalidateKeys", keysKind(keys), cachekeys)
+	if qerr := g.bumpQueryGenerations(c, "InvalidateKeys", keys); err == nil {
+		err = qerr
+	}
+	return err
+}
+
+// InvalidateEntities is like InvalidateKeys, but takes the keys from the
+// goon key fields of src, which accepts the same types as GetMulti.
+func (g *Goon) InvalidateEntities(src interface{}) error {
+	return g.InvalidateEntitiesContext(g.Context, src)
+}
+
+// InvalidateEntitiesContext is like InvalidateEntities, but uses c instead of g.Context.
+func (g *Goon) InvalidateEntitiesContext(c context.Context, src interface{}) error {
+	keys, err := g.extractKeys(c, src, false)
+	if err != nil {
+		return err
+	}
+	return g.InvalidateKeysContext(c, keys)
+}
+
+// invalidateCacheKeys removes cachekeys from the local memory cache and memcache
+// on behalf of operation op, or defers that until the transaction is committed.
+// A memcache failure is logged and counted, and also returned.
+func (g *Goon) invalidateCacheKeys(c context.Context, op, kind string, cachekeys []string) error {
+	if len(cachekeys) == 0 {
+		return nil
+	}
+	if g.inTransaction {
+		g.txnCacheLock.Lock()
+		for _, ck := range cachekeys {
+			g.toDelete[ck] = struct{}{}
+			g.toDeleteMC[ck] = struct{}{}
+		}
+		g.txnCacheLock.Unlock()
+		return nil
+	}
+	g.localDeleteMulti(cachekeys)
+	g.count(op, TierLocal, MetricDelete, len(cachekeys))
+	start := time.Now()
+	err := g.memcacheDeleteError(c, &LogEntry{Op: op, Kind: kind, KeyCount: len(cachekeys), Err: memcache.DeleteMulti(c, cachekeys)})
+	g.timing(op, TierMemcache, start)
+	g.count(op, TierMemcache, MetricDelete, len(cachekeys))
+	if err != nil {
+		g.count(op, TierMemcache, MetricError, 1)
+	}
+	return err
 }
 
 type memcacheTask struct {
@@ -418,7 +566,7 @@ type memcacheTask struct {
 }
 
 // NB! putMemcache is expected to treat cacheItem as immutable!
-func (g *Goon) putMemcache(citems []*cacheItem) error {
+func (g *Goon) putMemcache(c context.Context, citems []*cacheItem) error {
 	// Go over all the cache items and generate memcache tasks from them,
 	// by splitting them up based on payload size
 	items := make([]*memcache.Item, len(citems))
@@ -444,9 +592,19 @@ func (g *Goon) putMemcache(citems []*cacheItem) error {
 	errc := make(chan error, count)
 	for i := 0; i < count; i++ {
 		go func(idx int) {
-			tc, cf := context.WithTimeout(g.Context, memcachePutTimeout(tasks[idx].size))
-			errc <- memcache.SetMulti(tc, tasks[idx].items)
+			sc, span := g.startSpan(c, "goon.putMemcache")
+			span.SetAttribute(SpanAttrKeys, len(tasks[idx].items))
+			span.SetAttribute(SpanAttrPayloadBytes, tasks[idx].size)
+			start := time.Now()
+			tc, cf := context.WithTimeout(sc, memcachePutTimeout(tasks[idx].size))
+			err := memcache.SetMulti(tc, tasks[idx].items)
 			cf()
+			g.timing("putMemcache", TierMemcache, start)
+			endSpan(span, err)
+			if err == nil {
+				g.count("putMemcache", TierMemcache, MetricSet, len(tasks[idx].items))
+			}
+			errc <- err
 		}(i)
 	}
 	// Wait for all goroutines to finish and log any errors.
@@ -455,10 +613,13 @@ func (g *Goon) putMemcache(citems []*cacheItem) error {
 	for i := 0; i < count; i++ {
 		err := <-errc
 		if err != nil {
+			e := &LogEntry{Op: "putMemcache", KeyCount: len(citems), Tier: TierMemcache, Err: err}
 			if appengine.IsTimeoutError(err) {
-				g.timeoutError(err)
+				g.count("putMemcache", TierMemcache, MetricTimeout, 1)
+				g.timeoutError(c, e)
 			} else {
-				g.error(err)
+				g.count("putMemcache", TierMemcache, MetricError, 1)
+				g.error(c, e)
 			}
 			rerr = err
 		}
@@ -470,15 +631,20 @@ func (g *Goon) putMemcache(citems []*cacheItem) error {
 // If there is no such entity for the key, Get returns
 // datastore.ErrNoSuchEntity.
 func (g *Goon) Get(dst interface{}) error {
+	return g.GetContext(g.Context, dst)
+}
+
+// GetContext is like Get, but uses c instead of g.Context.
+func (g *Goon) GetContext(c context.Context, dst interface{}) error {
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
-		return fmt.Errorf("goon: expected pointer to a struct, got %#v", dst)
+		return &TypeError{Expected: "pointer to a struct", Got: fmt.Sprintf("%#v", dst)}
 	}
 	if !v.CanSet() {
 		v = v.Elem()
 	}
 	dsts := []interface{}{dst}
-	if err := g.GetMulti(dsts); err != nil {
+	if err := g.GetMultiContext(c, dsts); err != nil {
 		// Look for an embedded error if it's multi
 		if me, ok := err.(appengine.MultiError); ok {
 			return me[0]
@@ -495,7 +661,17 @@ func (g *Goon) Get(dst interface{}) error {
 // dst must be a *[]S, *[]*S, *[]I, []S, []*S, or []I, for some struct type S,
 // or some interface type I. If *[]I or []I, each element must be a struct pointer.
 func (g *Goon) GetMulti(dst interface{}) error {
-	keys, err := g.extractKeys(dst, false) // don't allow incomplete keys on a Get request
+	return g.GetMultiContext(g.Context, dst)
+}
+
+// GetMultiContext is like GetMulti, but uses c instead of g.Context,
+// e.g. to cancel the operation or to give it a deadline. The memcache
+// timeouts are derived from c, so a deadline of c shorter than the memcache
+// timeout applies to memcache as well. The local memory cache is the same
+// as with GetMulti.
+func (g *Goon) GetMultiContext(c context.Context, dst interface{}) error {
+	c = g.callContext(c)
+	keys, err := g.extractKeys(c, dst, false) // don't allow incomplete keys on a Get request
 	if err != nil {
 		return err
 	}
@@ -507,7 +683,11 @@ func (g *Goon) GetMulti(dst interface{}) error {
 
 	if g.inTransaction {
 		// todo: support getMultiLimit in transactions
-		if err := datastore.GetMulti(g.Context, keys, v.Interface()); err != nil {
+		start := time.Now()
+		err := datastore.GetMulti(c, keys, v.Interface())
+		g.timing("GetMulti", TierDatastore, start)
+		g.countMultiErr("GetMulti", TierDatastore, MetricHit, len(keys), err)
+		if err != nil {
 			if merr, ok := err.(appengine.MultiError); ok {
 				for i := 0; i < len(keys); i++ {
 					if merr[i] != nil && (!IgnoreFieldMismatch || !errFieldMismatch(merr[i])) {
@@ -516,7 +696,7 @@ func (g *Goon) GetMulti(dst interface{}) error {
 					}
 				}
 			} else {
-				g.error(err)
+				g.error(c, &LogEntry{Op: "GetMulti", Kind: keysKind(keys), KeyCount: len(keys), Tier: TierDatastore, Err: err})
 				anyErr = true // this flag tells GetMulti to return multiErr later
 				for i := 0; i < len(keys); i++ {
 					multiErr[i] = err
@@ -543,7 +723,11 @@ func (g *Goon) GetMulti(dst interface{}) error {
 		lckeys = append(lckeys, cacheKey(key))
 	}
 
-	lcvalues := g.cache.GetMulti(lckeys)
+	_, span := g.startSpan(c, "goon.GetMulti.local")
+	span.SetAttribute(SpanAttrKeys, len(lckeys))
+	start := time.Now()
+	lcvalues := g.localGetMulti(keys, lckeys)
+	g.timing("GetMulti", TierLocal, start)
 
 	for i, key := range keys {
 		vi := v.Index(i)
@@ -556,70 +740,56 @@ func (g *Goon) GetMulti(dst interface{}) error {
 			// Attempt to deserialize the cached value into the struct
 			err := deserializeStruct(d, data)
 			if err != nil && (!IgnoreFieldMismatch || !errFieldMismatch(err)) {
-				if err == datastore.ErrNoSuchEntity || errFieldMismatch(err) {
+				if errors.Is(err, datastore.ErrNoSuchEntity) || errFieldMismatch(err) {
 					anyErr = true // this flag tells GetMulti to return multiErr later
 					multiErr[i] = err
 				} else {
-					g.error(err)
+					g.error(c, &LogEntry{Op: "GetMulti", Kind: key.Kind(), KeyCount: 1, Tier: TierLocal, Err: err})
+					span.End()
 					return err
 				}
 			}
 		} else {
-			mckeys = append(mckeys, lckeys[i])
-			mixs = append(mixs, i)
+			if !skipMemcache(key.Kind()) {
+				mckeys = append(mckeys, lckeys[i])
+				mixs = append(mixs, i)
+			}
 			dskeys = append(dskeys, key)
 			dsdst = append(dsdst, d)
 			dixs = append(dixs, i)
 		}
 	}
 
-	if len(mckeys) == 0 {
+	span.SetAttribute(SpanAttrHits, len(keys)-len(dskeys))
+	span.End()
+	g.count("GetMulti", TierLocal, MetricHit, len(keys)-len(dskeys))
+	g.count("GetMulti", TierLocal, MetricMiss, len(dskeys))
+
+	if len(dskeys) == 0 {
 		if anyErr {
 			return realError(multiErr)
 		}
 		return nil
 	}
 
-	// memcache.GetMulti is limited to memcacheMaxRPCSize for the data returned.
-	// Thus if the returned data is bigger than memcacheMaxRPCSize - memcacheMaxItemSize
-	// then we do another memcache.GetMulti on the missing keys.
-	memvalues := make(map[string]*memcache.Item, len(mckeys))
-	mcKeysSet := make(map[string]struct{}, len(mckeys))
-	for _, mk := range mckeys {
-		mcKeysSet[mk] = struct{}{}
-	}
-	for {
-		nextmckeys := make([]string, 0, len(mcKeysSet))
-		for mk := range mcKeysSet {
-			nextmckeys = append(nextmckeys, mk)
-		}
-		tc, cf := context.WithTimeout(g.Context, memcacheGetTimeout(len(nextmckeys)))
-		mvs, err := memcache.GetMulti(tc, nextmckeys)
-		cf()
-		// timing out or another error from memcache isn't something to fail over, but do log it
-		if appengine.IsTimeoutError(err) {
-			g.timeoutError(err)
-			break
-		} else if err != nil {
-			g.error(err)
-			break
-		}
-		payloadSize := 0
-		for k, v := range mvs {
-			memvalues[k] = v
-			payloadSize += memcacheOverhead + len(v.Key) + len(v.Value)
-			delete(mcKeysSet, k)
-		}
-		if len(mcKeysSet) == 0 || payloadSize < memcacheMaxRPCSize-memcacheMaxItemSize {
-			break
-		}
+	var memvalues map[string]*memcache.Item
+	if len(mckeys) > 0 {
+		memvalues = g.getMemcache(c, mckeys, keysKind(keys))
 	}
 
 	if len(memvalues) > 0 {
-		// since memcache fetch was successful, reset the datastore fetch list and repopulate it
-		dskeys = dskeys[:0]
-		dsdst = dsdst[:0]
-		dixs = dixs[:0]
+		// since memcache fetch was successful, reset the datastore fetch list and repopulate it,
+		// keeping only the keys of kinds that aren't cached in memcache
+		n := 0
+		for i, key := range dskeys {
+			if skipMemcache(key.Kind()) {
+				dskeys[n], dsdst[n], dixs[n] = key, dsdst[i], dixs[i]
+				n++
+			}
+		}
+		dskeys = dskeys[:n]
+		dsdst = dsdst[:n]
+		dixs = dixs[:n]
 		// we only want to check the returned map if there weren't any errors
 		// unlike the datastore, memcache will return a smaller map with no error if some of the keys were missed
 
@@ -630,15 +800,18 @@ func (g *Goon) GetMulti(dst interface{}) error {
 			}
 			if s, present := memvalues[m]; present {
 				// Mirror any memcache entries in local cache
-				g.cache.Set(&cacheItem{key: m, value: s.Value})
+				if lc := g.localCacheFor(keys[mixs[i]].Kind()); lc != nil {
+					lc.Set(&cacheItem{key: m, value: s.Value})
+					g.count("GetMulti", TierLocal, MetricSet, 1)
+				}
 				// Attempt to deserialize the cached value into the struct
 				err := deserializeStruct(d, s.Value)
 				if err != nil && (!IgnoreFieldMismatch || !errFieldMismatch(err)) {
-					if err == datastore.ErrNoSuchEntity || errFieldMismatch(err) {
+					if errors.Is(err, datastore.ErrNoSuchEntity) || errFieldMismatch(err) {
 						anyErr = true // this flag tells GetMulti to return multiErr later
 						multiErr[mixs[i]] = err
 					} else {
-						g.error(err)
+						g.error(c, &LogEntry{Op: "GetMulti", Kind: keys[mixs[i]].Kind(), KeyCount: 1, Tier: TierMemcache, Err: err})
 						return err
 					}
 				}
@@ -668,18 +841,23 @@ func (g *Goon) GetMulti(dst interface{}) error {
 			if hi > len(dskeys) {
 				hi = len(dskeys)
 			}
+			sc, span := g.startSpan(c, "goon.GetMulti.datastore")
+			span.SetAttribute(SpanAttrKeys, hi-lo)
+			defer span.End()
 			toCache := make([]*cacheItem, 0, hi-lo)
+			toCacheKeys := make([]*datastore.Key, 0, hi-lo)
 			propLists := make([]datastore.PropertyList, hi-lo)
 			handleProp := func(i, idx int, exists bool) {
 				// Serialize the properties
 				data, err := serializeProperties(propLists[i], exists)
 				if err != nil {
-					g.error(err)
+					g.error(c, &LogEntry{Op: "GetMulti", Kind: keys[idx].Kind(), KeyCount: 1, Tier: TierDatastore, Err: err})
 					multiErr[idx] = err
 					return
 				}
 				// Prepare the properties for caching
 				toCache = append(toCache, &cacheItem{key: lckeys[idx], value: data})
+				toCacheKeys = append(toCacheKeys, keys[idx])
 				// Deserialize the properties into a struct
 				if exists {
 					err = deserializeProperties(dsdst[lo+i], propLists[i])
@@ -688,14 +866,18 @@ func (g *Goon) GetMulti(dst interface{}) error {
 					}
 				}
 			}
-			gmerr := datastore.GetMulti(g.Context, dskeys[lo:hi], propLists)
+			start := time.Now()
+			gmerr := datastore.GetMulti(sc, dskeys[lo:hi], propLists)
+			g.timing("GetMulti", TierDatastore, start)
+			g.countMultiErr("GetMulti", TierDatastore, MetricHit, hi-lo, gmerr)
 			if gmerr != nil {
 				mu.Lock()
 				anyErr = true // this flag tells GetMulti to return multiErr later
 				mu.Unlock()
 				merr, ok := gmerr.(appengine.MultiError)
 				if !ok {
-					g.error(gmerr)
+					span.SetAttribute(SpanAttrError, gmerr.Error())
+					g.error(c, &LogEntry{Op: "GetMulti", Kind: keysKind(dskeys[lo:hi]), KeyCount: hi - lo, Tier: TierDatastore, Err: gmerr})
 					for j := lo; j < hi; j++ {
 						multiErr[j] = gmerr
 					}
@@ -705,7 +887,7 @@ func (g *Goon) GetMulti(dst interface{}) error {
 					if merr[i] == nil {
 						handleProp(i, idx, true)
 					} else {
-						if merr[i] == datastore.ErrNoSuchEntity {
+						if errors.Is(merr[i], datastore.ErrNoSuchEntity) {
 							handleProp(i, idx, false)
 						}
 						multiErr[idx] = merr[i]
@@ -716,15 +898,33 @@ func (g *Goon) GetMulti(dst interface{}) error {
 					handleProp(i, idx, true)
 				}
 			}
+			payloadSize := 0
+			for _, ci := range toCache {
+				payloadSize += len(ci.value)
+			}
+			span.SetAttribute(SpanAttrPayloadBytes, payloadSize)
 			if len(toCache) > 0 {
+				toMemcache := toCache
+				if kindCachesRegistered() {
+					toMemcache = make([]*cacheItem, 0, len(toCache))
+					for i, ci := range toCache {
+						if !skipMemcache(toCacheKeys[i].Kind()) {
+							toMemcache = append(toMemcache, ci)
+						}
+					}
+				}
 				// Populate memcache in a goroutine because there's network involved
 				// and we can be doing useful work while waiting for I/O
 				errc := make(chan error)
 				go func() {
-					errc <- g.putMemcache(toCache)
+					if len(toMemcache) == 0 {
+						errc <- nil
+						return
+					}
+					errc <- g.putMemcache(sc, toMemcache)
 				}()
 				// Populate local cache
-				g.cache.SetMulti(toCache)
+				g.count("GetMulti", TierLocal, MetricSet, g.localSetMulti(toCacheKeys, toCache))
 				// Wait for memcache population to finish
 				err := <-errc
 				// .. but only propagate the memcache error if configured to do so
@@ -745,20 +945,88 @@ func (g *Goon) GetMulti(dst interface{}) error {
 	return nil
 }
 
+// getMemcache fetches mckeys from memcache with the context c, which contain entities of kind.
+// Errors aren't returned, as memcache failures are only logged
+// and the missing keys are fetched from the datastore instead.
+func (g *Goon) getMemcache(c context.Context, mckeys []string, kind string) map[string]*memcache.Item {
+	// memcache.GetMulti is limited to memcacheMaxRPCSize for the data returned.
+	// Thus if the returned data is bigger than memcacheMaxRPCSize - memcacheMaxItemSize
+	// then we do another memcache.GetMulti on the missing keys.
+	memvalues := make(map[string]*memcache.Item, len(mckeys))
+	mcKeysSet := make(map[string]struct{}, len(mckeys))
+	for _, mk := range mckeys {
+		mcKeysSet[mk] = struct{}{}
+	}
+	mc, mcspan := g.startSpan(c, "goon.GetMulti.memcache")
+	mcspan.SetAttribute(SpanAttrKeys, len(mckeys))
+	mcPayloadSize := 0
+	for attempt := 1; ; attempt++ {
+		nextmckeys := make([]string, 0, len(mcKeysSet))
+		for mk := range mcKeysSet {
+			nextmckeys = append(nextmckeys, mk)
+		}
+		sc, span := g.startSpan(mc, "goon.memcache.GetMulti")
+		span.SetAttribute(SpanAttrKeys, len(nextmckeys))
+		span.SetAttribute(SpanAttrAttempt, attempt)
+		start := time.Now()
+		tc, cf := context.WithTimeout(sc, memcacheGetTimeout(len(nextmckeys)))
+		mvs, err := memcache.GetMulti(tc, nextmckeys)
+		cf()
+		g.timing("GetMulti", TierMemcache, start)
+		if err != nil {
+			endSpan(span, err)
+		}
+		// timing out or another error from memcache isn't something to fail over, but do log it
+		if appengine.IsTimeoutError(err) {
+			g.count("GetMulti", TierMemcache, MetricTimeout, 1)
+			g.timeoutError(c, &LogEntry{Op: "GetMulti", Kind: kind, KeyCount: len(nextmckeys), Tier: TierMemcache, Err: err})
+			break
+		} else if err != nil {
+			g.count("GetMulti", TierMemcache, MetricError, 1)
+			g.error(c, &LogEntry{Op: "GetMulti", Kind: kind, KeyCount: len(nextmckeys), Tier: TierMemcache, Err: err})
+			break
+		}
+		payloadSize := 0
+		for k, v := range mvs {
+			memvalues[k] = v
+			payloadSize += memcacheOverhead + len(v.Key) + len(v.Value)
+			delete(mcKeysSet, k)
+		}
+		mcPayloadSize += payloadSize
+		span.SetAttribute(SpanAttrHits, len(mvs))
+		span.SetAttribute(SpanAttrPayloadBytes, payloadSize)
+		span.End()
+		if len(mcKeysSet) == 0 || payloadSize < memcacheMaxRPCSize-memcacheMaxItemSize {
+			break
+		}
+	}
+	mcspan.SetAttribute(SpanAttrHits, len(memvalues))
+	mcspan.SetAttribute(SpanAttrPayloadBytes, mcPayloadSize)
+	mcspan.End()
+	g.count("GetMulti", TierMemcache, MetricHit, len(memvalues))
+	g.count("GetMulti", TierMemcache, MetricMiss, len(mckeys)-len(memvalues))
+	return memvalues
+}
+
 // Delete deletes the provided entity.
 // Takes either *S or *datastore.Key.
 func (g *Goon) Delete(src interface{}) error {
+	return g.DeleteContext(g.Context, src)
+}
+
+// DeleteContext is like Delete, but uses c instead of g.Context.
+func (g *Goon) DeleteContext(c context.Context, src interface{}) error {
 	var srcs interface{}
 	if key, ok := src.(*datastore.Key); ok {
 		srcs = []*datastore.Key{key}
 	} else {
 		v := reflect.ValueOf(src)
 		if v.Kind() != reflect.Ptr {
-			return fmt.Errorf("goon: expected pointer to a struct, got %#v", src)
+			return &TypeError{Expected: "pointer to a struct", Got: fmt.Sprintf("%#v", src)}
 		}
 		srcs = []interface{}{src}
 	}
-	err := g.DeleteMulti(srcs)
+	err := g.DeleteMultiContext(c, srcs)
 	if err != nil {
 		// Look for an embedded error if it's multi
 		if me, ok := err.(appengine.MultiError); ok {
@@ -771,10 +1039,18 @@ func (g *Goon) Delete(src interface{}) error {
 // DeleteMulti is a batch version of Delete.
 // Takes either []*S or []*datastore.Key.
 func (g *Goon) DeleteMulti(src interface{}) error {
+	return g.DeleteMultiContext(g.Context, src)
+}
+
+// DeleteMultiContext is like DeleteMulti, but uses c instead of g.Context,
+// e.g. to cancel the operation or to give it a deadline.
+// The local memory cache is the same as with DeleteMulti.
+func (g *Goon) DeleteMultiContext(c context.Context, src interface{}) error {
+	c = g.callContext(c)
 	keys, ok := src.([]*datastore.Key)
 	if !ok {
 		var err error
-		keys, err = g.extractKeys(src, false) // don't allow incomplete keys on a Delete request
+		keys, err = g.extractKeys(c, src, false) // don't allow incomplete keys on a Delete request
 		if err != nil {
 			return err
 		}
@@ -784,6 +1060,7 @@ func (g *Goon) DeleteMulti(src interface{}) error {
 		// not an error, and it was "successful", so return nil
 	}
 
+	existence := g.lookupCountedKeys(c, keys)
 	mu := new(sync.Mutex)
 	multiErr, any := make(appengine.MultiError, len(keys)), false
 	goroutines := (len(keys)-1)/datastoreDeleteMultiMaxItems + 1
@@ -797,14 +1074,17 @@ func (g *Goon) DeleteMulti(src interface{}) error {
 			if hi > len(keys) {
 				hi = len(keys)
 			}
-			dmerr := datastore.DeleteMulti(g.Context, keys[lo:hi])
+			start := time.Now()
+			dmerr := datastore.DeleteMulti(c, keys[lo:hi])
+			g.timing("DeleteMulti", TierDatastore, start)
+			g.countMultiErr("DeleteMulti", TierDatastore, MetricDelete, hi-lo, dmerr)
 			if dmerr != nil {
 				mu.Lock()
 				any = true // this flag tells DeleteMulti to return multiErr later
 				mu.Unlock()
 				merr, ok := dmerr.(appengine.MultiError)
 				if !ok {
-					g.error(dmerr)
+					g.error(c, &LogEntry{Op: "DeleteMulti", Kind: keysKind(keys[lo:hi]), KeyCount: hi - lo, Tier: TierDatastore, Err: dmerr})
 					for j := lo; j < hi; j++ {
 						multiErr[j] = dmerr
 					}
@@ -823,17 +1103,17 @@ func (g *Goon) DeleteMulti(src interface{}) error {
 	for _, key := range keys {
 		cachekeys = append(cachekeys, cacheKey(key))
 	}
-	if g.inTransaction {
-		g.txnCacheLock.Lock()
-		for _, ck := range cachekeys {
-			g.toDelete[ck] = struct{}{}
-			g.toDeleteMC[ck] = struct{}{}
+	// The write has succeeded, so cache failures don't fail it. Both calls
+	// log and count their memcache errors.
+	g.invalidateCacheKeys(c, "DeleteMulti", keysKind(keys), cachekeys)
+	g.bumpQueryGenerations(c, "DeleteMulti", keys)
+	deletedKeys := make([]*datastore.Key, 0, len(keys))
+	for i, key := range keys {
+		if multiErr[i] == nil && (existence == nil || existence[i] != entityAbsent) {
+			deletedKeys = append(deletedKeys, key)
 		}
-		g.txnCacheLock.Unlock()
-	} else {
-		g.cache.DeleteMulti(cachekeys)
-		g.memcacheDeleteError(memcache.DeleteMulti(g.Context, cachekeys))
 	}
+	g.adjustApproximateCounts(c, "DeleteMulti", deletedKeys, -1)
 
 	if any {
 		return realError(multiErr)
@@ -841,18 +1121,20 @@ func (g *Goon) DeleteMulti(src interface{}) error {
 	return nil
 }
 
-// NotFound returns true if err is an appengine.MultiError and err[idx] is a datastore.ErrNoSuchEntity.
+// NotFound returns true if err is or wraps an appengine.MultiError
+// and err[idx] is or wraps datastore.ErrNoSuchEntity.
 func NotFound(err error, idx int) bool {
-	if merr, ok := err.(appengine.MultiError); ok {
-		return idx < len(merr) && merr[idx] == datastore.ErrNoSuchEntity
+	var merr appengine.MultiError
+	if errors.As(err, &merr) {
+		return idx >= 0 && idx < len(merr) && errors.Is(merr[idx], datastore.ErrNoSuchEntity)
 	}
 	return false
 }
 
-// errFieldMismatch returns true if err is *datastore.ErrFieldMismatch
+// errFieldMismatch returns true if err is or wraps *datastore.ErrFieldMismatch
 func errFieldMismatch(err error) bool {
-	_, ok := err.(*datastore.ErrFieldMismatch)
-	return ok
+	var fm *datastore.ErrFieldMismatch
+	return errors.As(err, &fm)
 }
 
 // Returns a single error if each error in MultiError is the same
@@ -863,11 +1145,11 @@ func realError(multiError appengine.MultiError) error {
 	}
 	init := multiError[0]
 	// some errors are *always* returned in MultiError form from the datastore
-	if _, ok := init.(*datastore.ErrFieldMismatch); ok { // returned in GetMulti
+	if errFieldMismatch(init) { // returned in GetMulti
 		return multiError
 	}
-	if init == datastore.ErrInvalidEntityType || // returned in GetMulti
-		init == datastore.ErrNoSuchEntity { // returned in GetMulti
+	if errors.Is(init, datastore.ErrInvalidEntityType) || // returned in GetMulti
+		errors.Is(init, datastore.ErrNoSuchEntity) { // returned in GetMulti
 		return multiError
 	}
 	// check if all errors are the same
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
@@ -72,6 +73,15 @@ const (
 	ivModeTotal
 )
 
+// offlineContext returns a context that can be used to build keys
+// without starting aetest, for tests that never talk to any services.
+func offlineContext() context.Context {
+	if os.Getenv("GAE_APPLICATION") == "" {
+		os.Setenv("GAE_APPLICATION", "dev~goon-test")
+	}
+	return context.Background()
+}
+
 func cloneKey(key *datastore.Key) *datastore.Key {
 	if key == nil {
 		return nil
@@ -2061,7 +2071,7 @@ func TestGoon(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Unexpected error serializing: %v", err)
 		}
-		n.putMemcache([]*cacheItem{{key: ckey, value: data}})
+		n.putMemcache(n.Context, []*cacheItem{{key: ckey, value: data}})
 		n.cache.Delete(ckey)
 	}
 
@@ -2547,6 +2557,18 @@ type HasKind struct {
 	Name string
 }
 
+type HasNamespace struct {
+	Id        int64  `datastore:"-" goon:"id"`
+	Namespace string `datastore:"-" goon:"namespace"`
+	Name      string
+}
+
+type HasNamespaceParent struct {
+	Id        int64          `datastore:"-" goon:"id"`
+	Parent    *datastore.Key `datastore:"-" goon:"parent"`
+	Namespace string         `datastore:"-" goon:"namespace"`
+}
+
 type HasDefaultKind struct {
 	Id   int64  `datastore:"-" goon:"id"`
 	Kind string `datastore:"-" goon:"kind,DefaultKind"`
@@ -3027,12 +3049,12 @@ func TestMemcachePutTimeout(t *testing.T) {
 	MemcachePutTimeoutSmall = 0
 	MemcachePutTimeoutLarge = 0
 	MemcachePutTimeoutThreshold = 1
-	if err := g.putMemcache(cis); !appengine.IsTimeoutError(err) {
+	if err := g.putMemcache(g.Context, cis); !appengine.IsTimeoutError(err) {
 		t.Fatalf("Request should timeout - err = %v", err)
 	}
 
 	MemcachePutTimeoutLarge = time.Second
-	if err := g.putMemcache(cis); err != nil {
+	if err := g.putMemcache(g.Context, cis); err != nil {
 		t.Fatalf("putMemcache: unexpected error - %v", err)
 	}
 
@@ -3244,3 +3266,380 @@ func TestMemcacheLimits(t *testing.T) {
 		hd.Data = nil
 	}
 }
+
+func TestInvalidateKeys(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	src := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+
+	// Another system changes the datastore behind goon's back
+	keys := []*datastore.Key{g.Key(src[0]), g.Key(src[1])}
+	if _, err := datastore.PutMulti(c, keys, []*HasId{{Name: "uno"}, {Name: "dos"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	stale := &HasId{Id: 1}
+	if err := g.Get(stale); err != nil || stale.Name != "one" {
+		t.Fatalf("Expected the stale cached value, got %v (%v)", stale.Name, err)
+	}
+
+	if err := g.InvalidateKeys(keys[:1]); err != nil {
+		t.Fatalf("Unexpected error on InvalidateKeys: %v", err)
+	}
+	if err := g.InvalidateEntities([]*HasId{{Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on InvalidateEntities: %v", err)
+	}
+	for _, ck := range []string{cacheKey(keys[0]), cacheKey(keys[1])} {
+		if g.cache.Get(ck) != nil {
+			t.Fatalf("Expected %v to be gone from the local cache", ck)
+		}
+		if _, err := memcache.Get(c, ck); err != memcache.ErrCacheMiss {
+			t.Fatalf("Expected %v to be gone from memcache, got %v", ck, err)
+		}
+	}
+	dst := []*HasId{{Id: 1}, {Id: 2}}
+	if err := g.GetMulti(dst); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+	if dst[0].Name != "uno" || dst[1].Name != "dos" {
+		t.Fatalf("Expected fresh values, got %v and %v", dst[0].Name, dst[1].Name)
+	}
+
+	// Inside a transaction the invalidation waits for the commit
+	err = g.RunInTransaction(func(tg *Goon) error {
+		if err := tg.InvalidateKeys(keys); err != nil {
+			return err
+		}
+		if g.cache.Get(cacheKey(keys[0])) == nil {
+			t.Fatalf("Expected the invalidation to be deferred")
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error on RunInTransaction: %v", err)
+	}
+	if g.cache.Get(cacheKey(keys[0])) != nil {
+		t.Fatalf("Expected the invalidation to happen on commit")
+	}
+}
+
+func TestInvalidateKeysDeferred(t *testing.T) {
+	g := FromContext(offlineContext())
+	tg := &Goon{
+		Context:          g.Context,
+		inTransaction:    true,
+		toDelete:         make(map[string]struct{}),
+		toDeleteMC:       make(map[string]struct{}),
+		KindNameResolver: DefaultKindName,
+	}
+	key := datastore.NewKey(g.Context, "HasId", "", 1, nil)
+	if err := tg.InvalidateKeys([]*datastore.Key{key}); err != nil {
+		t.Fatalf("Unexpected error on InvalidateKeys: %v", err)
+	}
+	ck := cacheKey(key)
+	if _, ok := tg.toDelete[ck]; !ok {
+		t.Fatalf("Expected the local cache invalidation to be deferred")
+	}
+	if _, ok := tg.toDeleteMC[ck]; !ok {
+		t.Fatalf("Expected the memcache invalidation to be deferred")
+	}
+	if err := tg.InvalidateEntities([]*HasId{{}}); !errors.Is(err, ErrIncompleteKey) {
+		t.Fatalf("Expected an incomplete key error, got %v", err)
+	}
+}
+
+func TestNamespaceKeys(t *testing.T) {
+	g := FromContext(offlineContext())
+
+	if key := g.Key(&HasNamespace{Id: 1}); key.Namespace() != "" {
+		t.Fatalf("Expected the default namespace, got %q", key.Namespace())
+	}
+	if key := g.Key(&HasNamespace{Id: 1, Namespace: "a"}); key.Namespace() != "a" {
+		t.Fatalf("Expected namespace a, got %q", key.Namespace())
+	}
+
+	// The field takes precedence over the Goon namespace
+	g.Namespace = "b"
+	if key := g.Key(&HasNamespace{Id: 1}); key.Namespace() != "b" {
+		t.Fatalf("Expected namespace b, got %q", key.Namespace())
+	}
+	if key := g.Key(&HasNamespace{Id: 1, Namespace: "a"}); key.Namespace() != "a" {
+		t.Fatalf("Expected namespace a, got %q", key.Namespace())
+	}
+
+	// The parent decides the namespace, even over the Goon namespace
+	c, _ := appengine.Namespace(g.Context, "c")
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	if key := g.Key(&HasNamespaceParent{Id: 1, Parent: parent}); key.Namespace() != "c" || !key.Parent().Equal(parent) {
+		t.Fatalf("Expected namespace c, got %v", key)
+	}
+	rootParent := datastore.NewKey(g.Context, "Parent", "", 1, nil)
+	if rootParent.Namespace() != "" {
+		t.Fatalf("Expected the parent to be built in the default namespace, got %q", rootParent.Namespace())
+	}
+	if key := g.Key(&HasNamespaceParent{Id: 1, Parent: rootParent}); key.Namespace() != "" {
+		t.Fatalf("Expected the default namespace of the parent, got %q", key.Namespace())
+	}
+	if _, err := g.KeyError(&HasNamespaceParent{Id: 1, Parent: parent, Namespace: "a"}); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected a namespace mismatch error, got %v", err)
+	}
+	if _, err := g.KeyError(&HasNamespace{Id: 1, Namespace: "not valid!"}); err == nil {
+		t.Fatalf("Expected an invalid namespace error")
+	}
+
+	// The namespace is set back from the key
+	hn := &HasNamespace{}
+	if err := g.setStructKey(hn, g.Key(&HasNamespace{Id: 2, Namespace: "a"})); err != nil {
+		t.Fatalf("Unexpected error on setStructKey: %v", err)
+	}
+	if hn.Id != 2 || hn.Namespace != "a" {
+		t.Fatalf("Unexpected struct: %+v", hn)
+	}
+}
+
+func TestNamespaceCacheKeys(t *testing.T) {
+	originalMemcacheKey := MemcacheKey
+	defer func() {
+		MemcacheKey = originalMemcacheKey
+	}()
+	// A custom MemcacheKey that ignores the namespace
+	MemcacheKey = func(k *datastore.Key) string {
+		return fmt.Sprintf("%v-%v", k.Kind(), k.IntID())
+	}
+
+	g := FromContext(offlineContext())
+	seen := map[string]bool{}
+	for _, ns := range []string{"", "a", "b"} {
+		ck := cacheKey(g.Key(&HasNamespace{Id: 1, Namespace: ns}))
+		if seen[ck] {
+			t.Fatalf("Cache key %q isn't distinct for namespace %q", ck, ns)
+		}
+		seen[ck] = true
+	}
+}
+
+func TestNamespaceRoundTrip(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	src := []*HasNamespace{
+		{Id: 1, Name: "default"},
+		{Id: 1, Namespace: "a", Name: "in a"},
+		{Id: 1, Namespace: "b", Name: "in b"},
+	}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+
+	// Fetch from every tier, with all the namespaces in a single GetMulti
+	for _, tier := range []string{"local", "memcache", "datastore"} {
+		switch tier {
+		case "memcache":
+			g.FlushLocalCache()
+		case "datastore":
+			g.FlushLocalCache()
+			memcache.Flush(c)
+		}
+		dst := []*HasNamespace{{Id: 1, Namespace: "b"}, {Id: 1}, {Id: 1, Namespace: "a"}}
+		if err := g.GetMulti(dst); err != nil {
+			t.Fatalf("Unexpected error on GetMulti from %v: %v", tier, err)
+		}
+		if dst[0].Name != "in b" || dst[1].Name != "default" || dst[2].Name != "in a" {
+			t.Fatalf("Unexpected results from %v: %+v %+v %+v", tier, dst[0], dst[1], dst[2])
+		}
+	}
+
+	// Queries run in the Goon namespace
+	g.Namespace = "a"
+	var results []*HasNamespace
+	if _, err := g.GetAll(datastore.NewQuery("HasNamespace"), &results); err != nil {
+		t.Fatalf("Unexpected error on GetAll: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "in a" || results[0].Namespace != "a" {
+		t.Fatalf("Unexpected query results: %+v", results)
+	}
+
+	// Deleting in one namespace leaves the others alone
+	if err := g.Delete(&HasNamespace{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Delete: %v", err)
+	}
+	g.Namespace = ""
+	dst := []*HasNamespace{{Id: 1}, {Id: 1, Namespace: "a"}, {Id: 1, Namespace: "b"}}
+	if err := g.GetMulti(dst); !NotFound(err, 1) || NotFound(err, 0) || NotFound(err, 2) {
+		t.Fatalf("Expected only namespace a to be deleted, got %v", err)
+	}
+}
+
+func TestContextVariants(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	if _, err := g.PutContext(c, &HasId{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on PutContext: %v", err)
+	}
+	if err := g.GetContext(c, &HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on GetContext: %v", err)
+	}
+
+	// A cancelled context fails the operations that need to leave the local cache
+	cc, cancel := context.WithCancel(c)
+	cancel()
+	g.FlushLocalCache()
+	memcache.Flush(c)
+	if err := g.GetMultiContext(cc, []*HasId{{Id: 1}}); err == nil {
+		t.Fatalf("Expected an error on GetMultiContext with a cancelled context")
+	}
+	if _, err := g.PutMultiContext(cc, []*HasId{{Id: 2}}); err == nil {
+		t.Fatalf("Expected an error on PutMultiContext with a cancelled context")
+	}
+	if _, err := g.GetAllContext(cc, datastore.NewQuery("HasId"), &[]*HasId{}); err == nil {
+		t.Fatalf("Expected an error on GetAllContext with a cancelled context")
+	}
+
+	// The Goon itself is still usable and shares the local cache with the context variants
+	if err := g.Get(&HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on Get: %v", err)
+	}
+	hi := &HasId{Id: 1}
+	if err := g.GetMultiContext(cc, []*HasId{hi}); err != nil || hi.Name != "one" {
+		t.Fatalf("Expected a local cache hit, got %+v (%v)", hi, err)
+	}
+	if err := g.DeleteContext(c, &HasId{Id: 1}); err != nil {
+		t.Fatalf("Unexpected error on DeleteContext: %v", err)
+	}
+}
+
+type txnTestKey struct{}
+
+func TestTransactionCallContext(t *testing.T) {
+	g := &Goon{Context: context.WithValue(offlineContext(), txnTestKey{}, "transaction"), inTransaction: true}
+	deadline := time.Now().Add(time.Minute)
+	c, cancel := context.WithDeadline(context.WithValue(offlineContext(), txnTestKey{}, "caller"), deadline)
+	defer cancel()
+
+	tc := g.callContext(c)
+	if v := tc.Value(txnTestKey{}); v != "transaction" {
+		t.Fatalf("Expected the values of the transaction context, got %v", v)
+	}
+	if d, ok := tc.Deadline(); !ok || !d.Equal(deadline) {
+		t.Fatalf("Expected the deadline of the caller's context, got %v", d)
+	}
+	cancel()
+	select {
+	case <-tc.Done():
+	default:
+		t.Fatalf("Expected cancelling the caller's context to cancel the operation")
+	}
+	if tc.Err() != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, tc.Err())
+	}
+
+	// Outside a transaction the caller's context is used as is
+	g.inTransaction = false
+	if g.callContext(c) != c {
+		t.Fatalf("Expected the caller's context to be used outside a transaction")
+	}
+}
+
+func TestTransactionContextVariants(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	// A put with the outer context is still rolled back with the transaction
+	errRollback := errors.New("rollback")
+	if err := g.RunInTransaction(func(tg *Goon) error {
+		if _, err := tg.PutContext(c, &HasId{Id: 1, Name: "one"}); err != nil {
+			return err
+		}
+		return errRollback
+	}, nil); err != errRollback {
+		t.Fatalf("Expected %v, got %v", errRollback, err)
+	}
+	if err := g.Get(&HasId{Id: 1}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected %v, got %v", datastore.ErrNoSuchEntity, err)
+	}
+}
+
+type HasProjection struct {
+	Id      int64 `datastore:"-" goon:"id"`
+	Name    string
+	Age     int64
+	Created time.Time
+}
+
+func TestProjectionQueries(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := []*HasProjection{{Id: 1, Name: "a", Age: 10, Created: when}, {Id: 2, Name: "b", Age: 10, Created: when}}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*HasProjection{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+	g.FlushLocalCache()
+
+	// Only the projected fields and the key fields are set
+	var dst []HasProjection
+	q := datastore.NewQuery("HasProjection").Project("Name", "Created").Order("Name")
+	if _, err := g.GetAll(q, &dst); err != nil {
+		t.Fatalf("Unexpected error on GetAll: %v", err)
+	}
+	if len(dst) != 2 || dst[0].Id != 1 || dst[0].Name != "a" || dst[0].Age != 0 || !dst[0].Created.Equal(when) {
+		t.Fatalf("Unexpected projection results %+v", dst)
+	}
+	it := g.Run(q)
+	hp := &HasProjection{}
+	if _, err := it.Next(hp); err != nil {
+		t.Fatalf("Unexpected error on Next: %v", err)
+	}
+	if hp.Id != 1 || hp.Name != "a" || hp.Age != 0 {
+		t.Fatalf("Unexpected projection result %+v", hp)
+	}
+
+	// Distinct queries return one result per distinct value
+	dst = nil
+	if _, err := g.GetAll(datastore.NewQuery("HasProjection").Project("Age").Distinct(), &dst); err != nil {
+		t.Fatalf("Unexpected error on distinct GetAll: %v", err)
+	}
+	if len(dst) != 1 || dst[0].Age != 10 {
+		t.Fatalf("Unexpected distinct results %+v", dst)
+	}
+
+	// The partial entities weren't cached, so Get returns the full entities
+	if stats := g.CacheStats(); stats.Items != 0 {
+		t.Fatalf("Expected nothing to be cached, got %v items", stats.Items)
+	}
+	full := &HasProjection{Id: 1}
+	if err := g.Get(full); err != nil || full.Age != 10 {
+		t.Fatalf("Unexpected entity %+v (%v)", full, err)
+	}
+}
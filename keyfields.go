@@ -0,0 +1,316 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	keyType             = reflect.TypeOf(&datastore.Key{})
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// idType is the way an id field maps to the id of a datastore key.
+type idType int
+
+const (
+	idInt    idType = iota // Any signed integer kind, stored as an int id
+	idUint                 // Any unsigned integer kind, stored as an int id
+	idString               // Any string kind, stored as a string id
+	idText                 // An encoding.TextMarshaler, stored as a string id
+)
+
+// getIdType returns how a field of type t can be used as an id.
+// Integer and string kinds use their underlying value, even if the type
+// also implements encoding.TextMarshaler. Other types must implement both
+// encoding.TextMarshaler and encoding.TextUnmarshaler, so that the id
+// can be written to the key and read back from it.
+func getIdType(t reflect.Type) (idType, bool) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return idInt, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return idUint, true
+	case reflect.String:
+		return idString, true
+	}
+	pt := reflect.PtrTo(t)
+	if (t.Implements(textMarshalerType) || pt.Implements(textMarshalerType)) && pt.Implements(textUnmarshalerType) {
+		return idText, true
+	}
+	return 0, false
+}
+
+// keyField is the location of a goon key field in a struct.
+type keyField struct {
+	index    []int // for reflect.Value.FieldByIndex
+	settable bool  // whether setStructKey may set the field
+}
+
+// keyFields describes the goon key fields of a struct type.
+// It is built once per type, so that getStructKey and setStructKey
+// don't need to parse the struct tags on every call.
+type keyFields struct {
+	id          *keyField  // nil if the struct has no id field
+	idType      idType     // how the id field maps to the key id
+	kind        *keyField  // nil if the struct has no kind field
+	kindDefault string     // the optional second value of the kind tag
+	parent      *keyField  // nil if the struct has no parent field
+	parentType  parentType // what the parent field holds
+	namespace   *keyField  // nil if the struct has no namespace field
+	err         error      // set if the key fields are declared incorrectly
+}
+
+// parentType is what a parent field holds.
+type parentType int
+
+const (
+	parentKey       parentType = iota // A *datastore.Key, or a type convertible to it
+	parentStructPtr                   // A pointer to a goon entity, where nil means no parent
+	parentStruct                      // A goon entity, where the zero value means no parent
+)
+
+// getParentType returns what a parent field of type t holds.
+func getParentType(t reflect.Type) (parentType, bool) {
+	if t.ConvertibleTo(keyType) {
+		return parentKey, true
+	}
+	if t.Kind() == reflect.Struct {
+		return parentStruct, true
+	}
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		return parentStructPtr, true
+	}
+	return 0, false
+}
+
+// keyFieldsCache holds a *keyFields for every reflect.Type seen so far.
+var keyFieldsCache sync.Map
+
+// getKeyFields returns the goon key fields of the struct type t.
+func getKeyFields(t reflect.Type) *keyFields {
+	if kf, ok := keyFieldsCache.Load(t); ok {
+		return kf.(*keyFields)
+	}
+	kf, _ := keyFieldsCache.LoadOrStore(t, newKeyFields(t))
+	return kf.(*keyFields)
+}
+
+// keyFieldCandidate is a struct field that has a goon key tag.
+type keyFieldCandidate struct {
+	field     *keyField
+	tf        reflect.StructField
+	tagValues []string
+	depth     int // The number of embedded structs that contain the field
+}
+
+// newKeyFields finds the goon key fields of the struct type t.
+// Declaration errors are recorded in keyFields.err.
+//
+// The fields of anonymous embedded structs, or pointers to them, are searched
+// too, unless the embedded field itself has a goon tag. Like with Go's own
+// field promotion, the shallowest field with a given tag wins, and multiple
+// fields with the same tag at the same depth are an error.
+func newKeyFields(t reflect.Type) *keyFields {
+	kf := &keyFields{}
+	candidates := make(map[string][]keyFieldCandidate)
+	collectKeyFields(t, nil, 0, map[reflect.Type]bool{t: true}, candidates)
+	for _, tag := range []string{"id", "kind", "parent", "namespace"} {
+		cs := candidates[tag]
+		if len(cs) == 0 {
+			continue
+		}
+		best, duplicate := cs[0], false
+		for _, c := range cs[1:] {
+			if c.depth < best.depth {
+				best, duplicate = c, false
+			} else if c.depth == best.depth {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			kf.err = &KeyFieldError{Struct: t.Name(), Tag: tag, Reason: "Only one field may be marked " + tag}
+			return kf
+		}
+		switch tag {
+		case "id":
+			it, ok := getIdType(best.tf.Type)
+			if !ok {
+				kf.err = &KeyFieldError{Struct: t.Name(), Tag: "id", Reason: "ID field must be an integer, a string or implement encoding.TextMarshaler and encoding.TextUnmarshaler"}
+				return kf
+			}
+			if it == idText && !best.field.settable {
+				kf.err = &KeyFieldError{Struct: t.Name(), Tag: "id", Reason: "ID field implementing encoding.TextMarshaler must be exported"}
+				return kf
+			}
+			kf.id, kf.idType = best.field, it
+		case "kind":
+			kf.kind = best.field
+			if len(best.tagValues) > 1 {
+				kf.kindDefault = best.tagValues[1]
+			}
+		case "parent":
+			pt, _ := getParentType(best.tf.Type)
+			if pt != parentKey && !best.field.settable {
+				kf.err = &KeyFieldError{Struct: t.Name(), Tag: "parent", Reason: "Parent field holding a struct must be exported"}
+				return kf
+			}
+			kf.parent, kf.parentType = best.field, pt
+		case "namespace":
+			kf.namespace = best.field
+		}
+	}
+	return kf
+}
+
+// collectKeyFields adds the goon key fields of the struct type t to candidates,
+// recursing into embedded structs. The index of every field is prefixed by index.
+// Types in visited are already being searched, which prevents infinite recursion.
+func collectKeyFields(t reflect.Type, index []int, depth int, visited map[reflect.Type]bool, candidates map[string][]keyFieldCandidate) {
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		tagValues := strings.Split(tf.Tag.Get("goon"), ",")
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
+		tag := tagValues[0]
+		if tf.Anonymous && tag == "" {
+			et := tf.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct && !visited[et] {
+				visited[et] = true
+				collectKeyFields(et, fieldIndex, depth+1, visited, candidates)
+				delete(visited, et)
+			}
+			continue
+		}
+		switch tag {
+		case "id":
+		case "kind", "namespace":
+			if tf.Type.Kind() != reflect.String {
+				continue
+			}
+		case "parent":
+			if _, ok := getParentType(tf.Type); !ok {
+				continue
+			}
+		default:
+			continue
+		}
+		candidates[tag] = append(candidates[tag], keyFieldCandidate{
+			field:     &keyField{index: fieldIndex, settable: tf.PkgPath == ""},
+			tf:        tf,
+			tagValues: tagValues,
+			depth:     depth,
+		})
+	}
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, except that it returns false
+// instead of panicking when it comes across a nil embedded struct pointer.
+// If alloc is true, then settable nil pointers are allocated instead.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// getId returns the id stored in the id field vf of type it.
+// A zero value of an encoding.TextMarshaler means an incomplete key.
+func getId(vf reflect.Value, it idType) (stringID string, intID int64, err error) {
+	switch it {
+	case idInt:
+		intID = vf.Int()
+	case idUint:
+		u := vf.Uint()
+		if u > math.MaxInt64 {
+			err = fmt.Errorf("%w: ID %v overflows int64", ErrInvalidKeyStruct, u)
+			return
+		}
+		intID = int64(u)
+	case idString:
+		stringID = vf.String()
+	case idText:
+		if vf.IsZero() {
+			return
+		}
+		var tm encoding.TextMarshaler
+		if vf.Type().Implements(textMarshalerType) {
+			tm = vf.Interface().(encoding.TextMarshaler)
+		} else {
+			// MarshalText has a pointer receiver, so use an addressable copy if needed
+			pv := reflect.New(vf.Type())
+			pv.Elem().Set(vf)
+			tm = pv.Interface().(encoding.TextMarshaler)
+		}
+		var text []byte
+		if text, err = tm.MarshalText(); err != nil {
+			err = fmt.Errorf("%w: ID MarshalText failed: %v", ErrInvalidKeyStruct, err)
+			return
+		}
+		stringID = string(text)
+	}
+	return
+}
+
+// setId stores the id of key in the id field vf of type it.
+func setId(vf reflect.Value, it idType, key *datastore.Key) error {
+	switch it {
+	case idInt:
+		if vf.OverflowInt(key.IntID()) {
+			return fmt.Errorf("%w: ID %v overflows %v", ErrInvalidKeyStruct, key.IntID(), vf.Type())
+		}
+		vf.SetInt(key.IntID())
+	case idUint:
+		if key.IntID() < 0 || vf.OverflowUint(uint64(key.IntID())) {
+			return fmt.Errorf("%w: ID %v overflows %v", ErrInvalidKeyStruct, key.IntID(), vf.Type())
+		}
+		vf.SetUint(uint64(key.IntID()))
+	case idString:
+		vf.SetString(key.StringID())
+	case idText:
+		if key.StringID() == "" {
+			vf.Set(reflect.Zero(vf.Type()))
+			return nil
+		}
+		if err := vf.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(key.StringID())); err != nil {
+			return fmt.Errorf("%w: ID UnmarshalText failed: %v", ErrInvalidKeyStruct, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type benchKeyStruct struct {
+	Name    string
+	Id      int64          `datastore:"-" goon:"id"`
+	Kind    string         `datastore:"-" goon:"kind,BenchKind"`
+	Parent  *datastore.Key `datastore:"-" goon:"parent"`
+	Data    []byte
+	Count   int
+	Enabled bool
+}
+
+func TestKeyFields(t *testing.T) {
+	kf := getKeyFields(reflect.TypeOf(benchKeyStruct{}))
+	if kf != getKeyFields(reflect.TypeOf(benchKeyStruct{})) {
+		t.Fatalf("Expected the key fields to be cached")
+	}
+	if kf.err != nil || kf.kindDefault != "BenchKind" {
+		t.Fatalf("Unexpected key fields: %+v", kf)
+	}
+	if !reflect.DeepEqual(kf.id.index, []int{1}) || !reflect.DeepEqual(kf.kind.index, []int{2}) || !reflect.DeepEqual(kf.parent.index, []int{3}) || kf.namespace != nil {
+		t.Fatalf("Unexpected key field indexes: %+v", kf)
+	}
+
+	// Duplicate tags are an error even when the values are empty
+	g := FromContext(offlineContext())
+	if _, err := g.KeyError(TwoId{}); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected ErrInvalidKeyStruct, got %v", err)
+	}
+	if err := g.setStructKey(&TwoId{}, datastore.NewKey(g.Context, "TwoId", "", 1, nil)); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected ErrInvalidKeyStruct, got %v", err)
+	}
+}
+
+type userID int64
+
+type hasUserID struct {
+	Id   userID `datastore:"-" goon:"id"`
+	Name string
+}
+
+type hasUintID struct {
+	Id uint16 `datastore:"-" goon:"id"`
+}
+
+type hasUint64ID struct {
+	Id uint64 `datastore:"-" goon:"id"`
+}
+
+// textID is a UUID-like id, which is stored as a hex string id.
+type textID [4]byte
+
+func (id textID) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(id[:])), nil
+}
+
+func (id *textID) UnmarshalText(text []byte) error {
+	if len(text) != hex.EncodedLen(len(id)) {
+		return fmt.Errorf("invalid textID %q", text)
+	}
+	_, err := hex.Decode(id[:], text)
+	return err
+}
+
+type hasTextID struct {
+	Id   textID `datastore:"-" goon:"id"`
+	Name string
+}
+
+type hasUnexportedTextID struct {
+	id textID `goon:"id"`
+}
+
+func TestCustomIdTypes(t *testing.T) {
+	g := FromContext(offlineContext())
+
+	// Named integer types
+	key, err := g.KeyError(&hasUserID{Id: 5})
+	if err != nil || key.IntID() != 5 || key.StringID() != "" {
+		t.Fatalf("Unexpected key %v (%v)", key, err)
+	}
+	hu := &hasUserID{}
+	if err := g.setStructKey(hu, key); err != nil || hu.Id != 5 {
+		t.Fatalf("Expected id 5, got %v (%v)", hu.Id, err)
+	}
+
+	// Unsigned integers, which must fit into the key id and back
+	if key := g.Key(&hasUintID{Id: 7}); key.IntID() != 7 {
+		t.Fatalf("Expected id 7, got %v", key)
+	}
+	if err := g.setStructKey(&hasUintID{}, datastore.NewKey(g.Context, "hasUintID", "", 70000, nil)); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected an overflow error, got %v", err)
+	}
+	if _, err := g.KeyError(&hasUint64ID{Id: math.MaxUint64}); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected an overflow error, got %v", err)
+	}
+
+	// TextMarshaler ids are string ids, and the zero value is incomplete
+	key, err = g.KeyError(&hasTextID{Id: textID{1, 2, 3, 4}})
+	if err != nil || key.StringID() != "01020304" {
+		t.Fatalf("Unexpected key %v (%v)", key, err)
+	}
+	ht := &hasTextID{}
+	if err := g.setStructKey(ht, key); err != nil || ht.Id != (textID{1, 2, 3, 4}) {
+		t.Fatalf("Expected id 01020304, got %v (%v)", ht.Id, err)
+	}
+	if key := g.Key(&hasTextID{}); key == nil || !key.Incomplete() {
+		t.Fatalf("Expected an incomplete key, got %v", key)
+	}
+	if _, err := g.extractKeys(g.Context, []*hasTextID{{}}, true); !errors.Is(err, ErrIncompleteKey) {
+		t.Fatalf("Expected an empty string id error on put, got %v", err)
+	}
+	// Keys are created with the context of the operation
+	nc, err := appengine.Namespace(g.Context, "ns")
+	if err != nil {
+		t.Fatalf("Unexpected error on Namespace: %v", err)
+	}
+	if keys, err := g.extractKeys(nc, []*hasTextID{{Id: textID{1, 2, 3, 4}}}, false); err != nil || keys[0].Namespace() != "ns" {
+		t.Fatalf("Expected a key in namespace ns, got %v (%v)", keys, err)
+	}
+	if err := g.setStructKey(ht, datastore.NewKey(g.Context, "hasTextID", "bad", 0, nil)); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected an UnmarshalText error, got %v", err)
+	}
+	if _, err := g.KeyError(&hasUnexportedTextID{}); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected an unexported field error, got %v", err)
+	}
+}
+
+type keyBase struct {
+	Id     int64          `datastore:"-" goon:"id"`
+	Parent *datastore.Key `datastore:"-" goon:"parent"`
+}
+
+type KeyBase struct {
+	Id   int64  `datastore:"-" goon:"id"`
+	Kind string `datastore:"-" goon:"kind"`
+}
+
+type OtherKeyBase struct {
+	Id int64 `datastore:"-" goon:"id"`
+}
+
+type embedsKeyBase struct {
+	keyBase
+	Name string
+}
+
+type embedsKeyBasePtr struct {
+	*KeyBase
+	Name string
+}
+
+type shadowsKeyBase struct {
+	Id string `datastore:"-" goon:"id"`
+	KeyBase
+}
+
+type embedsTwoKeyBases struct {
+	KeyBase
+	OtherKeyBase
+}
+
+type embedsItself struct {
+	Id int64 `datastore:"-" goon:"id"`
+	*embedsItself
+}
+
+func TestEmbeddedKeyFields(t *testing.T) {
+	g := FromContext(offlineContext())
+	parent := datastore.NewKey(g.Context, "Parent", "p", 0, nil)
+
+	// Fields of an unexported embedded struct are found and set
+	key, err := g.KeyError(&embedsKeyBase{keyBase: keyBase{Id: 3, Parent: parent}})
+	if err != nil || key.IntID() != 3 || !key.Parent().Equal(parent) || key.Kind() != "embedsKeyBase" {
+		t.Fatalf("Unexpected key %v (%v)", key, err)
+	}
+	ekb := &embedsKeyBase{}
+	if err := g.setStructKey(ekb, key); err != nil || ekb.Id != 3 || !ekb.Parent.Equal(parent) {
+		t.Fatalf("Unexpected struct %+v (%v)", ekb, err)
+	}
+
+	// A nil embedded pointer means an incomplete key, and is allocated when setting the key
+	if key := g.Key(&embedsKeyBasePtr{}); key == nil || !key.Incomplete() {
+		t.Fatalf("Expected an incomplete key, got %v", key)
+	}
+	key = g.Key(&embedsKeyBasePtr{KeyBase: &KeyBase{Id: 4, Kind: "Custom"}})
+	if key.IntID() != 4 || key.Kind() != "Custom" {
+		t.Fatalf("Unexpected key %v", key)
+	}
+	ekbp := &embedsKeyBasePtr{}
+	if err := g.setStructKey(ekbp, key); err != nil || ekbp.KeyBase == nil || ekbp.Id != 4 || ekbp.Kind != "Custom" {
+		t.Fatalf("Unexpected struct %+v (%v)", ekbp, err)
+	}
+
+	// Shallower fields win
+	key = g.Key(&shadowsKeyBase{Id: "top", KeyBase: KeyBase{Id: 5}})
+	if key.StringID() != "top" || key.IntID() != 0 {
+		t.Fatalf("Expected the top level id to win, got %v", key)
+	}
+
+	// Fields at the same depth conflict
+	var kfe *KeyFieldError
+	if _, err := g.KeyError(&embedsTwoKeyBases{}); !errors.As(err, &kfe) || kfe.Tag != "id" {
+		t.Fatalf("Expected a duplicate id error, got %v", err)
+	}
+
+	// Recursive types don't recurse forever
+	if key := g.Key(&embedsItself{Id: 6}); key.IntID() != 6 {
+		t.Fatalf("Unexpected key %v", key)
+	}
+}
+
+type keyParent struct {
+	Id   string `datastore:"-" goon:"id"`
+	Kind string `datastore:"-" goon:"kind"`
+}
+
+type hasParentPtr struct {
+	Id     int64      `datastore:"-" goon:"id"`
+	Parent *keyParent `datastore:"-" goon:"parent"`
+}
+
+type hasParentValue struct {
+	Id     int64     `datastore:"-" goon:"id"`
+	Parent keyParent `datastore:"-" goon:"parent"`
+}
+
+type hasGrandparent struct {
+	Id     int64         `datastore:"-" goon:"id"`
+	Parent *hasParentPtr `datastore:"-" goon:"parent"`
+}
+
+type hasUnexportedParentPtr struct {
+	Id     int64      `datastore:"-" goon:"id"`
+	parent *keyParent `goon:"parent"`
+}
+
+func TestParentStructs(t *testing.T) {
+	g := FromContext(offlineContext())
+	parent := datastore.NewKey(g.Context, "keyParent", "p", 0, nil)
+
+	// A nil pointer or zero value means no parent
+	if key := g.Key(&hasParentPtr{Id: 1}); key.Parent() != nil {
+		t.Fatalf("Expected no parent, got %v", key.Parent())
+	}
+	if key := g.Key(&hasParentValue{Id: 1}); key.Parent() != nil {
+		t.Fatalf("Expected no parent, got %v", key.Parent())
+	}
+
+	// The parent key is derived from the parent struct
+	key := g.Key(&hasParentPtr{Id: 1, Parent: &keyParent{Id: "p"}})
+	if !key.Parent().Equal(parent) {
+		t.Fatalf("Expected parent %v, got %v", parent, key.Parent())
+	}
+	key = g.Key(&hasParentValue{Id: 1, Parent: keyParent{Id: "p"}})
+	if !key.Parent().Equal(parent) {
+		t.Fatalf("Expected parent %v, got %v", parent, key.Parent())
+	}
+	key = g.Key(&hasGrandparent{Id: 2, Parent: &hasParentPtr{Id: 1, Parent: &keyParent{Id: "p"}}})
+	if !key.Parent().Parent().Equal(parent) || key.Parent().IntID() != 1 {
+		t.Fatalf("Unexpected key %v", key)
+	}
+
+	// Parents must have a complete key
+	var kfe *KeyFieldError
+	if _, err := g.KeyError(&hasParentPtr{Id: 1, Parent: &keyParent{}}); !errors.As(err, &kfe) || kfe.Tag != "parent" {
+		t.Fatalf("Expected a parent error, got %v", err)
+	}
+	if _, err := g.KeyError(&hasUnexportedParentPtr{}); !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected ErrInvalidKeyStruct, got %v", err)
+	}
+
+	// Setting the key fills in the parent structs
+	custom := datastore.NewKey(g.Context, "Custom", "c", 0, nil)
+	hpp := &hasParentPtr{}
+	if err := g.setStructKey(hpp, datastore.NewKey(g.Context, "hasParentPtr", "", 1, custom)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hpp.Parent == nil || hpp.Parent.Id != "c" || hpp.Parent.Kind != "Custom" {
+		t.Fatalf("Unexpected parent %+v", hpp.Parent)
+	}
+	hpv := &hasParentValue{Parent: keyParent{Id: "old"}}
+	if err := g.setStructKey(hpv, datastore.NewKey(g.Context, "hasParentValue", "", 1, parent)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hpv.Parent.Id != "p" || hpv.Parent.Kind != "" {
+		t.Fatalf("Unexpected parent %+v", hpv.Parent)
+	}
+	hg := &hasGrandparent{}
+	if err := g.setStructKey(hg, key); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hg.Id != 2 || hg.Parent == nil || hg.Parent.Id != 1 || hg.Parent.Parent == nil || hg.Parent.Parent.Id != "p" {
+		t.Fatalf("Unexpected struct %+v", hg)
+	}
+
+	// No parent key clears the parent
+	if err := g.setStructKey(hpp, datastore.NewKey(g.Context, "hasParentPtr", "", 1, nil)); err != nil || hpp.Parent != nil {
+		t.Fatalf("Expected the parent to be cleared, got %+v (%v)", hpp.Parent, err)
+	}
+}
+
+func BenchmarkExtractKeys(b *testing.B) {
+	g := FromContext(offlineContext())
+	parent := datastore.NewKey(g.Context, "Parent", "p", 0, nil)
+	src := make([]*benchKeyStruct, 1000)
+	for i := range src {
+		src[i] = &benchKeyStruct{Id: int64(i + 1), Parent: parent}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.extractKeys(g.Context, src, false); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkSetStructKey(b *testing.B) {
+	g := FromContext(offlineContext())
+	parent := datastore.NewKey(g.Context, "Parent", "p", 0, nil)
+	key := datastore.NewKey(g.Context, "BenchKind", "", 1, parent)
+	dst := &benchKeyStruct{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := g.setStructKey(dst, key); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
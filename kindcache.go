@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// KindCacheConfig configures how goon caches the entities of a single kind.
+type KindCacheConfig struct {
+	// LocalBudget is the maximum size in bytes that the entities of the kind
+	// may take up in the local memory cache. The kind gets a separate cache
+	// with this limit, so it neither evicts other kinds nor is evicted by them.
+	// Zero means that the kind shares the main local memory cache.
+	LocalBudget int
+	// NoLocalCache prevents the entities of the kind from being cached
+	// in the local memory cache.
+	NoLocalCache bool
+	// NoMemcache prevents the entities of the kind from being cached
+	// in memcache. They are still removed from memcache on Put and Delete,
+	// in case they got there before the kind was registered.
+	NoMemcache bool
+	// CacheQueries enables caching the results of GetAll ancestor queries of
+	// the kind as key lists, in the local memory cache and memcache. The cached
+	// results of the kind are invalidated on every Put and Delete of the kind.
+	// Queries without an ancestor are eventually consistent, and projection
+	// and distinct queries return partial entities, so they are never cached,
+	// and neither are queries that are iterated with Run. Every GetAll of
+	// the kind costs a memcache round trip to read the generation counter
+	// that invalidates the results, even when they are in the local cache.
+	CacheQueries bool
+	// CountCacheTTL enables caching the results of Count queries of the kind
+	// in memcache for at most this long. Like cached query results, the cached
+	// counts of the kind are invalidated on every Put and Delete of the kind.
+	CountCacheTTL time.Duration
+	// CountShards enables ApproximateCount for the kind, with the count kept
+	// in this many memcache counters, which Put and Delete update without
+	// contending with each other.
+	CountShards int
+	// CountLookups makes Put and Delete look up the complete keys of the kind
+	// in the datastore before writing them, so that ApproximateCount only
+	// counts the entities they actually create or remove. That's needed when
+	// the application chooses the ids, but costs an extra datastore read per
+	// key, which inside a transaction also joins its read set. Without it,
+	// only puts of incomplete keys count as creations, and every deleted key
+	// counts as a removal.
+	CountLookups bool
+	// CountResync is how long ApproximateCount trusts the counters before
+	// recounting the entities of the kind. Zero means an hour.
+	CountResync time.Duration
+}
+
+// kindCacheConfigs holds a map[string]KindCacheConfig, which is replaced
+// as a whole on every registration, so that lookups don't need a lock.
+var (
+	kindCacheConfigs    atomic.Value
+	kindCacheConfigLock sync.Mutex // serializes registrations
+)
+
+// RegisterKindCache sets the caching configuration of kind, replacing
+// any previous configuration. Kinds that aren't registered are cached
+// in the main local memory cache and memcache. RegisterKindCache is meant
+// to be called during initialization, before any Goon fetches the kind.
+func RegisterKindCache(kind string, cfg KindCacheConfig) {
+	kindCacheConfigLock.Lock()
+	defer kindCacheConfigLock.Unlock()
+	old, _ := kindCacheConfigs.Load().(map[string]KindCacheConfig)
+	configs := make(map[string]KindCacheConfig, len(old)+1)
+	for k, c := range old {
+		configs[k] = c
+	}
+	configs[kind] = cfg
+	kindCacheConfigs.Store(configs)
+}
+
+// kindCacheConfig returns the caching configuration of kind.
+func kindCacheConfig(kind string) (KindCacheConfig, bool) {
+	configs, _ := kindCacheConfigs.Load().(map[string]KindCacheConfig)
+	cfg, ok := configs[kind]
+	return cfg, ok
+}
+
+// kindCachesRegistered reports whether any kind has a caching configuration.
+func kindCachesRegistered() bool {
+	configs, _ := kindCacheConfigs.Load().(map[string]KindCacheConfig)
+	return len(configs) > 0
+}
+
+// skipMemcache reports whether the entities of kind must not be cached in memcache.
+func skipMemcache(kind string) bool {
+	cfg, _ := kindCacheConfig(kind)
+	return cfg.NoMemcache
+}
+
+// localCacheFor returns the local memory cache that holds the entities
+// of kind, or nil if the kind must not be cached locally.
+func (g *Goon) localCacheFor(kind string) localCache {
+	cfg, ok := kindCacheConfig(kind)
+	switch {
+	case !ok:
+		return g.cache
+	case cfg.NoLocalCache:
+		return nil
+	case cfg.LocalBudget > 0:
+		caches, _ := g.kindCaches.Load().(map[string]localCache)
+		if lc, ok := caches[kind]; ok {
+			return lc
+		}
+		return g.newKindCache(kind, cfg.LocalBudget)
+	}
+	return g.cache
+}
+
+// newKindCache creates the local memory cache of kind with the given budget,
+// unless another goroutine already did, and returns it.
+func (g *Goon) newKindCache(kind string, budget int) localCache {
+	g.kindCacheLock.Lock()
+	defer g.kindCacheLock.Unlock()
+	old, _ := g.kindCaches.Load().(map[string]localCache)
+	if lc, ok := old[kind]; ok {
+		return lc
+	}
+	caches := make(map[string]localCache, len(old)+1)
+	for k, lc := range old {
+		caches[k] = lc
+	}
+	lc := newLocalCache(budget, g.cacheOpts)
+	caches[kind] = lc
+	g.kindCaches.Store(caches)
+	return lc
+}
+
+// localCaches returns the main local memory cache and all the per-kind caches.
+func (g *Goon) localCaches() []localCache {
+	kindCaches, _ := g.kindCaches.Load().(map[string]localCache)
+	caches := make([]localCache, 0, len(kindCaches)+1)
+	caches = append(caches, g.cache)
+	for _, lc := range kindCaches {
+		caches = append(caches, lc)
+	}
+	return caches
+}
+
+// localGetMulti looks up cachekeys in the local memory caches of the kinds of keys.
+// Keys of kinds that aren't cached locally are always missing.
+func (g *Goon) localGetMulti(keys []*datastore.Key, cachekeys []string) [][]byte {
+	if !kindCachesRegistered() {
+		return g.cache.GetMulti(cachekeys)
+	}
+	values := make([][]byte, len(keys))
+	groups := make(map[localCache][]int)
+	for i, key := range keys {
+		if lc := g.localCacheFor(key.Kind()); lc != nil {
+			groups[lc] = append(groups[lc], i)
+		}
+	}
+	for lc, idxs := range groups {
+		gkeys := make([]string, len(idxs))
+		for j, i := range idxs {
+			gkeys[j] = cachekeys[i]
+		}
+		for j, value := range lc.GetMulti(gkeys) {
+			values[idxs[j]] = value
+		}
+	}
+	return values
+}
+
+// localSetMulti stores items in the local memory caches of the kinds of keys,
+// where items[i] belongs to keys[i]. Returns the number of items stored.
+func (g *Goon) localSetMulti(keys []*datastore.Key, items []*cacheItem) int {
+	if !kindCachesRegistered() {
+		g.cache.SetMulti(items)
+		return len(items)
+	}
+	groups := make(map[localCache][]*cacheItem)
+	stored := 0
+	for i, key := range keys {
+		if lc := g.localCacheFor(key.Kind()); lc != nil {
+			groups[lc] = append(groups[lc], items[i])
+			stored++
+		}
+	}
+	for lc, gitems := range groups {
+		lc.SetMulti(gitems)
+	}
+	return stored
+}
+
+// localDeleteMulti removes cachekeys from all the local memory caches,
+// as the cache keys don't reveal which kind they belong to.
+func (g *Goon) localDeleteMulti(cachekeys []string) {
+	for _, lc := range g.localCaches() {
+		lc.DeleteMulti(cachekeys)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// registerTestKindCaches registers configs and returns a function
+// that restores the previous registrations.
+func registerTestKindCaches(configs map[string]KindCacheConfig) func() {
+	old, _ := kindCacheConfigs.Load().(map[string]KindCacheConfig)
+	for kind, cfg := range configs {
+		RegisterKindCache(kind, cfg)
+	}
+	return func() {
+		kindCacheConfigs.Store(old)
+	}
+}
+
+func TestKindCacheRouting(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{
+		"BudgetKind":  {LocalBudget: 2 * (cachedValueOverhead + 100)},
+		"NoLocalKind": {NoLocalCache: true},
+	})()
+	g := FromContext(offlineContext())
+
+	var keys []*datastore.Key
+	var items []*cacheItem
+	for _, kind := range []string{"BudgetKind", "NoLocalKind", "OtherKind"} {
+		for id := int64(1); id <= 3; id++ {
+			key := datastore.NewKey(g.Context, kind, "", id, nil)
+			keys = append(keys, key)
+			items = append(items, &cacheItem{key: cacheKey(key), value: make([]byte, 50)})
+		}
+	}
+	if n := g.localSetMulti(keys, items); n != 6 {
+		t.Fatalf("Expected 6 items to be stored, got %v", n)
+	}
+
+	cachekeys := make([]string, len(items))
+	for i, item := range items {
+		cachekeys[i] = item.key
+	}
+	values := g.localGetMulti(keys, cachekeys)
+	// The budget only fits two BudgetKind values, and the first one was evicted
+	found := make([]bool, len(values))
+	for i, v := range values {
+		found[i] = v != nil
+	}
+	expected := []bool{false, true, true, false, false, false, true, true, true}
+	for i := range expected {
+		if found[i] != expected[i] {
+			t.Fatalf("Expected %v to be found %v, got %v", keys[i], expected[i], found[i])
+		}
+	}
+	// The main cache wasn't affected by the BudgetKind evictions
+	if stats := g.cache.Stats(); stats.Items != 3 || stats.Evictions != 0 {
+		t.Fatalf("Unexpected main cache stats: %+v", stats)
+	}
+	if stats := g.CacheStats(); stats.Items != 5 || stats.Evictions != 1 {
+		t.Fatalf("Unexpected total stats: %+v", stats)
+	}
+
+	// Deletes reach the per-kind caches too
+	g.localDeleteMulti(cachekeys[1:2])
+	if v := g.localGetMulti(keys[1:2], cachekeys[1:2]); v[0] != nil {
+		t.Fatalf("Expected the deleted value to be gone, got %v", v[0])
+	}
+	g.FlushLocalCache()
+	if stats := g.CacheStats(); stats.Items != 0 {
+		t.Fatalf("Expected empty caches, got %+v", stats)
+	}
+}
+
+func TestKindCacheShards(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{
+		"BudgetKind": {LocalBudget: 1 << 20},
+	})()
+	g := FromContext(offlineContext())
+	if _, ok := g.localCacheFor("BudgetKind").(*cache); !ok {
+		t.Fatalf("Expected an unsharded cache, got %T", g.localCacheFor("BudgetKind"))
+	}
+	g.ConfigureLocalCache(LocalCacheOptions{Shards: 4})
+	lc := g.localCacheFor("BudgetKind")
+	if _, ok := lc.(*shardedCache); !ok {
+		t.Fatalf("Expected a sharded cache, got %T", lc)
+	}
+	if again := g.localCacheFor("BudgetKind"); again != lc {
+		t.Fatalf("Expected the same cache to be returned again")
+	}
+	if n := len(g.localCaches()); n != 2 {
+		t.Fatalf("Expected 2 local caches, got %v", n)
+	}
+}
+
+func TestKindCacheGetMultiLocal(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{
+		"BudgetKind": {LocalBudget: 1 << 10},
+	})()
+	g := FromContext(offlineContext())
+
+	src := &HasKind{Id: 1, Kind: "BudgetKind", Name: "budget"}
+	data, err := serializeStruct(src)
+	if err != nil {
+		t.Fatalf("Unexpected error serializing: %v", err)
+	}
+	key := g.Key(src)
+	g.localCacheFor(key.Kind()).Set(&cacheItem{key: cacheKey(key), value: data})
+
+	dst := &HasKind{Id: 1, Kind: "BudgetKind"}
+	if err := g.Get(dst); err != nil {
+		t.Fatalf("Unexpected error on Get: %v", err)
+	}
+	if dst.Name != "budget" {
+		t.Fatalf("Expected name to be 'budget', got %v", dst.Name)
+	}
+}
+
+func TestKindCacheExclusion(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	defer registerTestKindCaches(map[string]KindCacheConfig{
+		"NoLocalKind":    {NoLocalCache: true},
+		"NoMemcacheKind": {NoMemcache: true},
+	})()
+	g := FromContext(c)
+
+	noLocal := &HasKind{Id: 1, Kind: "NoLocalKind", Name: "no local"}
+	noMemcache := &HasKind{Id: 1, Kind: "NoMemcacheKind", Name: "no memcache"}
+	if _, err := g.PutMulti([]*HasKind{noLocal, noMemcache}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasKind{{Id: 1, Kind: "NoLocalKind"}, {Id: 1, Kind: "NoMemcacheKind"}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+
+	noLocalKey, noMemcacheKey := cacheKey(g.Key(noLocal)), cacheKey(g.Key(noMemcache))
+	if v := g.cache.Get(noLocalKey); v != nil {
+		t.Fatalf("Expected NoLocalKind to not be cached locally")
+	}
+	if _, err := memcache.Get(c, noLocalKey); err != nil {
+		t.Fatalf("Expected NoLocalKind to be in memcache, got %v", err)
+	}
+	if v := g.cache.Get(noMemcacheKey); v == nil {
+		t.Fatalf("Expected NoMemcacheKind to be cached locally")
+	}
+	if _, err := memcache.Get(c, noMemcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatalf("Expected NoMemcacheKind to not be in memcache, got %v", err)
+	}
+
+	// Neither does a query cache NoLocalKind locally
+	var results []*HasKind
+	if _, err := g.GetAll(datastore.NewQuery("NoLocalKind"), &results); err != nil {
+		t.Fatalf("Unexpected error on GetAll - %v", err)
+	}
+	if len(results) != 1 || g.cache.Get(noLocalKey) != nil {
+		t.Fatalf("Expected a single uncached result, got %v", len(results))
+	}
+	it := g.Run(datastore.NewQuery("NoLocalKind"))
+	if _, err := it.Next(&HasKind{}); err != nil {
+		t.Fatalf("Unexpected error on Next - %v", err)
+	}
+	if g.cache.Get(noLocalKey) != nil {
+		t.Fatalf("Expected Next to not cache NoLocalKind")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// LogLevel is the severity of a LogEntry.
+type LogLevel int
+
+// Log levels, in increasing order of severity.
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarning:
+		return "warning"
+	case LogLevelError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// LogEntry is a single structured message logged by goon.
+// Any field other than Level may be left empty.
+type LogEntry struct {
+	Level    LogLevel
+	Message  string // Description of what happened, if Err alone isn't enough
+	Err      error  // The error that caused this entry
+	Op       string // The goon operation, e.g. "GetMulti"
+	Kind     string // The kind of the first key involved
+	KeyCount int    // The number of keys involved
+	Tier     Tier   // The storage tier involved
+	Caller   string // The file:line inside goon that logged the entry
+}
+
+// String formats the entry as a single human readable line.
+func (e *LogEntry) String() string {
+	var sb strings.Builder
+	sb.WriteString("goon")
+	if e.Caller != "" {
+		sb.WriteString(" - ")
+		sb.WriteString(e.Caller)
+	}
+	if e.Message != "" {
+		sb.WriteString(" - ")
+		sb.WriteString(e.Message)
+	}
+	if e.Err != nil {
+		sb.WriteString(" - ")
+		sb.WriteString(e.Err.Error())
+	}
+	var fields []string
+	if e.Op != "" {
+		fields = append(fields, "op="+e.Op)
+	}
+	if e.Kind != "" {
+		fields = append(fields, "kind="+e.Kind)
+	}
+	if e.KeyCount != 0 {
+		fields = append(fields, fmt.Sprintf("keys=%d", e.KeyCount))
+	}
+	if e.Tier != "" {
+		fields = append(fields, "tier="+string(e.Tier))
+	}
+	if len(fields) > 0 {
+		sb.WriteString(" [")
+		sb.WriteString(strings.Join(fields, " "))
+		sb.WriteString("]")
+	}
+	return sb.String()
+}
+
+// Logger receives all the messages that goon logs, along with the context
+// of the operation, which is the one given to the Context variants.
+// Log may be called concurrently from multiple goroutines.
+type Logger interface {
+	Log(c context.Context, e *LogEntry)
+}
+
+// DefaultLogger is the Logger used when Goon.Logger is nil.
+// It writes to appengine/log and honors LogErrors and LogTimeoutErrors.
+var DefaultLogger Logger = appengineLogger{}
+
+type appengineLogger struct{}
+
+func (appengineLogger) Log(c context.Context, e *LogEntry) {
+	switch e.Level {
+	case LogLevelError:
+		if LogErrors {
+			log.Errorf(c, "%v", e)
+		}
+	case LogLevelWarning:
+		if LogTimeoutErrors {
+			log.Warningf(c, "%v", e)
+		}
+	case LogLevelInfo:
+		log.Infof(c, "%v", e)
+	default:
+		log.Debugf(c, "%v", e)
+	}
+}
+
+// keysKind returns the kind of the first key, or an empty string if there are no keys.
+func keysKind(keys []*datastore.Key) string {
+	if len(keys) == 0 || keys[0] == nil {
+		return ""
+	}
+	return keys[0].Kind()
+}
+
+func (g *Goon) logger() Logger {
+	if g.Logger != nil {
+		return g.Logger
+	}
+	return DefaultLogger
+}
+
+// log fills in the caller of the function that called the logging helper
+// and passes e on, along with the context c of the operation.
+func (g *Goon) log(c context.Context, e *LogEntry) {
+	if _, filename, line, ok := runtime.Caller(2); ok {
+		e.Caller = fmt.Sprintf("%s:%d", filepath.Base(filename), line)
+	}
+	g.logger().Log(c, e)
+}
+
+func (g *Goon) error(c context.Context, e *LogEntry) {
+	e.Level = LogLevelError
+	g.log(c, e)
+}
+
+func (g *Goon) timeoutError(c context.Context, e *LogEntry) {
+	e.Level = LogLevelWarning
+	e.Message = "memcache timeout"
+	g.log(c, e)
+}
+
+// memcacheDeleteError logs a memcache.DeleteMulti error, ignoring cache misses,
+// and returns the logged error or nil if there was nothing to log.
+func (g *Goon) memcacheDeleteError(c context.Context, e *LogEntry) error {
+	if e.Err == nil {
+		return nil
+	}
+	if me, ok := e.Err.(appengine.MultiError); ok {
+		e.Err = nil
+		for i := range me {
+			if me[i] != nil && me[i] != memcache.ErrCacheMiss {
+				e.Err = me[i]
+				break
+			}
+		}
+		if e.Err == nil {
+			return nil
+		}
+	}
+	e.Level = LogLevelError
+	e.Message = "memcache.DeleteMulti failed - the goon cache may be out of sync now!"
+	e.Tier = TierMemcache
+	g.log(c, e)
+	return e.Err
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+type recordingLogger struct {
+	lock     sync.Mutex
+	entries  []LogEntry
+	contexts []context.Context
+}
+
+func (rl *recordingLogger) Log(c context.Context, e *LogEntry) {
+	rl.lock.Lock()
+	rl.entries = append(rl.entries, *e)
+	rl.contexts = append(rl.contexts, c)
+	rl.lock.Unlock()
+}
+
+func TestLogger(t *testing.T) {
+	g := FromContext(offlineContext())
+	if g.Logger != DefaultLogger {
+		t.Fatalf("Expected FromContext to set DefaultLogger")
+	}
+	g.Logger = nil
+	if g.logger() != DefaultLogger {
+		t.Fatalf("Expected nil Logger to fall back to DefaultLogger")
+	}
+
+	rl := &recordingLogger{}
+	g.Logger = rl
+
+	errTest := errors.New("test error")
+	c := g.Context
+	g.error(c, &LogEntry{Op: "GetMulti", Kind: "HasId", KeyCount: 3, Tier: TierDatastore, Err: errTest})
+	g.timeoutError(c, &LogEntry{Op: "GetMulti", KeyCount: 2, Tier: TierMemcache, Err: errTest})
+	// Cache misses are not errors for memcache.DeleteMulti
+	g.memcacheDeleteError(c, &LogEntry{Op: "DeleteMulti", Err: appengine.MultiError{memcache.ErrCacheMiss, nil}})
+	g.memcacheDeleteError(c, &LogEntry{Op: "DeleteMulti", Err: nil})
+	g.memcacheDeleteError(c, &LogEntry{Op: "DeleteMulti", Err: appengine.MultiError{memcache.ErrCacheMiss, errTest}})
+
+	if len(rl.entries) != 3 {
+		t.Fatalf("Expected 3 log entries, got %v: %+v", len(rl.entries), rl.entries)
+	}
+
+	e := rl.entries[0]
+	if e.Level != LogLevelError || e.Err != errTest || e.Op != "GetMulti" || e.Kind != "HasId" || e.KeyCount != 3 || e.Tier != TierDatastore {
+		t.Fatalf("Unexpected error entry: %+v", e)
+	}
+	if !strings.HasPrefix(e.Caller, "log_test.go:") {
+		t.Fatalf("Expected caller to be in log_test.go, got %v", e.Caller)
+	}
+	if s := e.String(); !strings.Contains(s, "test error") || !strings.Contains(s, "op=GetMulti kind=HasId keys=3 tier=datastore") {
+		t.Fatalf("Unexpected entry string: %v", s)
+	}
+
+	if e := rl.entries[1]; e.Level != LogLevelWarning || e.Tier != TierMemcache || e.Message == "" {
+		t.Fatalf("Unexpected timeout entry: %+v", e)
+	}
+
+	if e := rl.entries[2]; e.Level != LogLevelError || e.Err != errTest || e.Tier != TierMemcache || e.Op != "DeleteMulti" {
+		t.Fatalf("Unexpected memcache delete entry: %+v", e)
+	}
+}
+
+type logTestKey struct{}
+
+func TestLoggerContext(t *testing.T) {
+	g := FromContext(offlineContext())
+	rl := &recordingLogger{}
+	g.Logger = rl
+
+	// The header claims one property, which is missing
+	hi := &HasId{Id: 1}
+	g.cache.Set(&cacheItem{key: cacheKey(g.Key(hi)), value: []byte{1, 0, 0, 0x40}})
+
+	// Errors are logged with the context given to GetMultiContext
+	c := context.WithValue(g.Context, logTestKey{}, "request")
+	if err := g.GetMultiContext(c, []*HasId{hi}); err == nil {
+		t.Fatalf("Expected an error for corrupt cache data")
+	}
+	if len(rl.contexts) != 1 || rl.contexts[0].Value(logTestKey{}) != "request" {
+		t.Fatalf("Expected a single entry logged with the caller's context, got %+v", rl.entries)
+	}
+}
+
+func TestLoggerCacheInvalidation(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{"HasId": {CacheQueries: true}})()
+	g := FromContext(offlineContext())
+	rl := &recordingLogger{}
+	g.Logger = rl
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	// Outside App Engine every memcache call fails
+	key := datastore.NewKey(g.Context, "HasId", "", 1, nil)
+	if err := g.invalidateCacheKeys(g.Context, "PutMulti", "HasId", []string{cacheKey(key)}); err == nil {
+		t.Fatalf("Expected a memcache error")
+	}
+	if err := g.bumpQueryGenerations(g.Context, "PutMulti", []*datastore.Key{key}); err == nil {
+		t.Fatalf("Expected a memcache error")
+	}
+	if len(rl.entries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %v: %+v", len(rl.entries), rl.entries)
+	}
+	for _, e := range rl.entries {
+		if e.Level != LogLevelError || e.Op != "PutMulti" || e.Tier != TierMemcache || e.Err == nil {
+			t.Fatalf("Unexpected entry: %+v", e)
+		}
+	}
+	if n := mc.Counter("PutMulti", TierMemcache, MetricError); n != 2 {
+		t.Fatalf("Expected 2 memcache errors, got %v", n)
+	}
+}
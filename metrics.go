@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// MetricEvent is something that happened in a storage tier.
+type MetricEvent string
+
+// The events reported via Metrics.Count.
+const (
+	MetricHit     MetricEvent = "hit"     // A key was found
+	MetricMiss    MetricEvent = "miss"    // A key was not found
+	MetricSet     MetricEvent = "set"     // A key was written
+	MetricDelete  MetricEvent = "delete"  // A key was deleted
+	MetricResult  MetricEvent = "result"  // A query returned a result
+	MetricError   MetricEvent = "error"   // A call to the tier failed
+	MetricTimeout MetricEvent = "timeout" // A call to the tier timed out
+)
+
+// Metrics receives counters and timings at every storage tier decision
+// that goon makes. The methods may be called concurrently from multiple
+// goroutines, and should return quickly.
+type Metrics interface {
+	// Count adds n to the counter of event in tier during operation op.
+	Count(op string, tier Tier, event MetricEvent, n int)
+	// Timing records the duration of a single call to tier during operation op.
+	Timing(op string, tier Tier, d time.Duration)
+}
+
+func (g *Goon) count(op string, tier Tier, event MetricEvent, n int) {
+	if g.Metrics != nil && n > 0 {
+		g.Metrics.Count(op, tier, event, n)
+	}
+}
+
+func (g *Goon) timing(op string, tier Tier, start time.Time) {
+	if g.Metrics != nil {
+		g.Metrics.Timing(op, tier, time.Since(start))
+	}
+}
+
+// countMultiErr reports the per key outcome of a call to tier with n keys.
+// Successful keys are counted as event and missing entities as MetricMiss.
+func (g *Goon) countMultiErr(op string, tier Tier, event MetricEvent, n int, err error) {
+	if g.Metrics == nil {
+		return
+	}
+	if err == nil {
+		g.count(op, tier, event, n)
+		return
+	}
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		if appengine.IsTimeoutError(err) {
+			g.count(op, tier, MetricTimeout, 1)
+		} else {
+			g.count(op, tier, MetricError, 1)
+		}
+		return
+	}
+	succeeded, missing := 0, 0
+	for _, e := range merr {
+		if e == nil || errFieldMismatch(e) {
+			succeeded++
+		} else if errors.Is(e, datastore.ErrNoSuchEntity) {
+			missing++
+		}
+	}
+	g.count(op, tier, event, succeeded)
+	g.count(op, tier, MetricMiss, missing)
+	if succeeded+missing < len(merr) {
+		g.count(op, tier, MetricError, 1)
+	}
+}
+
+// TimingStats is a summary of the timings recorded for one operation and tier.
+type TimingStats struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+type metricCounterKey struct {
+	op    string
+	tier  Tier
+	event MetricEvent
+}
+
+type metricTimingKey struct {
+	op   string
+	tier Tier
+}
+
+// MetricsCollector is an in-memory Metrics implementation.
+// It is safe for concurrent use and can be shared by many Goons.
+type MetricsCollector struct {
+	lock     sync.Mutex
+	counters map[metricCounterKey]int64
+	timings  map[metricTimingKey]*TimingStats
+}
+
+// NewMetricsCollector returns a new empty MetricsCollector.
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{
+		counters: map[metricCounterKey]int64{},
+		timings:  map[metricTimingKey]*TimingStats{},
+	}
+}
+
+// Count implements Metrics.
+func (mc *MetricsCollector) Count(op string, tier Tier, event MetricEvent, n int) {
+	mc.lock.Lock()
+	mc.counters[metricCounterKey{op, tier, event}] += int64(n)
+	mc.lock.Unlock()
+}
+
+// Timing implements Metrics.
+func (mc *MetricsCollector) Timing(op string, tier Tier, d time.Duration) {
+	mc.lock.Lock()
+	ts := mc.timings[metricTimingKey{op, tier}]
+	if ts == nil {
+		ts = &TimingStats{}
+		mc.timings[metricTimingKey{op, tier}] = ts
+	}
+	ts.Count++
+	ts.Total += d
+	if d > ts.Max {
+		ts.Max = d
+	}
+	mc.lock.Unlock()
+}
+
+// Counter returns the current value of the counter of event in tier during operation op.
+func (mc *MetricsCollector) Counter(op string, tier Tier, event MetricEvent) int64 {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.counters[metricCounterKey{op, tier, event}]
+}
+
+// Timings returns the summary of the timings recorded for tier during operation op.
+func (mc *MetricsCollector) Timings(op string, tier Tier) TimingStats {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if ts := mc.timings[metricTimingKey{op, tier}]; ts != nil {
+		return *ts
+	}
+	return TimingStats{}
+}
+
+// HitRatio returns the fraction of keys looked up in tier during operation op
+// that were found there. Returns zero if there were no lookups.
+func (mc *MetricsCollector) HitRatio(op string, tier Tier) float64 {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	hits := mc.counters[metricCounterKey{op, tier, MetricHit}]
+	misses := mc.counters[metricCounterKey{op, tier, MetricMiss}]
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// Reset clears all the collected metrics.
+func (mc *MetricsCollector) Reset() {
+	mc.lock.Lock()
+	mc.counters = map[metricCounterKey]int64{}
+	mc.timings = map[metricTimingKey]*TimingStats{}
+	mc.lock.Unlock()
+}
+
+// WritePrometheus writes all the collected metrics to w
+// in the Prometheus text exposition format.
+func (mc *MetricsCollector) WritePrometheus(w io.Writer) error {
+	mc.lock.Lock()
+	counterKeys := make([]metricCounterKey, 0, len(mc.counters))
+	counters := make(map[metricCounterKey]int64, len(mc.counters))
+	for k, v := range mc.counters {
+		counterKeys = append(counterKeys, k)
+		counters[k] = v
+	}
+	timingKeys := make([]metricTimingKey, 0, len(mc.timings))
+	timings := make(map[metricTimingKey]TimingStats, len(mc.timings))
+	for k, v := range mc.timings {
+		timingKeys = append(timingKeys, k)
+		timings[k] = *v
+	}
+	mc.lock.Unlock()
+
+	sort.Slice(counterKeys, func(i, j int) bool {
+		a, b := counterKeys[i], counterKeys[j]
+		if a.op != b.op {
+			return a.op < b.op
+		}
+		if a.tier != b.tier {
+			return a.tier < b.tier
+		}
+		return a.event < b.event
+	})
+	sort.Slice(timingKeys, func(i, j int) bool {
+		a, b := timingKeys[i], timingKeys[j]
+		if a.op != b.op {
+			return a.op < b.op
+		}
+		return a.tier < b.tier
+	})
+
+	bw := bufio.NewWriter(w)
+	if len(counterKeys) > 0 {
+		fmt.Fprintln(bw, "# HELP goon_tier_events_total Number of events in goon storage tiers.")
+		fmt.Fprintln(bw, "# TYPE goon_tier_events_total counter")
+		for _, k := range counterKeys {
+			fmt.Fprintf(bw, "goon_tier_events_total{op=%q,tier=%q,event=%q} %d\n", k.op, k.tier, k.event, counters[k])
+		}
+	}
+	if len(timingKeys) > 0 {
+		fmt.Fprintln(bw, "# HELP goon_tier_duration_seconds Time spent in calls to goon storage tiers.")
+		fmt.Fprintln(bw, "# TYPE goon_tier_duration_seconds summary")
+		for _, k := range timingKeys {
+			ts := timings[k]
+			fmt.Fprintf(bw, "goon_tier_duration_seconds_sum{op=%q,tier=%q} %s\n", k.op, k.tier, strconv.FormatFloat(ts.Total.Seconds(), 'g', -1, 64))
+			fmt.Fprintf(bw, "goon_tier_duration_seconds_count{op=%q,tier=%q} %d\n", k.op, k.tier, ts.Count)
+		}
+		fmt.Fprintln(bw, "# HELP goon_tier_duration_seconds_max Longest call to goon storage tiers.")
+		fmt.Fprintln(bw, "# TYPE goon_tier_duration_seconds_max gauge")
+		for _, k := range timingKeys {
+			fmt.Fprintf(bw, "goon_tier_duration_seconds_max{op=%q,tier=%q} %s\n", k.op, k.tier, strconv.FormatFloat(timings[k].Max.Seconds(), 'g', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	mc := NewMetricsCollector()
+	mc.Count("GetMulti", TierLocal, MetricHit, 3)
+	mc.Count("GetMulti", TierLocal, MetricMiss, 1)
+	mc.Count("GetMulti", TierMemcache, MetricTimeout, 1)
+	mc.Timing("GetMulti", TierMemcache, 2*time.Second)
+	mc.Timing("GetMulti", TierMemcache, 500*time.Millisecond)
+
+	if v := mc.Counter("GetMulti", TierLocal, MetricHit); v != 3 {
+		t.Fatalf("Expected 3 hits, got %v", v)
+	}
+	if r := mc.HitRatio("GetMulti", TierLocal); r != 0.75 {
+		t.Fatalf("Expected hit ratio of 0.75, got %v", r)
+	}
+	if r := mc.HitRatio("GetMulti", TierDatastore); r != 0 {
+		t.Fatalf("Expected hit ratio of 0, got %v", r)
+	}
+	if ts := mc.Timings("GetMulti", TierMemcache); ts.Count != 2 || ts.Total != 2500*time.Millisecond || ts.Max != 2*time.Second {
+		t.Fatalf("Unexpected timings: %+v", ts)
+	}
+
+	var buf bytes.Buffer
+	if err := mc.WritePrometheus(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `# HELP goon_tier_events_total Number of events in goon storage tiers.
+# TYPE goon_tier_events_total counter
+goon_tier_events_total{op="GetMulti",tier="local",event="hit"} 3
+goon_tier_events_total{op="GetMulti",tier="local",event="miss"} 1
+goon_tier_events_total{op="GetMulti",tier="memcache",event="timeout"} 1
+# HELP goon_tier_duration_seconds Time spent in calls to goon storage tiers.
+# TYPE goon_tier_duration_seconds summary
+goon_tier_duration_seconds_sum{op="GetMulti",tier="memcache"} 2.5
+goon_tier_duration_seconds_count{op="GetMulti",tier="memcache"} 2
+# HELP goon_tier_duration_seconds_max Longest call to goon storage tiers.
+# TYPE goon_tier_duration_seconds_max gauge
+goon_tier_duration_seconds_max{op="GetMulti",tier="memcache"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected Prometheus output:\n%v", buf.String())
+	}
+
+	mc.Reset()
+	buf.Reset()
+	if err := mc.WritePrometheus(&buf); err != nil || buf.Len() != 0 {
+		t.Fatalf("Expected no output after reset, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestCountMultiErr(t *testing.T) {
+	g := FromContext(offlineContext())
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	g.countMultiErr("GetMulti", TierDatastore, MetricHit, 4, appengine.MultiError{
+		nil,
+		datastore.ErrNoSuchEntity,
+		&datastore.ErrFieldMismatch{},
+		errors.New("broken"),
+	})
+	g.countMultiErr("GetMulti", TierDatastore, MetricHit, 2, nil)
+	g.countMultiErr("GetMulti", TierDatastore, MetricHit, 2, errors.New("broken"))
+
+	if v := mc.Counter("GetMulti", TierDatastore, MetricHit); v != 4 {
+		t.Fatalf("Expected 4 hits, got %v", v)
+	}
+	if v := mc.Counter("GetMulti", TierDatastore, MetricMiss); v != 1 {
+		t.Fatalf("Expected 1 miss, got %v", v)
+	}
+	if v := mc.Counter("GetMulti", TierDatastore, MetricError); v != 2 {
+		t.Fatalf("Expected 2 errors, got %v", v)
+	}
+}
+
+func TestTierMetrics(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	if v := mc.Counter("PutMulti", TierDatastore, MetricSet); v != 2 {
+		t.Fatalf("Expected 2 datastore sets, got %v", v)
+	}
+
+	// First fetch goes all the way to the datastore
+	memcache.Flush(c)
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}}); !NotFound(err, 2) {
+		t.Fatalf("Expected third entity to be not found, got %v", err)
+	}
+	if v := mc.Counter("GetMulti", TierLocal, MetricMiss); v != 3 {
+		t.Fatalf("Expected 3 local misses, got %v", v)
+	}
+	if v := mc.Counter("GetMulti", TierDatastore, MetricHit); v != 2 {
+		t.Fatalf("Expected 2 datastore hits, got %v", v)
+	}
+	if v := mc.Counter("GetMulti", TierDatastore, MetricMiss); v != 1 {
+		t.Fatalf("Expected 1 datastore miss, got %v", v)
+	}
+	if v := mc.Counter("putMemcache", TierMemcache, MetricSet); v != 3 {
+		t.Fatalf("Expected 3 memcache sets, got %v", v)
+	}
+
+	// Second fetch is served from memcache
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if v := mc.Counter("GetMulti", TierMemcache, MetricHit); v != 2 {
+		t.Fatalf("Expected 2 memcache hits, got %v", v)
+	}
+
+	// Third fetch is served from the local cache
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+	if v := mc.Counter("GetMulti", TierLocal, MetricHit); v != 2 {
+		t.Fatalf("Expected 2 local hits, got %v", v)
+	}
+	if ts := mc.Timings("GetMulti", TierDatastore); ts.Count != 1 {
+		t.Fatalf("Expected 1 datastore call, got %v", ts.Count)
+	}
+}
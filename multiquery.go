@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// MultiQuery is a set of queries whose results are merged into one result,
+// e.g. the same query run for many ancestors or namespaces.
+type MultiQuery struct {
+	Queries []*datastore.Query
+	// Namespaces optionally holds the namespace of every query. An empty
+	// namespace means the namespace of the Goon, like for keys.
+	Namespaces []string
+	// Orders is the sort order of the merged results, as property names
+	// given to datastore.Query.Order, e.g. "-Date". Results that are equal
+	// by Orders are sorted by key. The queries should have the same orders,
+	// so that the results of Limit are the same as for a single query.
+	Orders []string
+	// Limit is the maximum number of merged results, or zero for no limit.
+	Limit int
+}
+
+// GetAllMultiQuery runs the queries of mq concurrently and merges their
+// results by mq.Orders, leaving out repeated keys. At most mq.Limit results
+// are appended to dst, with the same semantics and caching as GetAll,
+// and their keys are returned.
+//
+// Projection queries aren't supported, and keys-only queries can only be
+// merged by key. The queries must either all be keys-only or all not be.
+// Such unsupported MultiQuerys return an error wrapping ErrInvalidMultiQuery.
+func (g *Goon) GetAllMultiQuery(mq MultiQuery, dst interface{}) ([]*datastore.Key, error) {
+	return g.GetAllMultiQueryContext(g.Context, mq, dst)
+}
+
+// GetAllMultiQueryContext is like GetAllMultiQuery, but uses c instead of g.Context.
+func (g *Goon) GetAllMultiQueryContext(c context.Context, mq MultiQuery, dst interface{}) ([]*datastore.Key, error) {
+	if err := checkSliceDst(dst); err != nil {
+		return nil, err
+	}
+	if len(mq.Namespaces) > 0 && len(mq.Namespaces) != len(mq.Queries) {
+		return nil, fmt.Errorf("%w: expected %v namespaces, got %v", ErrInvalidMultiQuery, len(mq.Queries), len(mq.Namespaces))
+	}
+	c = g.callContext(c)
+	orders := make([]multiQueryOrder, 0, len(mq.Orders))
+	for _, o := range mq.Orders {
+		o = strings.TrimSpace(o)
+		mo := multiQueryOrder{name: strings.TrimSpace(strings.TrimPrefix(o, "-")), desc: strings.HasPrefix(o, "-")}
+		if mo.name == "" {
+			return nil, fmt.Errorf("%w: invalid order %q", ErrInvalidMultiQuery, o)
+		}
+		orders = append(orders, mo)
+	}
+
+	// Check the queries and give them the limit, which none of them can exceed
+	queries := make([]*datastore.Query, len(mq.Queries))
+	contexts := make([]context.Context, len(mq.Queries))
+	keysOnly := false
+	for i, q := range mq.Queries {
+		info := inspectQuery(q)
+		if info.projection {
+			return nil, fmt.Errorf("%w: projection queries aren't supported", ErrInvalidMultiQuery)
+		}
+		if i == 0 {
+			keysOnly = info.keysOnly
+		} else if info.keysOnly != keysOnly {
+			return nil, fmt.Errorf("%w: can't merge keys-only and other queries", ErrInvalidMultiQuery)
+		}
+		if mq.Limit > 0 && (info.limit < 0 || info.limit > mq.Limit) {
+			q = q.Limit(mq.Limit)
+		}
+		queries[i] = q
+		ns := ""
+		if len(mq.Namespaces) > 0 {
+			ns = mq.Namespaces[i]
+		}
+		var err error
+		if contexts[i], err = g.namespaceContext(c, ns); err != nil {
+			return nil, err
+		}
+	}
+	if keysOnly {
+		for _, o := range orders {
+			if o.name != keyPropertyName {
+				return nil, fmt.Errorf("%w: can't order keys-only results by %q", ErrInvalidMultiQuery, o.name)
+			}
+		}
+	}
+
+	// Run the queries
+	keys := make([][]*datastore.Key, len(queries))
+	propLists := make([][]datastore.PropertyList, len(queries))
+	errs := make([]error, len(queries))
+	var wg sync.WaitGroup
+	wg.Add(len(queries))
+	for i := range queries {
+		go func(i int) {
+			defer wg.Done()
+			keys[i], propLists[i], errs[i] = g.runQuery(contexts[i], "MultiQuery", queries[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Merge the results
+	var results []multiQueryResult
+	for i := range keys {
+		for j, k := range keys[i] {
+			r := multiQueryResult{key: k}
+			if !keysOnly {
+				r.props = propLists[i][j]
+			}
+			results = append(results, r)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return compareResults(orders, results[i], results[j]) < 0
+	})
+	seen := make(map[string]bool, len(results))
+	mergedKeys := make([]*datastore.Key, 0, len(results))
+	var mergedProps []datastore.PropertyList
+	for _, r := range results {
+		if mq.Limit > 0 && len(mergedKeys) == mq.Limit {
+			break
+		}
+		ek := r.key.Encode()
+		if seen[ek] {
+			continue
+		}
+		seen[ek] = true
+		mergedKeys = append(mergedKeys, r.key)
+		if !keysOnly {
+			mergedProps = append(mergedProps, r.props)
+		}
+	}
+	return g.loadAll(c, "MultiQuery", mergedKeys, mergedProps, false, dst)
+}
+
+// multiQueryOrder is a parsed MultiQuery.Orders element.
+type multiQueryOrder struct {
+	name string
+	desc bool
+}
+
+// multiQueryResult is a result of one of the queries of a MultiQuery.
+type multiQueryResult struct {
+	key   *datastore.Key
+	props datastore.PropertyList // nil for keys-only results
+}
+
+// compareResults compares a and b by orders and then by key, returning
+// a negative number if a sorts first, a positive one if b does, or zero.
+func compareResults(orders []multiQueryOrder, a, b multiQueryResult) int {
+	for _, o := range orders {
+		var c int
+		if o.name == keyPropertyName {
+			c = compareKeys(a.key, b.key)
+		} else {
+			c = compareValues(sortValue(a.props, o), sortValue(b.props, o))
+		}
+		if o.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareKeys(a.key, b.key)
+}
+
+// sortValue returns the value of props that the datastore sorts by for o.
+// Properties with multiple values sort by their smallest value in ascending
+// order, and by their largest value in descending order.
+func sortValue(props datastore.PropertyList, o multiQueryOrder) interface{} {
+	var v interface{}
+	found := false
+	for _, p := range props {
+		if p.Name != o.name {
+			continue
+		}
+		if c := compareValues(p.Value, v); !found || (o.desc && c > 0) || (!o.desc && c < 0) {
+			v, found = p.Value, true
+		}
+	}
+	return v
+}
+
+// valueTypeRank returns the position of the type of v
+// in the order of property value types used by the datastore.
+// Strings and byte strings are stored alike, so they share a rank.
+func valueTypeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
+	case bool:
+		return 2
+	case []byte, datastore.ByteString, string:
+		return 3
+	case float64:
+		return 4
+	case appengine.GeoPoint:
+		return 5
+	case *datastore.Key:
+		return 6
+	}
+	return 7
+}
+
+// compareValues compares the property values a and b like the datastore,
+// returning a negative number if a sorts first, a positive one if b does, or zero.
+func compareValues(a, b interface{}) int {
+	ra, rb := valueTypeRank(a), valueTypeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch av := a.(type) {
+	case int64, time.Time:
+		return compareInts(integerValue(a), integerValue(b))
+	case bool:
+		if bv := b.(bool); av == bv {
+			return 0
+		} else if bv {
+			return -1
+		}
+		return 1
+	case []byte, datastore.ByteString, string:
+		return bytes.Compare(bytesValue(a), bytesValue(b))
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+		return 0
+	case appengine.GeoPoint:
+		bv := b.(appengine.GeoPoint)
+		if av.Lat != bv.Lat {
+			return compareValues(av.Lat, bv.Lat)
+		}
+		return compareValues(av.Lng, bv.Lng)
+	case *datastore.Key:
+		return compareKeys(av, b.(*datastore.Key))
+	}
+	return 0
+}
+
+// integerValue returns v, which is an int64 or a time.Time, as an int64.
+// Times are stored as microseconds since the Unix epoch.
+func integerValue(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return t.Unix()*1e6 + int64(t.Nanosecond()/1e3)
+	}
+	return v.(int64)
+}
+
+// bytesValue returns v, which is a []byte, a datastore.ByteString
+// or a string, as a []byte.
+func bytesValue(v interface{}) []byte {
+	switch bv := v.(type) {
+	case datastore.ByteString:
+		return bv
+	case string:
+		return []byte(bv)
+	}
+	return v.([]byte)
+}
+
+// compareInts compares a and b, returning -1, 0 or 1.
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareKeys compares a and b like the datastore, by namespace and then by
+// their path from the root, with numeric ids before string ids.
+func compareKeys(a, b *datastore.Key) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if c := strings.Compare(a.Namespace(), b.Namespace()); c != 0 {
+		return c
+	}
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ka, kb := pa[i], pb[i]
+		if c := strings.Compare(ka.Kind(), kb.Kind()); c != 0 {
+			return c
+		}
+		if ka.StringID() == "" && kb.StringID() == "" {
+			if c := compareInts(ka.IntID(), kb.IntID()); c != 0 {
+				return c
+			}
+		} else if ka.StringID() == "" {
+			return -1
+		} else if kb.StringID() == "" {
+			return 1
+		} else if c := strings.Compare(ka.StringID(), kb.StringID()); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// keyPath returns the keys from the root ancestor of k to k itself.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		path = append(path, k)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
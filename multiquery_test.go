@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestCompareValues(t *testing.T) {
+	c := offlineContext()
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	parent := datastore.NewKey(c, "A", "", 1, nil)
+	// Every value sorts before the next one
+	ordered := []interface{}{
+		nil,
+		int64(-5),
+		when,
+		when.Add(time.Microsecond),
+		false,
+		true,
+		[]byte("a"),
+		"b",
+		datastore.ByteString("c"),
+		"d",
+		-1.5,
+		2.5,
+		appengine.GeoPoint{Lat: 1, Lng: 2},
+		appengine.GeoPoint{Lat: 1, Lng: 3},
+		datastore.NewKey(c, "A", "", 1, nil),
+		datastore.NewKey(c, "B", "", 1, parent),
+		datastore.NewKey(c, "A", "", 2, nil),
+		datastore.NewKey(c, "A", "a", 0, nil),
+		datastore.NewKey(c, "B", "", 1, datastore.NewKey(c, "A", "b", 0, nil)),
+		datastore.NewKey(c, "B", "", 1, nil),
+	}
+	for i := range ordered {
+		if c := compareValues(ordered[i], ordered[i]); c != 0 {
+			t.Fatalf("Expected %v to equal itself, got %v", ordered[i], c)
+		}
+		for j := i + 1; j < len(ordered); j++ {
+			if c := compareValues(ordered[i], ordered[j]); c >= 0 {
+				t.Fatalf("Expected %v to sort before %v, got %v", ordered[i], ordered[j], c)
+			}
+			if c := compareValues(ordered[j], ordered[i]); c <= 0 {
+				t.Fatalf("Expected %v to sort after %v, got %v", ordered[j], ordered[i], c)
+			}
+		}
+	}
+
+	// Strings and byte strings are compared by their bytes
+	for _, pair := range [][2]interface{}{
+		{"a", []byte("a")},
+		{datastore.ByteString("b"), "b"},
+		{[]byte("c"), datastore.ByteString("c")},
+	} {
+		if c := compareValues(pair[0], pair[1]); c != 0 {
+			t.Fatalf("Expected %v to equal %v, got %v", pair[0], pair[1], c)
+		}
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	c := offlineContext()
+	result := func(id int64, props ...datastore.Property) multiQueryResult {
+		return multiQueryResult{key: datastore.NewKey(c, "HasId", "", id, nil), props: props}
+	}
+	a := result(1, datastore.Property{Name: "Tags", Value: "x"}, datastore.Property{Name: "Tags", Value: "c"})
+	b := result(2, datastore.Property{Name: "Tags", Value: "b"}, datastore.Property{Name: "Tags", Value: "y"})
+	d := result(3, datastore.Property{Name: "Tags", Value: "b"})
+
+	// Multiple values sort by the smallest value ascending, the largest descending
+	asc := []multiQueryOrder{{name: "Tags"}}
+	if compareResults(asc, b, a) >= 0 || compareResults(asc, a, b) <= 0 {
+		t.Fatalf("Expected b to sort before a ascending")
+	}
+	desc := []multiQueryOrder{{name: "Tags", desc: true}}
+	if compareResults(desc, b, a) >= 0 {
+		t.Fatalf("Expected b to sort before a descending")
+	}
+	// Equal values sort by key
+	if compareResults(asc, b, d) >= 0 {
+		t.Fatalf("Expected b to sort before d")
+	}
+	if keyDesc := []multiQueryOrder{{name: keyPropertyName, desc: true}}; compareResults(keyDesc, d, b) >= 0 {
+		t.Fatalf("Expected d to sort before b by descending key")
+	}
+}
+
+func TestGetAllMultiQueryInvalid(t *testing.T) {
+	g := FromContext(offlineContext())
+	q := datastore.NewQuery("HasId")
+	for _, mq := range []MultiQuery{
+		{Queries: []*datastore.Query{q, q}, Namespaces: []string{"a"}},
+		{Queries: []*datastore.Query{q, q.Project("Name")}},
+		{Queries: []*datastore.Query{q, q.KeysOnly()}},
+		{Queries: []*datastore.Query{q.KeysOnly()}, Orders: []string{"Name"}},
+		{Queries: []*datastore.Query{q}, Orders: []string{"-"}},
+	} {
+		if _, err := g.GetAllMultiQuery(mq, &[]HasId{}); !errors.Is(err, ErrInvalidMultiQuery) {
+			t.Fatalf("Expected ErrInvalidMultiQuery for %+v, got %v", mq, err)
+		}
+	}
+	if _, err := g.GetAllMultiQuery(MultiQuery{Queries: []*datastore.Query{q}}, []HasId{}); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Expected ErrInvalidType for a non-pointer dst, got %v", err)
+	}
+}
+
+func TestLoadAllErrors(t *testing.T) {
+	g := FromContext(offlineContext())
+	keys := []*datastore.Key{datastore.NewKey(g.Context, "hasTextID", "bad", 0, nil)}
+	props := []datastore.PropertyList{{}}
+
+	// Like GetAll, no keys are returned when an entity can't be loaded
+	if keys, err := g.loadAll(g.Context, "GetAll", keys, props, false, &[]*hasTextID{}); keys != nil || !errors.Is(err, ErrInvalidKeyStruct) {
+		t.Fatalf("Expected no keys and ErrInvalidKeyStruct, got %v (%v)", keys, err)
+	}
+	// but they are when dst has the wrong element type
+	if got, err := g.loadAll(g.Context, "GetAll", keys, props, false, &[]string{}); len(got) != 1 || !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Expected the keys and ErrInvalidType, got %v (%v)", got, err)
+	}
+}
+
+type MultiQueryChild struct {
+	Id     int64          `datastore:"-" goon:"id"`
+	Parent *datastore.Key `datastore:"-" goon:"parent"`
+	Rank   int64
+}
+
+func TestGetAllMultiQuery(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	p1, p2 := datastore.NewKey(c, "Parent", "p1", 0, nil), datastore.NewKey(c, "Parent", "p2", 0, nil)
+	src := []*MultiQueryChild{
+		{Id: 1, Parent: p1, Rank: 5},
+		{Id: 2, Parent: p1, Rank: 2},
+		{Id: 1, Parent: p2, Rank: 4},
+		{Id: 2, Parent: p2, Rank: 1},
+		{Id: 3, Parent: p2, Rank: 3},
+	}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	g.FlushLocalCache()
+
+	q1 := datastore.NewQuery("MultiQueryChild").Ancestor(p1).Order("-Rank")
+	q2 := datastore.NewQuery("MultiQueryChild").Ancestor(p2).Order("-Rank")
+	var dst []*MultiQueryChild
+	keys, err := g.GetAllMultiQuery(MultiQuery{Queries: []*datastore.Query{q1, q2, q1}, Orders: []string{"-Rank"}, Limit: 4}, &dst)
+	if err != nil {
+		t.Fatalf("Unexpected error on GetAllMultiQuery: %v", err)
+	}
+	if len(keys) != 4 || len(dst) != 4 {
+		t.Fatalf("Expected 4 results, got %v %v", keys, dst)
+	}
+	for i, rank := range []int64{5, 4, 3, 2} {
+		if dst[i].Rank != rank || !dst[i].Parent.Equal(keys[i].Parent()) || dst[i].Id != keys[i].IntID() {
+			t.Fatalf("Unexpected result %v: %+v for %v", i, dst[i], keys[i])
+		}
+	}
+	if stats := g.CacheStats(); stats.Items != 4 {
+		t.Fatalf("Expected the 4 results to be cached, got %v", stats.Items)
+	}
+
+	// Keys-only queries merge by key
+	keys, err = g.GetAllMultiQuery(MultiQuery{Queries: []*datastore.Query{q2.KeysOnly(), q1.KeysOnly()}}, nil)
+	if err != nil || len(keys) != 5 || !keys[0].Parent().Equal(p1) || keys[4].IntID() != 3 {
+		t.Fatalf("Unexpected keys-only results %v (%v)", keys, err)
+	}
+}
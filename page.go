@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// PageTokenKey is the secret used to sign the page tokens returned by Page.
+// It must be set once during initialization, to the same value in every
+// deployment that must accept the tokens of the others. Page returns
+// ErrNoPageTokenKey while it is empty.
+var PageTokenKey []byte
+
+const (
+	pageTokenVersion = 1  // Increase this whenever the token format changes
+	pageTokenMACSize = 16 // Bytes of the HMAC-SHA256 kept in a token
+)
+
+// PageInfo describes a page of query results returned by Page.
+type PageInfo struct {
+	Keys    []*datastore.Key // Keys of the entities on the page
+	Next    string           // Token of the next page, empty if HasMore is false
+	HasMore bool             // Whether there are results after this page
+}
+
+// Page runs the query and appends at most pageSize entities to dst, which
+// must be a pointer to a slice of structs or struct pointers, or nil.
+// The entities are loaded like with Iterator.Next.
+//
+// The page starts at the beginning of the query if token is empty,
+// and otherwise right after the page whose PageInfo.Next it is. The tokens are
+// URL-safe and signed with PageTokenKey, and are only accepted for queries of
+// the same kind and namespace. Any limit or start cursor set on q is replaced,
+// and an offset set on q only applies to the first page.
+func (g *Goon) Page(q *datastore.Query, pageSize int, token string, dst interface{}) (*PageInfo, error) {
+	return g.PageContext(g.Context, q, pageSize, token, dst)
+}
+
+// PageContext is like Page, but uses c instead of g.Context.
+func (g *Goon) PageContext(c context.Context, q *datastore.Query, pageSize int, token string, dst interface{}) (*PageInfo, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("%w: expected a positive page size, got %v", ErrInvalidPageSize, pageSize)
+	}
+	if len(PageTokenKey) == 0 {
+		return nil, ErrNoPageTokenKey
+	}
+	var v, dstV reflect.Value
+	var elemType reflect.Type
+	elemTypeIsPtr := false
+	if dst != nil {
+		dstV = reflect.ValueOf(dst)
+		if dstV.Kind() != reflect.Ptr || dstV.Elem().Kind() != reflect.Slice {
+			return nil, &TypeError{Expected: "dst to be a pointer to a slice or nil", Got: dstV.Kind().String()}
+		}
+		dstV = dstV.Elem()
+		v = dstV
+		elemType = v.Type().Elem()
+		if elemType.Kind() == reflect.Ptr {
+			elemType = elemType.Elem()
+			elemTypeIsPtr = true
+		}
+		if elemType.Kind() != reflect.Struct {
+			return nil, &TypeError{Expected: "struct", Got: elemType.Kind().String()}
+		}
+	}
+
+	nc, err := g.namespaceContext(c, "")
+	if err != nil {
+		return nil, err
+	}
+	scope := pageTokenScope(contextNamespace(nc), inspectQuery(q).kind)
+	if token != "" {
+		cursor, err := decodePageToken(token, scope)
+		if err != nil {
+			return nil, err
+		}
+		// The cursor is already past the offset of the first page
+		q = q.Start(cursor).Offset(0)
+	}
+	// One extra result tells whether there are more pages
+	t := g.RunContext(c, q.Limit(pageSize+1))
+
+	page := &PageInfo{}
+	var rerr error
+	for {
+		if len(page.Keys) == pageSize {
+			cursor, err := t.Cursor()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := t.Next(nil); err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			page.Next = encodePageToken(cursor, scope)
+			page.HasMore = true
+			break
+		}
+		var e reflect.Value
+		var k *datastore.Key
+		var err error
+		if dst == nil {
+			k, err = t.Next(nil)
+		} else {
+			e = reflect.New(elemType)
+			k, err = t.Next(e.Interface())
+		}
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			if !errFieldMismatch(err) {
+				return nil, err
+			}
+			if rerr == nil {
+				rerr = err
+			}
+		}
+		page.Keys = append(page.Keys, k)
+		if dst != nil {
+			if !elemTypeIsPtr {
+				e = e.Elem()
+			}
+			v = reflect.Append(v, e)
+		}
+	}
+	if dst != nil {
+		dstV.Set(v)
+	}
+	return page, rerr
+}
+
+// pageTokenScope returns what a page token is bound to, so that the tokens
+// of one kind can't be used to page through another.
+func pageTokenScope(ns, kind string) string {
+	return ns + ":" + kind
+}
+
+// pageTokenMAC returns the MAC of a page token with the given payload.
+func pageTokenMAC(payload []byte, scope string) []byte {
+	mac := hmac.New(sha256.New, PageTokenKey)
+	mac.Write([]byte{pageTokenVersion})
+	mac.Write([]byte(scope))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)[:pageTokenMACSize]
+}
+
+// encodePageToken returns the page token of cursor.
+// The format is the version byte, the MAC and the cursor, base64 encoded.
+func encodePageToken(cursor datastore.Cursor, scope string) string {
+	payload := []byte(cursor.String())
+	data := make([]byte, 0, 1+pageTokenMACSize+len(payload))
+	data = append(data, pageTokenVersion)
+	data = append(data, pageTokenMAC(payload, scope)...)
+	data = append(data, payload...)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken returns the cursor of token,
+// or ErrInvalidPageToken if it wasn't created by encodePageToken with scope.
+func decodePageToken(token, scope string) (datastore.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < 1+pageTokenMACSize || data[0] != pageTokenVersion {
+		return datastore.Cursor{}, ErrInvalidPageToken
+	}
+	mac, payload := data[1:1+pageTokenMACSize], data[1+pageTokenMACSize:]
+	if !hmac.Equal(mac, pageTokenMAC(payload, scope)) {
+		return datastore.Cursor{}, ErrInvalidPageToken
+	}
+	cursor, err := datastore.DecodeCursor(string(payload))
+	if err != nil {
+		return datastore.Cursor{}, ErrInvalidPageToken
+	}
+	return cursor, nil
+}
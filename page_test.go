@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPageToken(t *testing.T) {
+	defer func(key []byte) { PageTokenKey = key }(PageTokenKey)
+	PageTokenKey = []byte("secret")
+
+	cursor, err := datastore.DecodeCursor("GgIIAQ")
+	if err != nil {
+		t.Fatalf("Unexpected error decoding cursor: %v", err)
+	}
+	scope := pageTokenScope("", "HasId")
+	token := encodePageToken(cursor, scope)
+	if strings.ContainsAny(token, "+/=") {
+		t.Fatalf("Expected a URL-safe token, got %v", token)
+	}
+	if decoded, err := decodePageToken(token, scope); err != nil || decoded.String() != cursor.String() {
+		t.Fatalf("Expected %v, got %v (%v)", cursor, decoded, err)
+	}
+
+	// Tokens are stable as long as the key is
+	if again := encodePageToken(cursor, scope); again != token {
+		t.Fatalf("Expected equal tokens, got %v and %v", token, again)
+	}
+
+	// Tampered tokens and tokens of other scopes or keys are rejected
+	tampered := []byte(token)
+	tampered[len(tampered)-1] ^= 1
+	for _, tc := range []struct {
+		token, scope string
+	}{
+		{string(tampered), scope},
+		{"!" + token, scope},
+		{token[:10], scope},
+		{token, pageTokenScope("", "Other")},
+		{token, pageTokenScope("ns", "HasId")},
+	} {
+		if _, err := decodePageToken(tc.token, tc.scope); err != ErrInvalidPageToken {
+			t.Fatalf("Expected ErrInvalidPageToken for %v in %v, got %v", tc.token, tc.scope, err)
+		}
+	}
+	PageTokenKey = []byte("other")
+	if _, err := decodePageToken(token, scope); err != ErrInvalidPageToken {
+		t.Fatalf("Expected ErrInvalidPageToken with another key, got %v", err)
+	}
+}
+
+func TestPageInvalid(t *testing.T) {
+	defer func(key []byte) { PageTokenKey = key }(PageTokenKey)
+	g := FromContext(offlineContext())
+	q := datastore.NewQuery("HasId")
+	var dst []HasId
+	PageTokenKey = nil
+	if _, err := g.Page(q, 10, "", &dst); err != ErrNoPageTokenKey {
+		t.Fatalf("Expected ErrNoPageTokenKey, got %v", err)
+	}
+	PageTokenKey = []byte("secret")
+	if _, err := g.Page(q, 0, "", &dst); !errors.Is(err, ErrInvalidPageSize) {
+		t.Fatalf("Expected ErrInvalidPageSize for a zero page size, got %v", err)
+	}
+	if _, err := g.Page(q, 10, "", dst); err == nil {
+		t.Fatalf("Expected an error for a non-pointer dst")
+	}
+	if _, err := g.Page(q, 10, "garbage", &dst); err != ErrInvalidPageToken {
+		t.Fatalf("Expected ErrInvalidPageToken, got %v", err)
+	}
+}
+
+func TestPage(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	defer func(key []byte) { PageTokenKey = key }(PageTokenKey)
+	PageTokenKey = []byte("secret")
+
+	src := []*HasId{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}, {Id: 3, Name: "c"}, {Id: 4, Name: "d"}, {Id: 5, Name: "e"}}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}, {Id: 5}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+
+	q := datastore.NewQuery("HasId").Order("Name")
+	var names []string
+	var pages int
+	token := ""
+	for {
+		var dst []*HasId
+		page, err := g.Page(q, 2, token, &dst)
+		if err != nil {
+			t.Fatalf("Unexpected error on Page: %v", err)
+		}
+		if len(page.Keys) != len(dst) {
+			t.Fatalf("Expected %v keys, got %v", len(dst), len(page.Keys))
+		}
+		for i, hi := range dst {
+			if hi.Id != page.Keys[i].IntID() {
+				t.Fatalf("Expected id %v, got %v", page.Keys[i].IntID(), hi.Id)
+			}
+			names = append(names, hi.Name)
+		}
+		pages++
+		if !page.HasMore {
+			if page.Next != "" {
+				t.Fatalf("Expected no next token on the last page, got %v", page.Next)
+			}
+			break
+		}
+		token = page.Next
+	}
+	if pages != 3 || strings.Join(names, "") != "abcde" {
+		t.Fatalf("Unexpected pages %v with %v", pages, names)
+	}
+
+	// An offset only skips results on the first page
+	var first, second []*HasId
+	page, err := g.Page(q.Offset(1), 2, "", &first)
+	if err != nil || len(first) != 2 || first[0].Name != "b" {
+		t.Fatalf("Unexpected first page %+v %+v (%v)", page, first, err)
+	}
+	if _, err := g.Page(q.Offset(1), 2, page.Next, &second); err != nil || len(second) != 2 || second[0].Name != "d" {
+		t.Fatalf("Unexpected second page %+v (%v)", second, err)
+	}
+
+	// A full last page doesn't claim there are more results
+	var dst []HasId
+	page, err = g.Page(q.KeysOnly(), 5, "", &dst)
+	if err != nil || page.HasMore || len(dst) != 5 || dst[4].Id != 5 || dst[4].Name != "" {
+		t.Fatalf("Unexpected keys-only page %+v %+v (%v)", page, dst, err)
+	}
+
+	// Tokens are only accepted for the same kind
+	page, err = g.Page(q, 2, "", nil)
+	if err != nil || !page.HasMore {
+		t.Fatalf("Unexpected page %+v (%v)", page, err)
+	}
+	if _, err := g.Page(datastore.NewQuery("Other"), 2, page.Next, nil); err != ErrInvalidPageToken {
+		t.Fatalf("Expected ErrInvalidPageToken, got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"container/list"
+)
+
+// EvictionPolicy decides which value the local memory cache evicts when the
+// cache grows beyond its size limit. The cache calls the methods while holding
+// its own lock, so implementations don't need to be safe for concurrent use.
+// Every key given to a policy is the exact string that the cache itself holds,
+// so storing it doesn't cost additional memory for the key contents.
+type EvictionPolicy interface {
+	// Add starts tracking a key that was just added to the cache.
+	Add(key string)
+	// Access marks a tracked key as read or overwritten.
+	Access(key string)
+	// Remove stops tracking a key that was deleted from the cache.
+	Remove(key string)
+	// Evict chooses a tracked key to be evicted and stops tracking it.
+	// Returns false if there are no tracked keys.
+	Evict() (key string, ok bool)
+	// Walk calls fn for every tracked key, roughly ordered
+	// from the key least likely to be evicted to the most likely.
+	Walk(fn func(key string))
+	// Reset stops tracking all keys.
+	Reset()
+}
+
+// lruPolicy evicts the least recently accessed key.
+type lruPolicy struct {
+	elements map[string]*list.Element // access via key
+	accessed list.List                // most recently accessed in front
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently used key.
+// This is the default policy of the local memory cache.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{elements: map[string]*list.Element{}}
+}
+
+func (p *lruPolicy) Add(key string) {
+	p.elements[key] = p.accessed.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.accessed.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.elements[key]; ok {
+		delete(p.elements, key)
+		p.accessed.Remove(e)
+	}
+}
+
+func (p *lruPolicy) Evict() (string, bool) {
+	e := p.accessed.Back()
+	if e == nil {
+		return "", false
+	}
+	key := e.Value.(string)
+	delete(p.elements, key)
+	p.accessed.Remove(e)
+	return key, true
+}
+
+func (p *lruPolicy) Walk(fn func(key string)) {
+	for e := p.accessed.Front(); e != nil; e = e.Next() {
+		fn(e.Value.(string))
+	}
+}
+
+func (p *lruPolicy) Reset() {
+	p.elements = map[string]*list.Element{}
+	p.accessed.Init()
+}
+
+// The share of tracked keys that the 2Q policy keeps in its probation queue,
+// and the number of evicted keys it remembers relative to the tracked keys.
+const (
+	twoQProbationRatio = 0.25
+	twoQGhostRatio     = 0.5
+)
+
+// twoQEntry is a key tracked by twoQPolicy.
+type twoQEntry struct {
+	key       string
+	protected bool // Whether the key is in the protected queue
+}
+
+// twoQPolicy is the simplified 2Q algorithm by Johnson and Shasha.
+// New keys enter a FIFO probation queue and are promoted to the protected
+// LRU queue only when accessed again. Keys evicted from probation are
+// remembered as ghosts, so that if they come back they are protected right
+// away. A scan of keys that are used only once never leaves probation,
+// so it can't flush the protected working set.
+type twoQPolicy struct {
+	elements  map[string]*list.Element // tracked keys, access via key
+	probation list.List                // FIFO of *twoQEntry, newest in front
+	protected list.List                // LRU of *twoQEntry, most recently accessed in front
+	ghosts    map[string]*list.Element // recently evicted probation keys, access via key
+	ghostList list.List                // FIFO of ghost keys, newest in front
+	ghostSize int                      // memory held by the ghosts, see extraSize
+}
+
+// New2QPolicy returns a scan-resistant policy based on the 2Q algorithm.
+// Keys that are accessed only once, e.g. during a large GetAll, are evicted
+// before keys that have been accessed repeatedly.
+func New2QPolicy() EvictionPolicy {
+	return &twoQPolicy{elements: map[string]*list.Element{}, ghosts: map[string]*list.Element{}}
+}
+
+func (p *twoQPolicy) Add(key string) {
+	if g, ok := p.ghosts[key]; ok {
+		// The key was evicted too early the last time, so protect it now
+		p.removeGhost(g)
+		p.elements[key] = p.protected.PushFront(&twoQEntry{key: key, protected: true})
+		return
+	}
+	p.elements[key] = p.probation.PushFront(&twoQEntry{key: key})
+}
+
+func (p *twoQPolicy) Access(key string) {
+	e, ok := p.elements[key]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*twoQEntry)
+	if entry.protected {
+		p.protected.MoveToFront(e)
+		return
+	}
+	p.probation.Remove(e)
+	entry.protected = true
+	p.elements[key] = p.protected.PushFront(entry)
+}
+
+func (p *twoQPolicy) Remove(key string) {
+	if e, ok := p.elements[key]; ok {
+		delete(p.elements, key)
+		p.removeElement(e)
+	}
+}
+
+// removeElement removes e from whichever queue holds it.
+func (p *twoQPolicy) removeElement(e *list.Element) {
+	if e.Value.(*twoQEntry).protected {
+		p.protected.Remove(e)
+	} else {
+		p.probation.Remove(e)
+	}
+}
+
+func (p *twoQPolicy) Evict() (string, bool) {
+	total := len(p.elements)
+	if total == 0 {
+		return "", false
+	}
+	var e *list.Element
+	if p.probation.Len() > 0 && (float64(p.probation.Len()) > twoQProbationRatio*float64(total) || p.protected.Len() == 0) {
+		e = p.probation.Back()
+	} else {
+		e = p.protected.Back()
+	}
+	entry := e.Value.(*twoQEntry)
+	delete(p.elements, entry.key)
+	p.removeElement(e)
+	if !entry.protected {
+		p.addGhost(entry.key)
+	}
+	return entry.key, true
+}
+
+// addGhost remembers an evicted key, forgetting the oldest ghosts
+// once there are more of them than allowed by twoQGhostRatio.
+func (p *twoQPolicy) addGhost(key string) {
+	p.ghosts[key] = p.ghostList.PushFront(key)
+	p.ghostSize += ghostOverhead + len(key)
+	limit := int(twoQGhostRatio*float64(len(p.elements))) + 1
+	for p.ghostList.Len() > limit {
+		p.removeGhost(p.ghostList.Back())
+	}
+}
+
+// removeGhost forgets the evicted key of g.
+func (p *twoQPolicy) removeGhost(g *list.Element) {
+	key := g.Value.(string)
+	delete(p.ghosts, key)
+	p.ghostList.Remove(g)
+	p.ghostSize -= ghostOverhead + len(key)
+}
+
+// extraSize returns the memory held by the ghosts, which keep the keys
+// alive after the cache has evicted their values.
+func (p *twoQPolicy) extraSize() int {
+	return p.ghostSize
+}
+
+func (p *twoQPolicy) Walk(fn func(key string)) {
+	for e := p.protected.Front(); e != nil; e = e.Next() {
+		fn(e.Value.(*twoQEntry).key)
+	}
+	for e := p.probation.Front(); e != nil; e = e.Next() {
+		fn(e.Value.(*twoQEntry).key)
+	}
+}
+
+func (p *twoQPolicy) Reset() {
+	p.elements = map[string]*list.Element{}
+	p.probation.Init()
+	p.protected.Init()
+	p.ghosts = map[string]*list.Element{}
+	p.ghostList.Init()
+	p.ghostSize = 0
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// accessTrace is a sequence of cache keys as they were requested.
+type accessTrace []string
+
+// hotSetTrace generates a synthetic access trace; there are no recorded
+// production traces in this repository. It models a typical request mix:
+// a hot set of hotKeys entities, such as users and settings, is fetched with
+// Get over and over with a Zipf distribution, and every scanEvery accesses
+// a GetAll style scan of scanSize never repeated keys is mixed in, like
+// a report or export. The seed is fixed, so the trace is the same on every run.
+func hotSetTrace(accesses, hotKeys, scanEvery, scanSize int) accessTrace {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, uint64(hotKeys-1))
+	trace := make(accessTrace, 0, accesses)
+	scans := 0
+	for i := 0; i < accesses; i++ {
+		if scanEvery > 0 && i > 0 && i%scanEvery == 0 {
+			for j := 0; j < scanSize; j++ {
+				trace = append(trace, fmt.Sprintf("scan-%d-%d", scans, j))
+			}
+			scans++
+		}
+		trace = append(trace, fmt.Sprintf("hot-%d", zipf.Uint64()))
+	}
+	return trace
+}
+
+// replay requests every key of the trace from c, and on a miss sets the key
+// the way GetMulti does after fetching it from a lower tier.
+// Returns the resulting hit ratio.
+func (trace accessTrace) replay(c *cache, valueSize int) float64 {
+	hits := 0
+	for _, key := range trace {
+		if c.Get(key) != nil {
+			hits++
+		} else {
+			c.Set(&cacheItem{key: key, value: make([]byte, valueSize)})
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+// itemsLimit returns a cache limit that fits n items with values of valueSize.
+func itemsLimit(n, valueSize int) int {
+	return n * (cachedValueOverhead + len("hot-000") + valueSize)
+}
+
+func TestPolicyHitRatio(t *testing.T) {
+	const valueSize = 100
+	limit := itemsLimit(200, valueSize)
+
+	// Without scans 2Q must keep up with LRU
+	trace := hotSetTrace(20000, 500, 0, 0)
+	lru := trace.replay(newCacheWithPolicy(limit, NewLRUPolicy()), valueSize)
+	twoQ := trace.replay(newCacheWithPolicy(limit, New2QPolicy()), valueSize)
+	if lru < 0.5 {
+		t.Fatalf("Expected LRU hit ratio of at least 0.5, got %v", lru)
+	}
+	if twoQ < lru-0.05 {
+		t.Fatalf("Expected 2Q hit ratio close to LRU %v, got %v", lru, twoQ)
+	}
+
+	// Scans flush the hot set from LRU, but not from 2Q
+	trace = hotSetTrace(20000, 500, 1000, 400)
+	lru = trace.replay(newCacheWithPolicy(limit, NewLRUPolicy()), valueSize)
+	twoQ = trace.replay(newCacheWithPolicy(limit, New2QPolicy()), valueSize)
+	t.Logf("Hit ratio with scans: LRU %.3f, 2Q %.3f", lru, twoQ)
+	if twoQ < lru+0.05 {
+		t.Fatalf("Expected 2Q hit ratio to beat LRU %v by a clear margin, got %v", lru, twoQ)
+	}
+}
+
+func TestTwoQPolicy(t *testing.T) {
+	p := New2QPolicy()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Add(key)
+	}
+	// a is accessed again, so it is protected and evicted last
+	p.Access("a")
+	var walked []string
+	p.Walk(func(key string) { walked = append(walked, key) })
+	if fmt.Sprint(walked) != "[a d c b]" {
+		t.Fatalf("Unexpected walk order: %v", walked)
+	}
+	for _, expected := range []string{"b", "c", "d", "a"} {
+		if key, ok := p.Evict(); !ok || key != expected {
+			t.Fatalf("Expected to evict %v, got %v (%v)", expected, key, ok)
+		}
+	}
+	if key, ok := p.Evict(); ok {
+		t.Fatalf("Expected nothing to evict, got %v", key)
+	}
+
+	// A recently evicted key is protected when it comes back
+	p.Add("d")
+	p.Add("e")
+	p.Add("f")
+	for _, expected := range []string{"e", "f", "d"} {
+		if key, ok := p.Evict(); !ok || key != expected {
+			t.Fatalf("Expected to evict %v, got %v (%v)", expected, key, ok)
+		}
+	}
+
+	p.Add("g")
+	p.Remove("g")
+	p.Add("h")
+	p.Reset()
+	if key, ok := p.Evict(); ok {
+		t.Fatalf("Expected nothing to evict after reset, got %v", key)
+	}
+}
+
+func TestTwoQGhostSize(t *testing.T) {
+	const valueSize = 100
+	limit := itemsLimit(20, valueSize)
+	c := newCacheWithPolicy(limit, New2QPolicy())
+	for i := 0; i < 100; i++ {
+		c.Set(&cacheItem{key: fmt.Sprintf("key-%03d", i), value: make([]byte, valueSize)})
+	}
+	p := c.policy.(*twoQPolicy)
+	if p.ghostList.Len() == 0 || p.extraSize() != p.ghostList.Len()*(ghostOverhead+len("key-000")) {
+		t.Fatalf("Expected the ghosts to be accounted for, got %v for %v ghosts", p.extraSize(), p.ghostList.Len())
+	}
+	// The ghosts count against the limit
+	stats := c.Stats()
+	if stats.Size != c.size+p.extraSize() || stats.Size > limit {
+		t.Fatalf("Expected a size of at most %v including the ghosts, got %+v", limit, stats)
+	}
+	c.Flush()
+	if p.extraSize() != 0 {
+		t.Fatalf("Expected no ghost size after a flush, got %v", p.extraSize())
+	}
+}
+
+func TestConfigureLocalCache(t *testing.T) {
+	g := FromContext(offlineContext())
+	g.cache.Set(&cacheItem{key: "foo", value: []byte{1}})
+
+	g.ConfigureLocalCache(LocalCacheOptions{Limit: 1 << 10, Policy: New2QPolicy})
+	if stats := g.CacheStats(); stats.Items != 0 || stats.Limit != 1<<10 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if _, ok := g.cache.(*cache).policy.(*twoQPolicy); !ok {
+		t.Fatalf("Expected 2Q policy, got %T", g.cache.(*cache).policy)
+	}
+
+	g.ConfigureLocalCache(LocalCacheOptions{})
+	if stats := g.CacheStats(); stats.Limit != defaultCacheLimit {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if _, ok := g.cache.(*cache).policy.(*lruPolicy); !ok {
+		t.Fatalf("Expected LRU policy, got %T", g.cache.(*cache).policy)
+	}
+}
+
+func benchmarkPolicy(b *testing.B, policy func() EvictionPolicy, trace accessTrace) {
+	const valueSize = 100
+	c := newCacheWithPolicy(itemsLimit(200, valueSize), policy())
+	items := make([]*cacheItem, len(trace))
+	for i, key := range trace {
+		items[i] = &cacheItem{key: key, value: make([]byte, valueSize)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(trace)
+		if c.Get(trace[j]) == nil {
+			c.Set(items[j])
+		}
+	}
+}
+
+func BenchmarkPolicyLRU(b *testing.B) {
+	benchmarkPolicy(b, NewLRUPolicy, hotSetTrace(20000, 500, 1000, 400))
+}
+
+func BenchmarkPolicy2Q(b *testing.B) {
+	benchmarkPolicy(b, New2QPolicy, hotSetTrace(20000, 500, 1000, 400))
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// RunPrefetch runs the query like Run, but the returned Iterator reads
+// the results in batches of batchSize. While one batch is being consumed,
+// the next one is already fetched in a goroutine, and every batch is put
+// into the local memory cache with a single SetMulti.
+//
+// The results can be read one at a time with Next, or a batch at a time
+// with NextBatch. The query is started by the first call of Next, NextBatch
+// or Cursor. The Iterator must be closed with Close once it's no longer
+// needed, as the goroutine isn't otherwise stopped before the query ends:
+// the contexts of first generation App Engine runtimes are never done.
+func (g *Goon) RunPrefetch(q *datastore.Query, batchSize int) *Iterator {
+	return g.RunPrefetchContext(g.Context, q, batchSize)
+}
+
+// RunPrefetchContext is like RunPrefetch, but uses c instead of g.Context.
+// The context applies to the whole lifetime of the returned Iterator.
+func (g *Goon) RunPrefetchContext(c context.Context, q *datastore.Query, batchSize int) *Iterator {
+	if batchSize <= 0 {
+		return &Iterator{g: g, err: fmt.Errorf("goon: Expected a positive batch size, got %v", batchSize)}
+	}
+	c = g.callContext(c)
+	c, err := g.namespaceContext(c, "")
+	if err != nil {
+		return &Iterator{g: g, err: err}
+	}
+	info := inspectQuery(q)
+	p := &prefetcher{
+		g:           g,
+		c:           c,
+		q:           q,
+		projection:  info.projection,
+		batchSize:   batchSize,
+		updateCache: !g.inTransaction && !info.keysOnly && !info.projection,
+		batches:     make(chan *prefetchBatch, 1),
+		stop:        make(chan struct{}),
+	}
+	return &Iterator{g: g, p: p, projection: info.projection}
+}
+
+// NextBatch appends the entities of the next batch of results to dst,
+// which must be a pointer to a slice of structs or struct pointers,
+// and returns their keys. If Next was called in the middle of a batch,
+// then only the rest of that batch is appended. When there are no more
+// results, datastore.Done is returned as the error. The entities are loaded
+// like with Next, except that the first field mismatch error is returned
+// after loading the whole batch.
+//
+// NextBatch is only supported by iterators returned by RunPrefetch.
+func (t *Iterator) NextBatch(dst interface{}) ([]*datastore.Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.p == nil {
+		return nil, errors.New("goon: NextBatch requires an Iterator returned by RunPrefetch")
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, &TypeError{Expected: "dst to be a pointer to a slice", Got: v.Kind().String()}
+	}
+	dstV := v.Elem()
+	elemType := dstV.Type().Elem()
+	elemTypeIsPtr := false
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+		elemTypeIsPtr = true
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, &TypeError{Expected: "struct", Got: elemType.Kind().String()}
+	}
+	return t.p.nextBatch(dstV, elemType, elemTypeIsPtr)
+}
+
+// Close stops the prefetching of an Iterator returned by RunPrefetch, and
+// waits for the goroutine to exit, which may take until a batch that is being
+// fetched arrives. Next and NextBatch then return datastore.Done. Close
+// always returns nil, and does nothing for other iterators.
+func (t *Iterator) Close() error {
+	if t.p != nil {
+		t.p.close()
+	}
+	return nil
+}
+
+// forEachBatchSize is the batch size of the iterator used by ForEach.
+const forEachBatchSize = 100
+
+// ForEach runs the query and calls fn for every result, streaming the
+// results in batches so that memory use doesn't grow with their number.
+// Every batch is put into the local memory cache, like with RunPrefetch.
+//
+// Before fn is called, the entity is loaded into dst, which must be
+// a pointer to a struct, or nil to only get the keys. The same dst is reset
+// and reused for every result, so fn must copy it to keep it. The cursor
+// function given to fn returns the position right after the current result,
+// from which the query can be resumed with datastore.Query.Start. Calling it
+// in the middle of a batch costs an extra small query, so it's best called
+// only when a checkpoint is actually saved.
+//
+// If fn returns ErrStopIteration, or an error wrapping it, then ForEach
+// stops as if the results had ended, and if fn returns any other error,
+// then ForEach stops and returns it. Field mismatch errors don't stop
+// ForEach: when the results end, or fn stops it with ErrStopIteration,
+// the first field mismatch error is returned, and nil if there was none.
+func (g *Goon) ForEach(q *datastore.Query, dst interface{}, fn func(key *datastore.Key, cursor func() (datastore.Cursor, error)) error) error {
+	return g.ForEachContext(g.Context, q, dst, fn)
+}
+
+// ForEachContext is like ForEach, but uses c instead of g.Context.
+func (g *Goon) ForEachContext(c context.Context, q *datastore.Query, dst interface{}, fn func(key *datastore.Key, cursor func() (datastore.Cursor, error)) error) error {
+	if dst != nil {
+		if v := reflect.ValueOf(dst); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return &TypeError{Expected: "dst to be a pointer to a struct or nil", Got: v.Kind().String()}
+		}
+	}
+	t := g.RunPrefetchContext(c, q, forEachBatchSize)
+	defer t.Close()
+	return t.forEach(dst, fn)
+}
+
+// forEach implements ForEach with the results of t.
+func (t *Iterator) forEach(dst interface{}, fn func(key *datastore.Key, cursor func() (datastore.Cursor, error)) error) error {
+	var v reflect.Value
+	if dst != nil {
+		v = reflect.ValueOf(dst).Elem()
+	}
+	var rerr error
+	for {
+		if dst != nil {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		k, err := t.Next(dst)
+		if err == datastore.Done {
+			return rerr
+		} else if err != nil {
+			if !errFieldMismatch(err) {
+				return err
+			}
+			if rerr == nil {
+				rerr = err
+			}
+		}
+		if err := fn(k, t.Cursor); errors.Is(err, ErrStopIteration) {
+			return rerr
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// prefetchBatch is a batch of query results read by prefetcher.fetch.
+type prefetchBatch struct {
+	keys   []*datastore.Key
+	props  []datastore.PropertyList // nil elements for keys-only results
+	cursor datastore.Cursor         // position after the last result of the batch
+	err    error                    // error that ended the query after this batch, e.g. datastore.Done
+}
+
+// prefetcher reads the results of a query in a goroutine,
+// one batch ahead of what the Iterator has consumed.
+type prefetcher struct {
+	g           *Goon
+	c           context.Context
+	q           *datastore.Query
+	projection  bool
+	batchSize   int
+	updateCache bool // whether fetched entities are put into the local memory cache
+
+	started   bool                // whether fetch was started
+	batches   chan *prefetchBatch // closed when fetch returns
+	stop      chan struct{}       // closed by close
+	closeOnce sync.Once
+
+	cur   *prefetchBatch   // the batch being consumed
+	pos   int              // index of the next result in cur
+	start datastore.Cursor // position before the first result of cur
+	err   error            // final error, returned once everything is consumed
+}
+
+// fetch runs the query and sends its results to p.batches in batches of
+// p.batchSize, until the query ends, p is closed or its context is done.
+// The results are put into the local memory cache before being sent,
+// if p.updateCache is true.
+func (p *prefetcher) fetch() {
+	defer close(p.batches)
+	g := p.g
+	i := p.q.Run(p.c)
+	batchSize := p.batchSize
+	// An empty batch carries the start position
+	cursor, err := i.Cursor()
+	if !p.send(&prefetchBatch{cursor: cursor, err: err}) || err != nil {
+		return
+	}
+	for {
+		b := &prefetchBatch{
+			keys:  make([]*datastore.Key, 0, batchSize),
+			props: make([]datastore.PropertyList, 0, batchSize),
+		}
+		start := time.Now()
+		for len(b.keys) < batchSize {
+			var props datastore.PropertyList
+			k, err := i.Next(&props)
+			if err != nil {
+				b.err = err
+				break
+			}
+			b.keys = append(b.keys, k)
+			b.props = append(b.props, props)
+		}
+		if b.err == nil || b.err == datastore.Done {
+			if cursor, err := i.Cursor(); err != nil {
+				b.err = err
+			} else {
+				b.cursor = cursor
+			}
+		}
+		g.timing("Next", TierDatastore, start)
+		g.count("Next", TierDatastore, MetricResult, len(b.keys))
+		if b.err != nil && b.err != datastore.Done {
+			g.countMultiErr("Next", TierDatastore, MetricResult, 0, b.err)
+		}
+
+		if p.updateCache {
+			p.cacheBatch(b)
+		}
+		if !p.send(b) || b.err != nil {
+			return
+		}
+	}
+}
+
+// cacheBatch puts the entities of b into the local memory cache.
+func (p *prefetcher) cacheBatch(b *prefetchBatch) {
+	g := p.g
+	toCache := make([]*cacheItem, 0, len(b.keys))
+	cacheKeys := make([]*datastore.Key, 0, len(b.keys))
+	for i, k := range b.keys {
+		if b.props[i] == nil || g.localCacheFor(k.Kind()) == nil {
+			continue
+		}
+		data, err := serializeProperties(b.props[i], true)
+		if err != nil {
+			g.error(p.c, &LogEntry{Op: "Next", Kind: k.Kind(), KeyCount: 1, Tier: TierLocal, Err: err})
+			continue
+		}
+		toCache = append(toCache, &cacheItem{key: cacheKey(k), value: data})
+		cacheKeys = append(cacheKeys, k)
+	}
+	if len(toCache) > 0 {
+		g.count("Next", TierLocal, MetricSet, g.localSetMulti(cacheKeys, toCache))
+	}
+}
+
+// send sends b to p.batches, and reports whether it was sent
+// before p was closed or its context was done.
+func (p *prefetcher) send(b *prefetchBatch) bool {
+	select {
+	case p.batches <- b:
+		return true
+	case <-p.stop:
+	case <-p.c.Done():
+	}
+	return false
+}
+
+// close stops fetch, waits for it to return,
+// and makes the iterator return datastore.Done.
+func (p *prefetcher) close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		if p.started {
+			for range p.batches {
+			}
+		}
+		if p.err == nil {
+			p.err = datastore.Done
+		}
+		p.cur = nil
+	})
+}
+
+// advance makes sure that p.cur has an unconsumed result,
+// and reports whether it does. The first call starts fetch.
+func (p *prefetcher) advance() bool {
+	if !p.started && p.err == nil {
+		p.started = true
+		go p.fetch()
+	}
+	for p.cur == nil || p.pos == len(p.cur.keys) {
+		if p.cur != nil {
+			p.start = p.cur.cursor
+			if p.cur.err != nil {
+				p.err, p.cur = p.cur.err, nil
+			}
+		}
+		if p.err != nil {
+			return false
+		}
+		b, ok := <-p.batches
+		if !ok {
+			// Closed without a final error, which only happens when the context is done
+			p.err = p.c.Err()
+			if p.err == nil {
+				p.err = datastore.Done
+			}
+			return false
+		}
+		p.cur, p.pos = b, 0
+	}
+	return true
+}
+
+// next implements Iterator.Next.
+func (p *prefetcher) next(dst interface{}) (*datastore.Key, error) {
+	if !p.advance() {
+		return nil, p.err
+	}
+	k, props := p.cur.keys[p.pos], p.cur.props[p.pos]
+	p.pos++
+	if dst == nil {
+		return k, nil
+	}
+	if err := p.g.loadResult(dst, k, props); err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+// nextBatch implements Iterator.NextBatch.
+func (p *prefetcher) nextBatch(dstV reflect.Value, elemType reflect.Type, elemTypeIsPtr bool) ([]*datastore.Key, error) {
+	if !p.advance() {
+		return nil, p.err
+	}
+	keys, props := p.cur.keys[p.pos:], p.cur.props[p.pos:]
+	p.pos = len(p.cur.keys)
+	v := reflect.MakeSlice(dstV.Type(), len(keys), len(keys))
+	var rerr error
+	for i, k := range keys {
+		vi := v.Index(i)
+		if elemTypeIsPtr {
+			vi.Set(reflect.New(elemType))
+		} else {
+			vi = vi.Addr()
+		}
+		if err := p.g.loadResult(vi.Interface(), k, props[i]); err != nil {
+			if !errFieldMismatch(err) {
+				return nil, err
+			}
+			if rerr == nil {
+				rerr = err
+			}
+		}
+	}
+	dstV.Set(reflect.AppendSlice(dstV, v))
+	return keys, rerr
+}
+
+// cursor implements Iterator.Cursor.
+func (p *prefetcher) cursor() (datastore.Cursor, error) {
+	if p.cur == nil && p.err == nil {
+		// Wait for the start position
+		p.advance()
+	}
+	if p.cur == nil || p.pos == 0 {
+		if p.err != nil && p.err != datastore.Done {
+			return datastore.Cursor{}, p.err
+		}
+		return p.start, nil
+	}
+	if p.pos == len(p.cur.keys) {
+		return p.cur.cursor, nil
+	}
+	// In the middle of a batch the datastore iterator has already moved on,
+	// so skip over the consumed results of the batch with a zero-limit query
+	q := p.q.Start(p.start).Offset(p.pos).Limit(0)
+	if !p.projection {
+		q = q.KeysOnly()
+	}
+	i := q.Run(p.c)
+	if _, err := i.Next(nil); err != datastore.Done {
+		if err == nil {
+			err = errors.New("goon: zero-limit query returned results")
+		}
+		return datastore.Cursor{}, err
+	}
+	return i.Cursor()
+}
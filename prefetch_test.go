@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPrefetcherBatches(t *testing.T) {
+	c := offlineContext()
+	g := FromContext(c)
+	cursors := make([]datastore.Cursor, 3)
+	for i, s := range []string{"EAE", "EAI", "EAM"} {
+		var err error
+		if cursors[i], err = datastore.DecodeCursor(s); err != nil {
+			t.Fatalf("Unexpected error decoding cursor: %v", err)
+		}
+	}
+	batch := func(cursor datastore.Cursor, err error, ids ...int64) *prefetchBatch {
+		b := &prefetchBatch{cursor: cursor, err: err}
+		for _, id := range ids {
+			b.keys = append(b.keys, datastore.NewKey(c, "HasId", "", id, nil))
+			b.props = append(b.props, datastore.PropertyList{{Name: "Name", Value: string(rune('a' + id))}})
+		}
+		return b
+	}
+	p := &prefetcher{g: g, c: c, started: true, batches: make(chan *prefetchBatch, 3), stop: make(chan struct{})}
+	p.batches <- batch(cursors[0], nil)
+	p.batches <- batch(cursors[1], nil, 1, 2, 3)
+	p.batches <- batch(cursors[2], datastore.Done, 4)
+	close(p.batches)
+	it := &Iterator{g: g, p: p}
+
+	// The cursor before anything is consumed is the start position
+	if cursor, err := it.Cursor(); err != nil || cursor.String() != cursors[0].String() {
+		t.Fatalf("Expected the start cursor, got %v (%v)", cursor, err)
+	}
+	hi := &HasId{}
+	if k, err := it.Next(hi); err != nil || k.IntID() != 1 || hi.Id != 1 || hi.Name != "b" {
+		t.Fatalf("Unexpected result %v %+v (%v)", k, hi, err)
+	}
+	// NextBatch returns the rest of the current batch
+	var dst []HasId
+	keys, err := it.NextBatch(&dst)
+	if err != nil || len(keys) != 2 || len(dst) != 2 || dst[0].Id != 2 || dst[1].Name != "d" {
+		t.Fatalf("Unexpected batch %v %+v (%v)", keys, dst, err)
+	}
+	if cursor, err := it.Cursor(); err != nil || cursor.String() != cursors[1].String() {
+		t.Fatalf("Expected the cursor after the batch, got %v (%v)", cursor, err)
+	}
+	var ptrs []*HasId
+	if keys, err := it.NextBatch(&ptrs); err != nil || len(keys) != 1 || ptrs[0].Id != 4 {
+		t.Fatalf("Unexpected batch %v %+v (%v)", keys, ptrs, err)
+	}
+	if _, err := it.NextBatch(&ptrs); err != datastore.Done {
+		t.Fatalf("Expected datastore.Done, got %v", err)
+	}
+	if _, err := it.Next(nil); err != datastore.Done {
+		t.Fatalf("Expected datastore.Done, got %v", err)
+	}
+	if cursor, err := it.Cursor(); err != nil || cursor.String() != cursors[2].String() {
+		t.Fatalf("Expected the end cursor, got %v (%v)", cursor, err)
+	}
+}
+
+func TestPrefetcherCancel(t *testing.T) {
+	g := FromContext(offlineContext())
+	c, cancel := context.WithCancel(g.Context)
+	defer cancel()
+	it := g.RunPrefetchContext(c, datastore.NewQuery("HasId"), 10)
+	if it.p.started {
+		t.Fatalf("Expected the query to start with the first Next")
+	}
+
+	// With the buffer full and nobody reading, fetch can only return
+	// by noticing that the context was cancelled
+	it.p.batches <- &prefetchBatch{}
+	it.p.started = true
+	done := make(chan struct{})
+	go func() {
+		it.p.fetch()
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected fetch to return after the context was cancelled")
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("Unexpected error on Close: %v", err)
+	}
+}
+
+func TestPrefetcherClose(t *testing.T) {
+	c := offlineContext()
+	g := FromContext(c)
+	p := &prefetcher{g: g, c: c, batches: make(chan *prefetchBatch), stop: make(chan struct{})}
+	sent := make(chan bool)
+	go func() {
+		sent <- p.send(&prefetchBatch{})
+	}()
+	it := &Iterator{g: g, p: p}
+	it.Close()
+	it.Close()
+	if <-sent {
+		t.Fatalf("Expected send to give up after Close")
+	}
+	if _, err := it.Next(nil); err != datastore.Done {
+		t.Fatalf("Expected datastore.Done after Close, got %v", err)
+	}
+
+	if _, err := g.Run(datastore.NewQuery("HasId")).NextBatch(&[]HasId{}); err == nil {
+		t.Fatalf("Expected an error from NextBatch without prefetching")
+	}
+	if _, err := g.RunPrefetch(datastore.NewQuery("HasId"), 0).Next(nil); err == nil {
+		t.Fatalf("Expected an error for a zero batch size")
+	}
+}
+
+func TestForEachLocal(t *testing.T) {
+	c := offlineContext()
+	g := FromContext(c)
+	end, err := datastore.DecodeCursor("EAM")
+	if err != nil {
+		t.Fatalf("Unexpected error decoding cursor: %v", err)
+	}
+	iterate := func() *Iterator {
+		p := &prefetcher{g: g, c: c, started: true, batches: make(chan *prefetchBatch, 2), stop: make(chan struct{})}
+		b := &prefetchBatch{cursor: end, err: datastore.Done}
+		for id := int64(1); id <= 3; id++ {
+			b.keys = append(b.keys, datastore.NewKey(c, "HasId", "", id, nil))
+			// Only the first entity has a name, which must not leak into the others
+			var props datastore.PropertyList
+			if id == 1 {
+				props = append(props, datastore.Property{Name: "Name", Value: "one"})
+			}
+			b.props = append(b.props, props)
+		}
+		p.batches <- &prefetchBatch{}
+		p.batches <- b
+		close(p.batches)
+		return &Iterator{g: g, p: p}
+	}
+
+	var seen []HasId
+	hi := &HasId{}
+	err = iterate().forEach(hi, func(k *datastore.Key, cursor func() (datastore.Cursor, error)) error {
+		if hi.Id != k.IntID() {
+			t.Fatalf("Expected id %v, got %v", k.IntID(), hi.Id)
+		}
+		seen = append(seen, *hi)
+		if k.IntID() == 3 {
+			if c, err := cursor(); err != nil || c.String() != end.String() {
+				t.Fatalf("Expected the end cursor, got %v (%v)", c, err)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(seen) != 3 || seen[0].Name != "one" || seen[1].Name != "" || seen[2].Id != 3 {
+		t.Fatalf("Unexpected results %+v (%v)", seen, err)
+	}
+
+	// ErrStopIteration stops early without an error, other errors are returned
+	n := 0
+	err = iterate().forEach(nil, func(*datastore.Key, func() (datastore.Cursor, error)) error {
+		n++
+		return ErrStopIteration
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("Expected to stop after one result without an error, got %v (%v)", n, err)
+	}
+	err = iterate().forEach(nil, func(*datastore.Key, func() (datastore.Cursor, error)) error {
+		return fmt.Errorf("done: %w", ErrStopIteration)
+	})
+	if err != nil {
+		t.Fatalf("Expected a wrapped ErrStopIteration to stop without an error, got %v", err)
+	}
+	// .. but a field mismatch that was found before stopping is returned
+	type noName struct {
+		Id int64 `datastore:"-" goon:"id"`
+	}
+	origIFM := IgnoreFieldMismatch
+	IgnoreFieldMismatch = false
+	err = iterate().forEach(&noName{}, func(*datastore.Key, func() (datastore.Cursor, error)) error {
+		return ErrStopIteration
+	})
+	IgnoreFieldMismatch = origIFM
+	if !errFieldMismatch(err) {
+		t.Fatalf("Expected a field mismatch error, got %v", err)
+	}
+	errTest := errors.New("test")
+	err = iterate().forEach(nil, func(*datastore.Key, func() (datastore.Cursor, error)) error {
+		return errTest
+	})
+	if err != errTest {
+		t.Fatalf("Expected the error of the function, got %v", err)
+	}
+
+	if err := g.ForEach(datastore.NewQuery("HasId"), HasId{}, nil); err == nil {
+		t.Fatalf("Expected an error for a non-pointer dst")
+	}
+}
+
+func TestForEach(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	src := make([]*HasId, 250)
+	for i := range src {
+		src[i] = &HasId{Id: int64(i + 1), Name: fmt.Sprintf("%03d", i)}
+	}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 250}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+	g.FlushLocalCache()
+
+	// Stop in the middle, saving a checkpoint
+	q := datastore.NewQuery("HasId").Order("Name")
+	var checkpoint datastore.Cursor
+	n := 0
+	err = Query[HasId](g, q).ForEach(func(hi *HasId, _ *datastore.Key, cursor func() (datastore.Cursor, error)) error {
+		if hi.Name != fmt.Sprintf("%03d", n) {
+			t.Fatalf("Unexpected entity %+v at %v", hi, n)
+		}
+		n++
+		if n == 120 {
+			var err error
+			checkpoint, err = cursor()
+			if err != nil {
+				return err
+			}
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil || n != 120 {
+		t.Fatalf("Expected to stop after 120 results, got %v (%v)", n, err)
+	}
+
+	// .. and resume from it
+	var names []string
+	err = g.ForEach(q.Start(checkpoint), nil, func(k *datastore.Key, _ func() (datastore.Cursor, error)) error {
+		names = append(names, fmt.Sprintf("%03d", k.IntID()-1))
+		return nil
+	})
+	if err != nil || len(names) != 130 || names[0] != "120" || names[129] != "249" {
+		t.Fatalf("Unexpected resumed results %v (%v)", len(names), err)
+	}
+	if stats := g.CacheStats(); stats.Items == 0 {
+		t.Fatalf("Expected the batches to be cached")
+	}
+}
+
+func TestRunPrefetch(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	src := []*HasId{{Id: 1, Name: "a"}, {Id: 2, Name: "b"}, {Id: 3, Name: "c"}, {Id: 4, Name: "d"}, {Id: 5, Name: "e"}}
+	if _, err := g.PutMulti(src); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}, {Id: 5}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+	g.FlushLocalCache()
+
+	q := datastore.NewQuery("HasId").Order("Name")
+	it := g.RunPrefetch(q, 2)
+	defer it.Close()
+	hi := &HasId{}
+	if _, err := it.Next(hi); err != nil || hi.Name != "a" {
+		t.Fatalf("Unexpected result %+v (%v)", hi, err)
+	}
+	// A cursor in the middle of a batch continues right after the consumed result
+	cursor, err := it.Cursor()
+	if err != nil {
+		t.Fatalf("Unexpected error on Cursor: %v", err)
+	}
+	var names []string
+	for {
+		var dst []*HasId
+		if _, err := it.NextBatch(&dst); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error on NextBatch: %v", err)
+		}
+		for _, hi := range dst {
+			names = append(names, hi.Name)
+		}
+	}
+	if len(names) != 4 || names[0] != "b" || names[3] != "e" {
+		t.Fatalf("Unexpected results %v", names)
+	}
+	if stats := g.CacheStats(); stats.Items != 5 {
+		t.Fatalf("Expected 5 cached entities, got %v", stats.Items)
+	}
+	if sets := mc.Counter("Next", TierLocal, MetricSet); sets != 5 {
+		t.Fatalf("Expected 5 cache sets, got %v", sets)
+	}
+
+	var rest []HasId
+	if _, err := g.GetAll(q.Start(cursor), &rest); err != nil || len(rest) != 4 || rest[0].Name != "b" {
+		t.Fatalf("Unexpected results after the cursor %+v (%v)", rest, err)
+	}
+}
@@ -17,15 +17,53 @@
 package goon
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
 // Count returns the number of results for the query.
+//
+// If the kind is registered with KindCacheConfig.CountCacheTTL, then the count
+// is cached in memcache, and a later Count of an equal query returns it until
+// it expires or the kind is written to.
 func (g *Goon) Count(q *datastore.Query) (int, error) {
-	return q.Count(g.Context)
+	return g.CountContext(g.Context, q)
+}
+
+// CountContext is like Count, but uses c instead of g.Context.
+func (g *Goon) CountContext(c context.Context, q *datastore.Query) (int, error) {
+	return g.countIn(c, "", q)
+}
+
+// countIn is like CountContext, but runs q in the namespace ns,
+// which defaults to the one chosen by namespaceContext.
+func (g *Goon) countIn(c context.Context, ns string, q *datastore.Query) (int, error) {
+	c = g.callContext(c)
+	c, err := g.namespaceContext(c, ns)
+	if err != nil {
+		return 0, err
+	}
+	cc := g.newCountCache(c, inspectQuery(q))
+	if cc != nil {
+		if n, ok := cc.get(); ok {
+			return n, nil
+		}
+	}
+	start := time.Now()
+	n, err := q.Count(c)
+	g.timing("Count", TierDatastore, start)
+	if err != nil {
+		g.countMultiErr("Count", TierDatastore, MetricResult, 0, err)
+	} else if cc != nil {
+		cc.set(n)
+	}
+	return n, err
 }
 
 // GetAll runs the query and returns all the keys that match the query, as well
@@ -36,34 +74,107 @@ func (g *Goon) Count(q *datastore.Query) (int, error) {
 // appends zero value structs to dst, only setting the goon key fields.
 // No data is cached with "keys-only" queries.
 //
+// For projection and distinct queries GetAll appends structs that only have
+// the projected fields and the goon key fields set. These partial entities
+// are never cached, neither is the result of the query.
+//
+// If the kind is registered with KindCacheConfig.CacheQueries, then the keys
+// matching the query are cached too, and a later GetAll of an equal query
+// loads the entities of those keys via GetMulti instead of running the query.
+//
 // See: https://developers.google.com/appengine/docs/go/datastore/reference#Query.GetAll
 func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
-	v := reflect.ValueOf(dst)
-	dstV := reflect.Indirect(v)
-	vLenBefore := 0
-	if dst != nil {
-		if v.Kind() != reflect.Ptr {
-			return nil, fmt.Errorf("goon: Expected dst to be a pointer to a slice or nil, got instead: %v", v.Kind())
-		}
-		v = v.Elem()
-		if v.Kind() != reflect.Slice {
-			return nil, fmt.Errorf("goon: Expected dst to be a pointer to a slice or nil, got instead: %v", v.Kind())
+	return g.GetAllContext(g.Context, q, dst)
+}
+
+// GetAllContext is like GetAll, but uses c instead of g.Context.
+func (g *Goon) GetAllContext(c context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return g.getAllIn(c, "", q, dst)
+}
+
+// getAllIn is like GetAllContext, but runs q in the namespace ns,
+// which defaults to the one chosen by namespaceContext.
+func (g *Goon) getAllIn(c context.Context, ns string, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	if err := checkSliceDst(dst); err != nil {
+		return nil, err
+	}
+
+	c = g.callContext(c)
+	c, err := g.namespaceContext(c, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serve the query from cached keys if the kind is registered with CacheQueries
+	info := inspectQuery(q)
+	qc := g.newQueryCache(c, info)
+	if qc != nil {
+		if keys, ok := qc.get(); ok {
+			if _, err := g.getAllByKeys(c, keys, qc.keysOnly, false, dst); err != errMissingEntities {
+				return keys, err
+			}
+			// Some of the entities were deleted by something other than goon
 		}
-		vLenBefore = v.Len()
 	}
 
-	var propLists []datastore.PropertyList
-	keys, err := q.GetAll(g.Context, &propLists)
+	keys, propLists, err := g.runQuery(c, "GetAll", q)
 	if err != nil {
-		g.error(err)
 		return keys, err
 	}
+	if qc != nil {
+		qc.set(keys)
+	}
+	return g.loadAll(c, "GetAll", keys, propLists, info.projection, dst)
+}
+
+// checkSliceDst returns an error if dst isn't nil or a pointer to a slice.
+func checkSliceDst(dst interface{}) error {
+	if dst == nil {
+		return nil
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr {
+		return &TypeError{Expected: "dst to be a pointer to a slice or nil", Got: v.Kind().String()}
+	}
+	if v = v.Elem(); v.Kind() != reflect.Slice {
+		return &TypeError{Expected: "dst to be a pointer to a slice or nil", Got: v.Kind().String()}
+	}
+	return nil
+}
+
+// runQuery runs q with GetAll, as part of op.
+// The returned propLists are empty for keys-only queries.
+func (g *Goon) runQuery(c context.Context, op string, q *datastore.Query) ([]*datastore.Key, []datastore.PropertyList, error) {
+	var propLists []datastore.PropertyList
+	start := time.Now()
+	keys, err := q.GetAll(c, &propLists)
+	g.timing(op, TierDatastore, start)
+	g.countMultiErr(op, TierDatastore, MetricResult, len(keys), err)
+	if err != nil {
+		g.error(c, &LogEntry{Op: op, Kind: keysKind(keys), KeyCount: len(keys), Tier: TierDatastore, Err: err})
+		return keys, nil, err
+	}
+	return keys, propLists, nil
+}
+
+// loadAll appends the query results keys and propLists to dst, with the
+// semantics of GetAll, as part of op, which runs with the context c.
+// The entities are cached in local memory, unless the results are keys-only
+// or of a projection query. Returns what GetAll returns, i.e. no keys if
+// an entity couldn't be loaded. dst must have been checked to be nil or
+// a pointer to a slice.
+func (g *Goon) loadAll(c context.Context, op string, keys []*datastore.Key, propLists []datastore.PropertyList, projection bool, dst interface{}) ([]*datastore.Key, error) {
 	if dst == nil || len(keys) == 0 {
-		return keys, err
+		return keys, nil
 	}
+	dstV := reflect.ValueOf(dst).Elem()
+	v := dstV
+	vLenBefore := v.Len()
 
 	keysOnly := (len(propLists) != len(keys))
-	updateCache := !g.inTransaction && !keysOnly
+	// Projection results are partial entities, which must not be cached as entities
+	updateCache := !g.inTransaction && !keysOnly && !projection
+	var cacheKeys []*datastore.Key
 
 	elemType := v.Type().Elem()
 	elemTypeIsPtr := false
@@ -72,7 +183,7 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 		elemTypeIsPtr = true
 	}
 	if elemType.Kind() != reflect.Struct {
-		return keys, fmt.Errorf("goon: Expected struct, got instead: %v", elemType.Kind())
+		return keys, &TypeError{Expected: "struct", Got: elemType.Kind().String()}
 	}
 
 	initMem := false
@@ -139,20 +250,21 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 			return nil, err
 		}
 
-		if updateCache {
+		if updateCache && g.localCacheFor(k.Kind()) != nil {
 			// Serialize the properties
 			data, err := serializeProperties(propLists[i], true)
 			if err != nil {
-				g.error(err)
+				g.error(c, &LogEntry{Op: op, Kind: k.Kind(), KeyCount: 1, Tier: TierLocal, Err: err})
 				return nil, err
 			}
 			// Prepare the properties for caching
 			toCache = append(toCache, &cacheItem{key: cacheKey(k), value: data})
+			cacheKeys = append(cacheKeys, k)
 		}
 	}
 
 	if len(toCache) > 0 {
-		g.cache.SetMulti(toCache)
+		g.count(op, TierLocal, MetricSet, g.localSetMulti(cacheKeys, toCache))
 	}
 
 	// Set dst to the slice we created
@@ -161,22 +273,157 @@ func (g *Goon) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, er
 	return keys, rerr
 }
 
-// Run runs the query.
+// GetAllByKeys is like GetAll, but runs the query as keys-only and then loads
+// the entities via GetMulti, which serves them from the local memory cache
+// and memcache when possible. This is cheaper than GetAll when most of the
+// results are already cached. The keys-only query is itself cached if the
+// kind is registered with KindCacheConfig.CacheQueries.
+//
+// The results are in the order of the query. Entities that were deleted
+// between running the query and loading them are left out, both from dst
+// and from the returned keys. Projection and keys-only queries are run with
+// GetAll instead.
+func (g *Goon) GetAllByKeys(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return g.GetAllByKeysContext(g.Context, q, dst)
+}
+
+// GetAllByKeysContext is like GetAllByKeys, but uses c instead of g.Context.
+func (g *Goon) GetAllByKeysContext(c context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return g.getAllByKeysIn(c, "", q, dst)
+}
+
+// getAllByKeysIn is like GetAllByKeysContext, but runs q in the namespace ns,
+// which defaults to the one chosen by namespaceContext.
+func (g *Goon) getAllByKeysIn(c context.Context, ns string, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	if info := inspectQuery(q); dst == nil || info.keysOnly || !info.cacheable {
+		return g.getAllIn(c, ns, q, dst)
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, &TypeError{Expected: "dst to be a pointer to a slice or nil", Got: v.Kind().String()}
+	}
+	keys, err := g.getAllIn(c, ns, q.KeysOnly(), nil)
+	if err != nil {
+		return keys, err
+	}
+	return g.getAllByKeys(c, keys, false, true, dst)
+}
+
+// errMissingEntities is returned by getAllByKeys if entities are missing and may not be skipped.
+var errMissingEntities = errors.New("goon: missing entities")
+
+// getAllByKeys appends the entities of keys to dst, with the same semantics
+// as GetAll, and returns the keys of the appended entities. Entities are loaded
+// via GetMulti, or only get their key fields set if keysOnly is true.
+// Entities that no longer exist are left out if skipMissing is true,
+// otherwise nothing is appended and errMissingEntities is returned.
+func (g *Goon) getAllByKeys(c context.Context, keys []*datastore.Key, keysOnly, skipMissing bool, dst interface{}) ([]*datastore.Key, error) {
+	if dst == nil {
+		return keys, nil
+	}
+	dstV := reflect.ValueOf(dst).Elem()
+	elemType := dstV.Type().Elem()
+	elemTypeIsPtr := false
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+		elemTypeIsPtr = true
+	}
+	if elemType.Kind() != reflect.Struct {
+		return keys, &TypeError{Expected: "struct", Got: elemType.Kind().String()}
+	}
+	v := reflect.MakeSlice(dstV.Type(), len(keys), len(keys))
+	for i, k := range keys {
+		vi := v.Index(i)
+		if elemTypeIsPtr {
+			vi.Set(reflect.New(elemType))
+		} else {
+			vi = vi.Addr()
+		}
+		if err := g.setStructKey(vi.Interface(), k); err != nil {
+			return nil, err
+		}
+	}
+	var rerr error
+	if !keysOnly && len(keys) > 0 {
+		if err := g.GetMultiContext(c, v.Interface()); err != nil {
+			merr, ok := err.(appengine.MultiError)
+			if !ok {
+				return nil, err
+			}
+			found := make([]*datastore.Key, 0, len(keys))
+			n := 0
+			for i, e := range merr {
+				if e != nil && errors.Is(e, datastore.ErrNoSuchEntity) {
+					continue
+				} else if e != nil && !errFieldMismatch(e) {
+					return nil, err
+				} else if e != nil && rerr == nil {
+					rerr = e
+				}
+				// Move the entities that exist to the front, keeping their order
+				if n != i {
+					v.Index(n).Set(v.Index(i))
+				}
+				found = append(found, keys[i])
+				n++
+			}
+			if n < len(keys) {
+				if !skipMissing {
+					return nil, errMissingEntities
+				}
+				v = v.Slice(0, n)
+				keys = found
+			}
+		}
+	}
+	dstV.Set(reflect.AppendSlice(dstV, v))
+	return keys, rerr
+}
+
+// Run runs the query. The results are always fetched from the datastore,
+// even for kinds registered with KindCacheConfig.CacheQueries.
 func (g *Goon) Run(q *datastore.Query) *Iterator {
+	return g.RunContext(g.Context, q)
+}
+
+// RunContext is like Run, but uses c instead of g.Context.
+// The context applies to the whole lifetime of the returned Iterator.
+func (g *Goon) RunContext(c context.Context, q *datastore.Query) *Iterator {
+	return g.runIn(c, "", q)
+}
+
+// runIn is like RunContext, but runs q in the namespace ns,
+// which defaults to the one chosen by namespaceContext.
+func (g *Goon) runIn(c context.Context, ns string, q *datastore.Query) *Iterator {
+	c = g.callContext(c)
+	c, err := g.namespaceContext(c, ns)
+	if err != nil {
+		return &Iterator{g: g, err: err}
+	}
 	return &Iterator{
-		g: g,
-		i: q.Run(g.Context),
+		g:          g,
+		i:          q.Run(c),
+		projection: inspectQuery(q).projection,
 	}
 }
 
 // Iterator is the result of running a query.
 type Iterator struct {
-	g *Goon
-	i *datastore.Iterator
+	g          *Goon
+	i          *datastore.Iterator
+	p          *prefetcher // set for iterators returned by RunPrefetch
+	err        error       // set if the query couldn't be run at all
+	projection bool        // set for projection and distinct queries, whose results aren't cached
 }
 
 // Cursor returns a cursor for the iterator's current location.
 func (t *Iterator) Cursor() (datastore.Cursor, error) {
+	if t.err != nil {
+		return datastore.Cursor{}, t.err
+	}
+	if t.p != nil {
+		return t.p.cursor()
+	}
 	return t.i.Cursor()
 }
 
@@ -189,41 +436,69 @@ func (t *Iterator) Cursor() (datastore.Cursor, error) {
 //
 // If the query is keys only and dst is non-nil, dst will be given the right id.
 //
+// If the query is a projection or distinct query and dst is non-nil, only the
+// projected fields and the goon key fields of dst are set, and nothing is cached.
+//
 // Refer to appengine/datastore.Iterator.Next:
 // https://developers.google.com/appengine/docs/go/datastore/reference#Iterator.Next
 func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.p != nil {
+		return t.p.next(dst)
+	}
 	var props datastore.PropertyList
+	start := time.Now()
 	k, err := t.i.Next(&props)
+	t.g.timing("Next", TierDatastore, start)
 	if err != nil {
+		if err != datastore.Done {
+			t.g.countMultiErr("Next", TierDatastore, MetricResult, 0, err)
+		}
 		return k, err
 	}
+	t.g.count("Next", TierDatastore, MetricResult, 1)
 	var rerr error
 	if dst != nil {
 		keysOnly := (props == nil)
-		updateCache := !t.g.inTransaction && !keysOnly
-		if !keysOnly {
-			if err := deserializeProperties(dst, props); err != nil {
-				if errFieldMismatch(err) {
-					// If we're not configured to ignore, set rerr to err,
-					// but proceed with work
-					if !IgnoreFieldMismatch {
-						rerr = err
-					}
-				} else {
-					return k, err
-				}
-			}
-		}
-		if err := t.g.setStructKey(dst, k); err != nil {
-			return k, err
+		updateCache := !t.g.inTransaction && !keysOnly && !t.projection
+		if rerr = t.g.loadResult(dst, k, props); rerr != nil && !errFieldMismatch(rerr) {
+			return k, rerr
 		}
-		if updateCache {
+		if lc := t.g.localCacheFor(k.Kind()); updateCache && lc != nil {
 			data, err := serializeProperties(props, true)
 			if err != nil {
 				return k, err
 			}
-			t.g.cache.Set(&cacheItem{key: cacheKey(k), value: data})
+			lc.Set(&cacheItem{key: cacheKey(k), value: data})
+			t.g.count("Next", TierLocal, MetricSet, 1)
 		}
 	}
 	return k, rerr
 }
+
+// loadResult loads the query result props into the struct pointer dst,
+// and sets its goon key fields to k. Keys-only results have nil props.
+// A field mismatch error is only returned if IgnoreFieldMismatch is false,
+// and even then dst is fully loaded.
+func (g *Goon) loadResult(dst interface{}, k *datastore.Key, props datastore.PropertyList) error {
+	var rerr error
+	if props != nil {
+		if err := deserializeProperties(dst, props); err != nil {
+			if errFieldMismatch(err) {
+				// If we're not configured to ignore, set rerr to err,
+				// but proceed with work
+				if !IgnoreFieldMismatch {
+					rerr = err
+				}
+			} else {
+				return err
+			}
+		}
+	}
+	if err := g.setStructKey(dst, k); err != nil {
+		return err
+	}
+	return rerr
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	geoPointType          = reflect.TypeOf(appengine.GeoPoint{})
+	byteSliceType         = reflect.TypeOf([]byte(nil))
+	propertyLoadSaverType = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
+)
+
+// keyPropertyName is the special property name for filtering and ordering by key.
+const keyPropertyName = "__key__"
+
+// propertyNamesCache holds the map[string]bool returned by getPropertyNames
+// for every reflect.Type seen so far.
+var propertyNamesCache sync.Map
+
+// getPropertyNames returns the datastore property names of the struct type t,
+// or nil if they can't be known, because t implements datastore.PropertyLoadSaver.
+func getPropertyNames(t reflect.Type) map[string]bool {
+	if names, ok := propertyNamesCache.Load(t); ok {
+		return names.(map[string]bool)
+	}
+	var names map[string]bool
+	if !reflect.PtrTo(t).Implements(propertyLoadSaverType) {
+		names = make(map[string]bool)
+		collectPropertyNames(t, "", map[reflect.Type]bool{t: true}, names)
+	}
+	stored, _ := propertyNamesCache.LoadOrStore(t, names)
+	return stored.(map[string]bool)
+}
+
+// collectPropertyNames adds the property names of the struct type t to names,
+// following the naming rules of the datastore package. Nested structs are
+// flattened with their field name and a dot as the prefix, except for
+// anonymous embedded structs, whose properties are promoted as is.
+func collectPropertyNames(t reflect.Type, prefix string, visited map[reflect.Type]bool, names map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("datastore"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		st := f.Type
+		if st.Kind() == reflect.Slice && st != byteSliceType {
+			st = st.Elem()
+		}
+		if st.Kind() == reflect.Struct && st != timeType && st != geoPointType {
+			if visited[st] {
+				continue
+			}
+			subPrefix := prefix
+			if name == "" && !f.Anonymous {
+				name = f.Name
+			}
+			if name != "" {
+				subPrefix += name + "."
+			}
+			visited[st] = true
+			collectPropertyNames(st, subPrefix, visited, names)
+			delete(visited, st)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[prefix+name] = true
+	}
+}
+
+// QueryBuilder builds a datastore query for the entities of a goon struct.
+// Every method returns a new QueryBuilder, leaving the original unchanged,
+// like the methods of datastore.Query. Property names given to Filter and
+// Order are checked against the struct, and the first problem is returned
+// when the query is run.
+type QueryBuilder struct {
+	g      *Goon
+	q      *datastore.Query
+	ns     string          // namespace of the struct's key, which the query runs in
+	name   string          // name of the struct type, for errors
+	fields map[string]bool // nil if the property names can't be checked
+	err    error
+}
+
+// NewQuery returns a QueryBuilder for the entities of the same kind as src,
+// which must be a S or *S for some struct type S. The kind is determined like
+// for the Key function, and so is the namespace that the query runs in.
+// If src has a parent, then the query is an ancestor query with that parent.
+func (g *Goon) NewQuery(src interface{}) *QueryBuilder {
+	qb := &QueryBuilder{g: g}
+	key, _, err := g.getStructKey(g.Context, src)
+	if err != nil {
+		qb.err = err
+		return qb
+	}
+	t := reflect.Indirect(reflect.ValueOf(src)).Type()
+	qb.name = t.Name()
+	qb.fields = getPropertyNames(t)
+	qb.ns = key.Namespace()
+	qb.q = datastore.NewQuery(key.Kind())
+	if parent := key.Parent(); parent != nil {
+		qb.q = qb.q.Ancestor(parent)
+	}
+	return qb
+}
+
+// with returns a copy of qb with the query q, or with the error err.
+func (qb *QueryBuilder) with(q *datastore.Query, err error) *QueryBuilder {
+	nqb := *qb
+	nqb.q, nqb.err = q, err
+	return &nqb
+}
+
+// checkField returns an error if the struct doesn't have the property name.
+func (qb *QueryBuilder) checkField(op, name string) error {
+	if qb.fields == nil || name == keyPropertyName || qb.fields[name] {
+		return nil
+	}
+	return &QueryFieldError{Struct: qb.name, Field: name, Op: op}
+}
+
+// Filter returns a derivative query with a field-based filter,
+// see datastore.Query.Filter.
+func (qb *QueryBuilder) Filter(filterStr string, value interface{}) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	name := strings.TrimRight(strings.TrimSpace(filterStr), " ><=!")
+	return qb.with(qb.q.Filter(filterStr, value), qb.checkField("Filter", name))
+}
+
+// Order returns a derivative query with a field-based sort order,
+// see datastore.Query.Order.
+func (qb *QueryBuilder) Order(fieldName string) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	name := strings.TrimPrefix(strings.TrimSpace(fieldName), "-")
+	return qb.with(qb.q.Order(fieldName), qb.checkField("Order", strings.TrimSpace(name)))
+}
+
+// Ancestor returns a derivative query with an ancestor filter,
+// replacing the parent of the struct given to NewQuery.
+func (qb *QueryBuilder) Ancestor(ancestor *datastore.Key) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.Ancestor(ancestor), nil)
+}
+
+// Limit returns a derivative query that has a limit on the number of results
+// returned, see datastore.Query.Limit.
+func (qb *QueryBuilder) Limit(limit int) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.Limit(limit), nil)
+}
+
+// Offset returns a derivative query that has an offset of how many keys
+// to skip over before returning results, see datastore.Query.Offset.
+func (qb *QueryBuilder) Offset(offset int) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.Offset(offset), nil)
+}
+
+// KeysOnly returns a derivative query that yields only keys,
+// see datastore.Query.KeysOnly.
+func (qb *QueryBuilder) KeysOnly() *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.KeysOnly(), nil)
+}
+
+// EventualConsistency returns a derivative query that returns eventually
+// consistent results, see datastore.Query.EventualConsistency.
+func (qb *QueryBuilder) EventualConsistency() *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.EventualConsistency(), nil)
+}
+
+// Start returns a derivative query with the given start point.
+func (qb *QueryBuilder) Start(c datastore.Cursor) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.Start(c), nil)
+}
+
+// End returns a derivative query with the given end point.
+func (qb *QueryBuilder) End(c datastore.Cursor) *QueryBuilder {
+	if qb.err != nil {
+		return qb
+	}
+	return qb.with(qb.q.End(c), nil)
+}
+
+// Query returns the built query, or the first error found while building it.
+func (qb *QueryBuilder) Query() (*datastore.Query, error) {
+	return qb.q, qb.err
+}
+
+// Count returns the number of results for the query, see Goon.Count.
+func (qb *QueryBuilder) Count() (int, error) {
+	return qb.CountContext(qb.g.Context)
+}
+
+// CountContext is like Count, but uses c instead of Goon.Context.
+func (qb *QueryBuilder) CountContext(c context.Context) (int, error) {
+	if qb.err != nil {
+		return 0, qb.err
+	}
+	return qb.g.countIn(c, qb.ns, qb.q)
+}
+
+// GetAll runs the query, see Goon.GetAll.
+func (qb *QueryBuilder) GetAll(dst interface{}) ([]*datastore.Key, error) {
+	return qb.GetAllContext(qb.g.Context, dst)
+}
+
+// GetAllContext is like GetAll, but uses c instead of Goon.Context.
+func (qb *QueryBuilder) GetAllContext(c context.Context, dst interface{}) ([]*datastore.Key, error) {
+	if qb.err != nil {
+		return nil, qb.err
+	}
+	return qb.g.getAllIn(c, qb.ns, qb.q, dst)
+}
+
+// GetAllByKeys runs the query, see Goon.GetAllByKeys.
+func (qb *QueryBuilder) GetAllByKeys(dst interface{}) ([]*datastore.Key, error) {
+	return qb.GetAllByKeysContext(qb.g.Context, dst)
+}
+
+// GetAllByKeysContext is like GetAllByKeys, but uses c instead of Goon.Context.
+func (qb *QueryBuilder) GetAllByKeysContext(c context.Context, dst interface{}) ([]*datastore.Key, error) {
+	if qb.err != nil {
+		return nil, qb.err
+	}
+	return qb.g.getAllByKeysIn(c, qb.ns, qb.q, dst)
+}
+
+// Run runs the query, see Goon.Run.
+func (qb *QueryBuilder) Run() *Iterator {
+	return qb.RunContext(qb.g.Context)
+}
+
+// RunContext is like Run, but uses c instead of Goon.Context.
+func (qb *QueryBuilder) RunContext(c context.Context) *Iterator {
+	if qb.err != nil {
+		return &Iterator{g: qb.g, err: qb.err}
+	}
+	return qb.g.runIn(c, qb.ns, qb.q)
+}
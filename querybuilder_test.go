@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+type queryAddress struct {
+	City string
+	Zip  string `datastore:"zip,noindex"`
+}
+
+type queryBase struct {
+	Created time.Time
+}
+
+type queryArticle struct {
+	Id       int64          `datastore:"-" goon:"id"`
+	Kind     string         `datastore:"-" goon:"kind,Article"`
+	Parent   *datastore.Key `datastore:"-" goon:"parent"`
+	Title    string         `datastore:"title"`
+	Address  queryAddress
+	Tags     []string
+	Hidden   string `datastore:"-"`
+	internal string
+	queryBase
+}
+
+func TestPropertyNames(t *testing.T) {
+	names := getPropertyNames(reflect.TypeOf(queryArticle{}))
+	for _, name := range []string{"title", "Address.City", "Address.zip", "Tags", "Created"} {
+		if !names[name] {
+			t.Fatalf("Expected property %q in %v", name, names)
+		}
+	}
+	for _, name := range []string{"Id", "Kind", "Parent", "Title", "Hidden", "internal", "Address", "queryBase.Created", "Address.Zip"} {
+		if names[name] {
+			t.Fatalf("Unexpected property %q in %v", name, names)
+		}
+	}
+	if names := getPropertyNames(reflect.TypeOf(dummyPLS{})); names != nil {
+		t.Fatalf("Expected no property names for a PropertyLoadSaver, got %v", names)
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	g := FromContext(offlineContext())
+	parent := datastore.NewKey(g.Context, "Blog", "b", 0, nil)
+	when := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The kind and the ancestor come from the struct
+	qb := g.NewQuery(&queryArticle{Parent: parent}).Filter("title =", "x").Filter("Created >", when).Order("-Created").Limit(5)
+	q, err := qb.Query()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := datastore.NewQuery("Article").Ancestor(parent).Filter("title =", "x").Filter("Created >", when).Order("-Created").Limit(5)
+	if inspectQuery(q).fingerprint != inspectQuery(expected).fingerprint {
+		t.Fatalf("Unexpected query\n%v\nexpected\n%v", inspectQuery(q).fingerprint, inspectQuery(expected).fingerprint)
+	}
+	if q, _ := g.NewQuery(queryArticle{Kind: "Other"}).Query(); inspectQuery(q).kind != "Other" {
+		t.Fatalf("Expected the kind field to be used, got %v", inspectQuery(q).kind)
+	}
+
+	// The namespace comes from the struct too, taking precedence over Goon.Namespace
+	if qb := g.NewQuery(&HasNamespace{Namespace: "ns1"}); qb.ns != "ns1" {
+		t.Fatalf("Expected the namespace ns1, got %q", qb.ns)
+	}
+	ng := FromContext(offlineContext())
+	ng.Namespace = "other"
+	if qb := ng.NewQuery(&HasNamespace{Namespace: "ns1"}); qb.ns != "ns1" {
+		t.Fatalf("Expected the namespace ns1, got %q", qb.ns)
+	}
+	if qb := ng.NewQuery(&HasNamespace{}); qb.ns != "other" {
+		t.Fatalf("Expected the namespace other, got %q", qb.ns)
+	}
+
+	// Builders are immutable
+	base := g.NewQuery(&queryArticle{})
+	base.Filter("Unknown =", 1)
+	if _, err := base.Order("__key__").Query(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Unknown properties are reported when running the query
+	for _, qb := range []*QueryBuilder{
+		base.Filter("Title =", "x"),
+		base.Order("-Hidden").Limit(1),
+		base.Filter("Address.Zip =", "x"),
+	} {
+		var qfe *QueryFieldError
+		if _, err := qb.GetAll(&[]*queryArticle{}); !errors.Is(err, ErrUnknownQueryField) || !errors.As(err, &qfe) || qfe.Struct != "queryArticle" {
+			t.Fatalf("Expected a *QueryFieldError, got %v", err)
+		}
+		if _, err := qb.Run().Next(nil); !errors.Is(err, ErrUnknownQueryField) {
+			t.Fatalf("Expected ErrUnknownQueryField from Run, got %v", err)
+		}
+	}
+	if _, err := g.NewQuery(5).Count(); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("Expected ErrInvalidType, got %v", err)
+	}
+}
+
+func TestQueryBuilderRun(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	parent := datastore.NewKey(c, "Blog", "b", 0, nil)
+	if _, err := g.PutMulti([]*queryArticle{{Id: 1, Parent: parent, Title: "b"}, {Id: 2, Parent: parent, Title: "a"}, {Id: 3, Title: "c"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	var dst []*queryArticle
+	keys, err := g.NewQuery(&queryArticle{Parent: parent}).Order("title").GetAll(&dst)
+	if err != nil {
+		t.Fatalf("Unexpected error on GetAll: %v", err)
+	}
+	if len(keys) != 2 || dst[0].Title != "a" || dst[1].Id != 1 || !dst[1].Parent.Equal(parent) {
+		t.Fatalf("Unexpected results %v %+v", keys, dst)
+	}
+
+	// The query runs in the namespace of the struct
+	if _, err := g.Put(&HasNamespace{Id: 1, Namespace: "ns1", Name: "one"}); err != nil {
+		t.Fatalf("Unexpected error on Put: %v", err)
+	}
+	var nsDst []*HasNamespace
+	if keys, err := g.NewQuery(&HasNamespace{Namespace: "ns1"}).GetAll(&nsDst); err != nil || len(keys) != 1 || nsDst[0].Namespace != "ns1" || nsDst[0].Name != "one" {
+		t.Fatalf("Unexpected results %v %+v (%v)", keys, nsDst, err)
+	}
+	if n, err := g.NewQuery(&HasNamespace{}).Count(); err != nil || n != 0 {
+		t.Fatalf("Expected no results in the default namespace, got %v (%v)", n, err)
+	}
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// The prefix of the cache keys of query results, which is followed by a hash
+// of the namespace, the kind generation and the query fingerprint.
+var queryCacheKeyPrefix = fmt.Sprintf("g%Xq:", serializationFormatVersion)
+
+// The prefix of the memcache keys of kind generations,
+// which is followed by the namespace, a colon and the kind.
+var queryGenerationKeyPrefix = fmt.Sprintf("g%Xg:", serializationFormatVersion)
+
+// queryGenerationKey returns the memcache key of the generation of kind in namespace ns.
+func queryGenerationKey(ns, kind string) string {
+	key := queryGenerationKeyPrefix + ns + ":" + kind
+	if len(key) > memcacheMaxKeySize {
+		key = hashCacheKey(key)
+	}
+	return key
+}
+
+// queryKind is a kind in a namespace, whose generation is bumped on writes.
+type queryKind struct {
+	ns   string
+	kind string
+}
+
+// queryInfo describes a *datastore.Query.
+type queryInfo struct {
+	kind        string
+	keysOnly    bool
+	ancestor    bool   // whether the query has an ancestor filter, which makes it strongly consistent
+	projection  bool   // true for projection and distinct queries, whose results are partial entities
+	limit       int    // negative if the query has no limit
+	cacheable   bool   // false for invalid, projection and distinct queries
+	fingerprint string // canonical form of the whole query
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// inspectQuery reads the description of q. The datastore package doesn't
+// export the contents of a query, so they are read via reflection.
+func inspectQuery(q *datastore.Query) queryInfo {
+	return inspectQueryValue(reflect.ValueOf(q).Elem())
+}
+
+// inspectQueryValue reads the description of the datastore.Query qv.
+// If the fields it reads are missing, e.g. after a change of the datastore
+// package, then the query is treated as a projection query, which is
+// neither cached nor has its results cached as entities.
+func inspectQueryValue(qv reflect.Value) queryInfo {
+	info := queryInfo{limit: -1, projection: true}
+	kind, keysOnly := qv.FieldByName("kind"), qv.FieldByName("keysOnly")
+	projection, distinct := qv.FieldByName("projection"), qv.FieldByName("distinct")
+	qerr, limit, ancestor := qv.FieldByName("err"), qv.FieldByName("limit"), qv.FieldByName("ancestor")
+	if !kind.IsValid() || !keysOnly.IsValid() || !projection.IsValid() || !distinct.IsValid() || !qerr.IsValid() || !limit.IsValid() || !ancestor.IsValid() {
+		return info
+	}
+	info.kind = kind.String()
+	info.keysOnly = keysOnly.Bool()
+	info.ancestor = !ancestor.IsNil()
+	info.limit = int(limit.Int())
+	info.projection = projection.Len() > 0 || distinct.Bool()
+	info.cacheable = info.kind != "" && !info.projection && qerr.IsNil()
+	var buf bytes.Buffer
+	writeFingerprint(&buf, qv)
+	info.fingerprint = buf.String()
+	return info
+}
+
+// writeFingerprint writes a canonical form of v to buf,
+// following pointers so that equal values get equal fingerprints.
+func writeFingerprint(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		buf.WriteString("nil")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return
+		}
+		if v.Kind() == reflect.Interface {
+			buf.WriteString(v.Elem().Type().String())
+			buf.WriteByte(':')
+		}
+		writeFingerprint(buf, v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			// The location doesn't change the instant, and contains internal caches
+			writeFingerprint(buf, v.FieldByName("wall"))
+			buf.WriteByte(',')
+			writeFingerprint(buf, v.FieldByName("ext"))
+			return
+		}
+		buf.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			buf.WriteString(v.Type().Field(i).Name)
+			buf.WriteByte('=')
+			writeFingerprint(buf, v.Field(i))
+			buf.WriteByte(';')
+		}
+		buf.WriteByte('}')
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(buf, "[%d:", v.Len())
+		for i := 0; i < v.Len(); i++ {
+			writeFingerprint(buf, v.Index(i))
+			buf.WriteByte(';')
+		}
+		buf.WriteByte(']')
+	case reflect.String:
+		buf.WriteString(strconv.Quote(v.String()))
+	case reflect.Bool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		buf.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	default:
+		// Maps, funcs and channels don't appear in queries
+		buf.WriteString(v.Type().String())
+	}
+}
+
+// contextNamespace returns the namespace of c.
+func contextNamespace(c context.Context) string {
+	return datastore.NewKey(c, "", "", 0, nil).Namespace()
+}
+
+// queryCache holds the key list of a single query in the
+// local memory cache and memcache.
+type queryCache struct {
+	g        *Goon
+	c        context.Context
+	kind     string
+	keysOnly bool
+	key      string     // the cache key of the key list
+	lc       localCache // nil if the kind isn't cached locally
+	memcache bool       // whether the kind is cached in memcache
+}
+
+// newQueryCache returns the cache of the query described by info, which runs
+// with the context c, or nil if the results of the query must not be cached.
+// Only ancestor queries are cached: a query without an ancestor is eventually
+// consistent, so right after a write bumped the generation it may still
+// return the old results, which would then stay cached until the next write.
+func (g *Goon) newQueryCache(c context.Context, info queryInfo) *queryCache {
+	if g.inTransaction || !info.cacheable || !info.ancestor {
+		return nil
+	}
+	cfg, _ := kindCacheConfig(info.kind)
+	if !cfg.CacheQueries {
+		return nil
+	}
+	qc := &queryCache{g: g, c: c, kind: info.kind, keysOnly: info.keysOnly, lc: g.localCacheFor(info.kind), memcache: !cfg.NoMemcache}
+	if qc.lc == nil && !qc.memcache {
+		return nil
+	}
+	ns := contextNamespace(c)
+	gen, err := g.queryGeneration(c, "queryCache", ns, info.kind)
+	if err != nil {
+		return nil
+	}
+	qc.key = queryCacheKeyPrefix + hashCacheKey(ns+"\x00"+strconv.FormatUint(gen, 10)+"\x00"+info.fingerprint)
+	return qc
+}
+
+// queryGeneration returns the current generation of kind in namespace ns,
+// on behalf of operation op.
+func (g *Goon) queryGeneration(c context.Context, op, ns, kind string) (uint64, error) {
+	// Read the generation without changing it, starting it from the current
+	// time if it's missing, so that an evicted generation doesn't come back
+	tc, cf := context.WithTimeout(c, memcacheGetTimeout(1))
+	gen, err := memcache.Increment(tc, queryGenerationKey(ns, kind), 0, uint64(time.Now().UnixNano()))
+	cf()
+	if err != nil {
+		g.count(op, TierMemcache, MetricError, 1)
+		g.error(c, &LogEntry{Op: op, Kind: kind, Tier: TierMemcache, Err: err})
+	}
+	return gen, err
+}
+
+// get returns the cached keys of the query, if any.
+func (qc *queryCache) get() ([]*datastore.Key, bool) {
+	var data []byte
+	if qc.lc != nil {
+		data = qc.lc.Get(qc.key)
+	}
+	if data != nil {
+		qc.g.count("queryCache", TierLocal, MetricHit, 1)
+	} else {
+		qc.g.count("queryCache", TierLocal, MetricMiss, 1)
+		if !qc.memcache {
+			return nil, false
+		}
+		tc, cf := context.WithTimeout(qc.c, memcacheGetTimeout(1))
+		item, err := memcache.Get(tc, qc.key)
+		cf()
+		if err == memcache.ErrCacheMiss {
+			qc.g.count("queryCache", TierMemcache, MetricMiss, 1)
+			return nil, false
+		} else if err != nil {
+			qc.g.count("queryCache", TierMemcache, MetricError, 1)
+			qc.g.error(qc.c, &LogEntry{Op: "queryCache", Kind: qc.kind, Tier: TierMemcache, Err: err})
+			return nil, false
+		}
+		qc.g.count("queryCache", TierMemcache, MetricHit, 1)
+		data = item.Value
+		if qc.lc != nil {
+			qc.lc.Set(&cacheItem{key: qc.key, value: data})
+		}
+	}
+	keys, err := deserializeKeys(data)
+	if err != nil {
+		qc.g.error(qc.c, &LogEntry{Op: "queryCache", Kind: qc.kind, Err: err})
+		return nil, false
+	}
+	return keys, true
+}
+
+// set caches keys as the results of the query.
+func (qc *queryCache) set(keys []*datastore.Key) {
+	data := serializeKeys(keys)
+	if qc.lc != nil {
+		qc.lc.Set(&cacheItem{key: qc.key, value: data})
+		qc.g.count("queryCache", TierLocal, MetricSet, 1)
+	}
+	if qc.memcache && len(data) <= memcacheMaxValueSize {
+		tc, cf := context.WithTimeout(qc.c, memcachePutTimeout(len(data)))
+		err := memcache.Set(tc, &memcache.Item{Key: qc.key, Value: data})
+		cf()
+		if err != nil {
+			qc.g.count("queryCache", TierMemcache, MetricError, 1)
+			qc.g.error(qc.c, &LogEntry{Op: "queryCache", Kind: qc.kind, KeyCount: len(keys), Tier: TierMemcache, Err: err})
+		} else {
+			qc.g.count("queryCache", TierMemcache, MetricSet, 1)
+		}
+	}
+}
+
+// serializeKeys encodes keys as a marker byte followed by the comma separated encoded keys.
+// The marker makes sure that even an empty key list is a non-nil cache value.
+func serializeKeys(keys []*datastore.Key) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('k')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(key.Encode())
+	}
+	return buf.Bytes()
+}
+
+// deserializeKeys decodes keys encoded by serializeKeys.
+func deserializeKeys(data []byte) ([]*datastore.Key, error) {
+	if len(data) == 0 || data[0] != 'k' {
+		return nil, fmt.Errorf("%w: invalid cached query results", ErrCorruptCacheData)
+	}
+	if len(data) == 1 {
+		return []*datastore.Key{}, nil
+	}
+	encoded := strings.Split(string(data[1:]), ",")
+	keys := make([]*datastore.Key, len(encoded))
+	for i, e := range encoded {
+		key, err := datastore.DecodeKey(e)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cached query result key - %v", ErrCorruptCacheData, err)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// bumpQueryGenerations invalidates the cached query results and counts of
+// the kinds of keys, or defers that until the transaction is committed.
+// Only kinds registered with KindCacheConfig.CacheQueries or
+// KindCacheConfig.CountCacheTTL are bumped.
+// A memcache failure is logged and counted, and also returned.
+func (g *Goon) bumpQueryGenerations(c context.Context, op string, keys []*datastore.Key) error {
+	var qks []queryKind
+	seen := make(map[queryKind]bool)
+	for _, key := range keys {
+		qk := queryKind{ns: key.Namespace(), kind: key.Kind()}
+		if seen[qk] {
+			continue
+		}
+		seen[qk] = true
+		if cfg, _ := kindCacheConfig(qk.kind); cfg.CacheQueries || cfg.CountCacheTTL > 0 {
+			qks = append(qks, qk)
+		}
+	}
+	if len(qks) == 0 {
+		return nil
+	}
+	if g.inTransaction {
+		g.txnCacheLock.Lock()
+		for _, qk := range qks {
+			g.toBump[qk] = struct{}{}
+		}
+		g.txnCacheLock.Unlock()
+		return nil
+	}
+	return g.incrementQueryGenerations(c, op, qks)
+}
+
+// incrementQueryGenerations bumps the generations of qks on behalf of operation op.
+func (g *Goon) incrementQueryGenerations(c context.Context, op string, qks []queryKind) error {
+	var rerr error
+	for _, qk := range qks {
+		tc, cf := context.WithTimeout(c, memcacheGetTimeout(1))
+		_, err := memcache.Increment(tc, queryGenerationKey(qk.ns, qk.kind), 1, uint64(time.Now().UnixNano()))
+		cf()
+		if err != nil {
+			g.count(op, TierMemcache, MetricError, 1)
+			g.error(c, &LogEntry{Op: op, Kind: qk.kind, Tier: TierMemcache, Err: err, Message: "memcache.Increment failed - cached query results may be out of sync now!"})
+			rerr = err
+		}
+	}
+	return rerr
+}
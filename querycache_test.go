@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestQueryReflectedFields(t *testing.T) {
+	// inspectQuery and writeFingerprint read these unexported fields, so an
+	// update of the datastore package that changes them must fail loudly
+	for _, f := range []struct {
+		t    reflect.Type
+		name string
+		kind reflect.Kind
+	}{
+		{reflect.TypeOf(datastore.Query{}), "kind", reflect.String},
+		{reflect.TypeOf(datastore.Query{}), "keysOnly", reflect.Bool},
+		{reflect.TypeOf(datastore.Query{}), "projection", reflect.Slice},
+		{reflect.TypeOf(datastore.Query{}), "distinct", reflect.Bool},
+		{reflect.TypeOf(datastore.Query{}), "err", reflect.Interface},
+		{reflect.TypeOf(datastore.Query{}), "limit", reflect.Int32},
+		{reflect.TypeOf(datastore.Query{}), "ancestor", reflect.Ptr},
+		{timeType, "wall", reflect.Uint64},
+		{timeType, "ext", reflect.Int64},
+	} {
+		sf, ok := f.t.FieldByName(f.name)
+		if !ok {
+			t.Fatalf("%v no longer has the field %v", f.t, f.name)
+		}
+		if sf.Type.Kind() != f.kind {
+			t.Fatalf("Expected %v.%v to be of kind %v, got %v", f.t, f.name, f.kind, sf.Type.Kind())
+		}
+	}
+}
+
+func TestQueryFingerprint(t *testing.T) {
+	c := offlineContext()
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	build := func(parentID string, t time.Time) *datastore.Query {
+		parent := datastore.NewKey(c, "Parent", parentID, 0, nil)
+		return datastore.NewQuery("HasId").Ancestor(parent).Filter("Date >", t).Order("-Date").Limit(10)
+	}
+
+	// Equal queries built from different pointers have equal fingerprints
+	a, b := inspectQuery(build("p", when)), inspectQuery(build("p", when.In(time.FixedZone("X", 3600))))
+	if !a.cacheable || !a.ancestor || a.kind != "HasId" || a.keysOnly {
+		t.Fatalf("Unexpected query info %+v", a)
+	}
+	if a.fingerprint != b.fingerprint {
+		t.Fatalf("Expected equal fingerprints, got\n%v\n%v", a.fingerprint, b.fingerprint)
+	}
+
+	// Any difference changes the fingerprint
+	for _, q := range []*datastore.Query{
+		build("q", when),
+		build("p", when.Add(time.Second)),
+		build("p", when).Limit(11),
+		build("p", when).KeysOnly(),
+		build("p", when).Filter("Name =", "x"),
+	} {
+		if info := inspectQuery(q); info.fingerprint == a.fingerprint {
+			t.Fatalf("Expected a different fingerprint for %v", info.fingerprint)
+		}
+	}
+	if info := inspectQuery(build("p", when).KeysOnly()); !info.keysOnly || !info.cacheable {
+		t.Fatalf("Unexpected keys-only query info %+v", info)
+	}
+	if info := inspectQuery(datastore.NewQuery("HasId")); info.ancestor || !info.cacheable {
+		t.Fatalf("Unexpected query info without an ancestor %+v", info)
+	}
+
+	// Projection, distinct and invalid queries are never cached
+	for i, q := range []*datastore.Query{
+		datastore.NewQuery("HasId").Project("Name"),
+		datastore.NewQuery("HasId").Project("Name").Distinct(),
+		datastore.NewQuery("HasId").Filter("Name", "x"),
+		datastore.NewQuery(""),
+	} {
+		info := inspectQuery(q)
+		if info.cacheable {
+			t.Fatalf("Expected the query to not be cacheable: %v", info.fingerprint)
+		}
+		if info.projection != (i < 2) {
+			t.Fatalf("Unexpected projection %v for %v", info.projection, info.fingerprint)
+		}
+	}
+}
+
+func TestInspectQueryMissingFields(t *testing.T) {
+	// A query type without the expected fields is treated as a projection
+	// query, so that neither the query nor its results are cached
+	type changedQuery struct {
+		kind  string
+		limit int32
+	}
+	info := inspectQueryValue(reflect.ValueOf(changedQuery{kind: "HasId", limit: 5}))
+	if info.cacheable || !info.projection || info.limit != -1 || info.kind != "" {
+		t.Fatalf("Unexpected query info %+v", info)
+	}
+}
+
+func TestSerializeKeys(t *testing.T) {
+	c := offlineContext()
+	for _, keys := range [][]*datastore.Key{
+		{},
+		{datastore.NewKey(c, "A", "a,b", 0, nil)},
+		{datastore.NewKey(c, "A", "", 1, nil), datastore.NewKey(c, "B", "", 2, datastore.NewKey(c, "A", "x", 0, nil))},
+	} {
+		decoded, err := deserializeKeys(serializeKeys(keys))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(decoded) != len(keys) {
+			t.Fatalf("Expected %v keys, got %v", len(keys), len(decoded))
+		}
+		for i := range keys {
+			if !keys[i].Equal(decoded[i]) {
+				t.Fatalf("Expected %v, got %v", keys[i], decoded[i])
+			}
+		}
+	}
+	for _, data := range []string{"", "x", "kbad"} {
+		if _, err := deserializeKeys([]byte(data)); !errors.Is(err, ErrCorruptCacheData) {
+			t.Fatalf("Expected ErrCorruptCacheData for %q, got %v", data, err)
+		}
+	}
+}
+
+type CachedQueryKind struct {
+	Id     int64          `datastore:"-" goon:"id"`
+	Parent *datastore.Key `datastore:"-" goon:"parent"`
+	Name   string
+}
+
+func TestQueryCache(t *testing.T) {
+	defer registerTestKindCaches(map[string]KindCacheConfig{"CachedQueryKind": {CacheQueries: true}})()
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	if _, err := g.PutMulti([]*CachedQueryKind{{Id: 1, Parent: parent, Name: "a"}, {Id: 2, Parent: parent, Name: "b"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+
+	// Queries without an ancestor are eventually consistent, and never cached
+	var results []*CachedQueryKind
+	if _, err := g.GetAll(datastore.NewQuery("CachedQueryKind"), &results); err != nil {
+		t.Fatalf("Unexpected error on GetAll: %v", err)
+	}
+	if n := mc.Counter("queryCache", TierLocal, MetricMiss); n != 0 {
+		t.Fatalf("Expected the query cache to not be used, got %v misses", n)
+	}
+
+	q := datastore.NewQuery("CachedQueryKind").Ancestor(parent).Order("Name")
+	getAll := func() []*CachedQueryKind {
+		var results []*CachedQueryKind
+		if _, err := g.GetAll(q, &results); err != nil {
+			t.Fatalf("Unexpected error on GetAll: %v", err)
+		}
+		return results
+	}
+
+	// The first query runs on the datastore and caches its keys
+	if results := getAll(); len(results) != 2 || results[0].Name != "a" {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if mc.Counter("queryCache", TierLocal, MetricSet) != 1 {
+		t.Fatalf("Expected the keys to be cached locally")
+	}
+
+	// The second one is served from the local cache
+	if results := getAll(); len(results) != 2 || results[1].Name != "b" || results[1].Id != 2 {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if mc.Counter("queryCache", TierLocal, MetricHit) != 1 {
+		t.Fatalf("Expected a local query cache hit")
+	}
+
+	// .. and after flushing the local cache, from memcache
+	g.FlushLocalCache()
+	if results := getAll(); len(results) != 2 {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if mc.Counter("queryCache", TierMemcache, MetricHit) != 1 {
+		t.Fatalf("Expected a memcache query cache hit")
+	}
+
+	// Writes of the kind invalidate the cached results
+	if _, err := g.Put(&CachedQueryKind{Id: 3, Parent: parent, Name: "c"}); err != nil {
+		t.Fatalf("Unexpected error on Put: %v", err)
+	}
+	if results := getAll(); len(results) != 3 || results[2].Name != "c" {
+		t.Fatalf("Unexpected results after Put %+v", results)
+	}
+	if hits := mc.Counter("queryCache", TierLocal, MetricHit) + mc.Counter("queryCache", TierMemcache, MetricHit); hits != 2 {
+		t.Fatalf("Expected no further query cache hits, got %v", hits)
+	}
+}
+
+func TestGetAllByKeysLocal(t *testing.T) {
+	g := FromContext(offlineContext())
+	var keys []*datastore.Key
+	for _, hi := range []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}, {Id: 3, Name: "three"}} {
+		data, err := serializeStruct(hi)
+		if err != nil {
+			t.Fatalf("Unexpected error serializing: %v", err)
+		}
+		g.cache.Set(&cacheItem{key: cacheKey(g.Key(hi)), value: data})
+		keys = append(keys, g.Key(hi))
+	}
+
+	// Entities are appended to dst in the order of keys
+	dst := []HasId{{Id: 9}}
+	if _, err := g.getAllByKeys(g.Context, []*datastore.Key{keys[1], keys[0]}, false, false, &dst); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(dst) != 3 || dst[0].Id != 9 || dst[1].Name != "two" || dst[2].Name != "one" {
+		t.Fatalf("Unexpected dst %+v", dst)
+	}
+
+	// Keys-only results only get their key fields set
+	var ptrs []*HasId
+	if _, err := g.getAllByKeys(g.Context, keys, true, false, &ptrs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ptrs) != 3 || ptrs[0].Id != 1 || ptrs[0].Name != "" || ptrs[2].Id != 3 {
+		t.Fatalf("Unexpected dst %+v %+v", ptrs[0], ptrs[2])
+	}
+
+	// Entities that are gone either fail the whole call ..
+	g.cache.Set(&cacheItem{key: cacheKey(keys[1]), value: []byte{0, 0, 0, 0}})
+	ptrs = nil
+	if _, err := g.getAllByKeys(g.Context, keys, false, false, &ptrs); err != errMissingEntities || len(ptrs) != 0 {
+		t.Fatalf("Expected errMissingEntities, got %v %v", err, ptrs)
+	}
+	// .. or are left out
+	found, err := g.getAllByKeys(g.Context, keys, false, true, &ptrs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(found) != 2 || !found[0].Equal(keys[0]) || !found[1].Equal(keys[2]) {
+		t.Fatalf("Unexpected keys %v", found)
+	}
+	if len(ptrs) != 2 || ptrs[0].Name != "one" || ptrs[1].Name != "three" {
+		t.Fatalf("Unexpected dst %+v %+v", ptrs[0], ptrs[1])
+	}
+}
+
+func TestGetAllByKeys(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	mc := NewMetricsCollector()
+	g.Metrics = mc
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "b"}, {Id: 2, Name: "a"}, {Id: 3, Name: "c"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti: %v", err)
+	}
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}, {Id: 3}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+
+	// The entities come from the local cache, in the order of the query
+	dst := []HasId{{Name: "existing"}}
+	keys, err := g.GetAllByKeys(datastore.NewQuery("HasId").Order("Name"), &dst)
+	if err != nil {
+		t.Fatalf("Unexpected error on GetAllByKeys: %v", err)
+	}
+	if len(keys) != 3 || len(dst) != 4 || dst[0].Name != "existing" || dst[1].Name != "a" || dst[2].Id != 1 || dst[3].Name != "c" {
+		t.Fatalf("Unexpected results %v %+v", keys, dst)
+	}
+	if hits := mc.Counter("GetMulti", TierLocal, MetricHit); hits != 3 {
+		t.Fatalf("Expected 3 local cache hits, got %v", hits)
+	}
+}
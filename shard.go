@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import "hash/maphash"
+
+// shardedCache splits the local memory cache into independently locked
+// shards, so that concurrent goroutines rarely wait for each other.
+// Every shard has its own eviction policy and an equal part of the size
+// limit, which keeps the total size of all the shards within the limit.
+type shardedCache struct {
+	shards []*cache
+	seed   maphash.Seed
+}
+
+func newShardedCache(limit, shards int, policy func() EvictionPolicy) *shardedCache {
+	sc := &shardedCache{shards: make([]*cache, shards), seed: maphash.MakeSeed()}
+	for i := range sc.shards {
+		// Spread the remainder so that the shard limits add up to exactly limit
+		shardLimit := limit / shards
+		if i < limit%shards {
+			shardLimit++
+		}
+		sc.shards[i] = newCacheWithPolicy(shardLimit, policy())
+	}
+	return sc
+}
+
+// shardIndex returns the index of the shard that holds key,
+// based on a hash of the key with the seed of the cache.
+func (sc *shardedCache) shardIndex(key string) int {
+	var h maphash.Hash
+	h.SetSeed(sc.seed)
+	h.WriteString(key)
+	return int(h.Sum64() % uint64(len(sc.shards)))
+}
+
+// maxStackKeys is the number of keys whose shard indexes the multi
+// operations keep in a fixed size array, which avoids an allocation
+// for the typical batch.
+const maxStackKeys = 64
+
+// shardIndexes returns the shard index of every key, using buf
+// if it is large enough. The multi operations visit the keys grouped
+// by shard, in the order of the first key of every shard, and take
+// each shard lock once. They overwrite the visited indexes with -1.
+func (sc *shardedCache) shardIndexes(keys []string, buf []int) []int {
+	indexes := buf
+	if len(keys) > len(buf) {
+		indexes = make([]int, len(keys))
+	}
+	indexes = indexes[:len(keys)]
+	for i, key := range keys {
+		indexes[i] = sc.shardIndex(key)
+	}
+	return indexes
+}
+
+func (sc *shardedCache) Set(item *cacheItem) {
+	sc.shards[sc.shardIndex(item.key)].Set(item)
+}
+
+// SetMulti takes the lock of every involved shard only once
+func (sc *shardedCache) SetMulti(items []*cacheItem) {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.key
+	}
+	var buf [maxStackKeys]int
+	indexes := sc.shardIndexes(keys, buf[:])
+	for i, s := range indexes {
+		if s < 0 {
+			continue
+		}
+		c := sc.shards[s]
+		c.lock.Lock()
+		for j := i; j < len(indexes); j++ {
+			if indexes[j] == s {
+				indexes[j] = -1
+				c.setUnderLock(items[j])
+			}
+		}
+		c.meetLimitUnderLock()
+		c.lock.Unlock()
+	}
+}
+
+func (sc *shardedCache) Delete(key string) {
+	sc.shards[sc.shardIndex(key)].Delete(key)
+}
+
+// DeleteMulti takes the lock of every involved shard only once
+func (sc *shardedCache) DeleteMulti(keys []string) {
+	var buf [maxStackKeys]int
+	indexes := sc.shardIndexes(keys, buf[:])
+	for i, s := range indexes {
+		if s < 0 {
+			continue
+		}
+		c := sc.shards[s]
+		c.lock.Lock()
+		for j := i; j < len(indexes); j++ {
+			if indexes[j] == s {
+				indexes[j] = -1
+				c.deleteUnderLock(keys[j])
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+// The cache retains ownership of the []byte, so consider it immutable
+func (sc *shardedCache) Get(key string) []byte {
+	return sc.shards[sc.shardIndex(key)].Get(key)
+}
+
+// GetMulti takes the lock of every involved shard only once
+// The cache retains ownership of the []byte, so consider it immutable
+func (sc *shardedCache) GetMulti(keys []string) [][]byte {
+	result := make([][]byte, len(keys))
+	var buf [maxStackKeys]int
+	indexes := sc.shardIndexes(keys, buf[:])
+	for i, s := range indexes {
+		if s < 0 {
+			continue
+		}
+		c := sc.shards[s]
+		c.lock.Lock()
+		for j := i; j < len(indexes); j++ {
+			if indexes[j] == s {
+				indexes[j] = -1
+				result[j] = c.getUnderLock(keys[j])
+			}
+		}
+		c.lock.Unlock()
+	}
+	return result
+}
+
+func (sc *shardedCache) Flush() {
+	for _, c := range sc.shards {
+		c.Flush()
+	}
+}
+
+// Stats returns the sum of the statistics of all the shards.
+// The shards are locked one at a time, so concurrent changes
+// may be only partially included.
+func (sc *shardedCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, c := range sc.shards {
+		stats.add(c.Stats())
+	}
+	return stats
+}
+
+// Items returns the items of every shard, one shard after another.
+func (sc *shardedCache) Items() []*cacheItem {
+	var items []*cacheItem
+	for _, c := range sc.shards {
+		items = append(items, c.Items()...)
+	}
+	return items
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedCache(t *testing.T) {
+	sc := newShardedCache(100003, 4, NewLRUPolicy)
+	limits := 0
+	for _, c := range sc.shards {
+		limits += c.limit
+	}
+	if limits != 100003 {
+		t.Fatalf("Expected shard limits to add up to 100003, got %v", limits)
+	}
+
+	items := make([]*cacheItem, 20)
+	keys := make([]string, len(items))
+	for i := range items {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		items[i] = &cacheItem{key: keys[i], value: []byte{byte(i)}}
+	}
+	sc.SetMulti(items)
+	used := 0
+	for _, c := range sc.shards {
+		if len(c.elements) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("Expected the keys to be spread over multiple shards, got %v", used)
+	}
+
+	vs := sc.GetMulti(append(keys, "missing"))
+	for i, v := range vs[:len(keys)] {
+		if !bytes.Equal(v, items[i].value) {
+			t.Fatalf("Invalid bytes for %v: %v", keys[i], v)
+		}
+	}
+	if vs[len(keys)] != nil {
+		t.Fatalf("Expected nil for a missing key, got %v", vs[len(keys)])
+	}
+	if v := sc.Get(keys[3]); !bytes.Equal(v, items[3].value) {
+		t.Fatalf("Invalid bytes! %v", v)
+	}
+
+	stats := sc.Stats()
+	if stats.Items != 20 || stats.Hits != 21 || stats.Misses != 1 || stats.Limit != 100003 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	expected := 0
+	for _, item := range items {
+		expected += cachedValueOverhead + len(item.key) + cap(item.value)
+	}
+	if stats.Size != expected {
+		t.Fatalf("Expected size %v, got %v", expected, stats.Size)
+	}
+	if n := len(sc.Items()); n != 20 {
+		t.Fatalf("Expected 20 items, got %v", n)
+	}
+
+	sc.DeleteMulti(keys[:10])
+	sc.Delete(keys[10])
+	if vs := sc.GetMulti(keys[:11]); !reflect.DeepEqual(vs, make([][]byte, 11)) {
+		t.Fatalf("Expected nils but got %+v", vs)
+	}
+	if stats := sc.Stats(); stats.Items != 9 {
+		t.Fatalf("Expected 9 items, got %+v", stats)
+	}
+
+	sc.Flush()
+	if stats := sc.Stats(); stats.Items != 0 || stats.Size != 0 {
+		t.Fatalf("Expected an empty cache, got %+v", stats)
+	}
+}
+
+func TestShardedCacheLimit(t *testing.T) {
+	const limit = 4 << 10
+	sc := newShardedCache(limit, 8, NewLRUPolicy)
+	for i := 0; i < 1000; i++ {
+		sc.Set(&cacheItem{key: fmt.Sprintf("key-%d", i), value: make([]byte, 50)})
+	}
+	stats := sc.Stats()
+	if stats.Size > limit || stats.Evictions == 0 {
+		t.Fatalf("Expected evictions to keep the size within %v, got %+v", limit, stats)
+	}
+	size := 0
+	for _, c := range sc.shards {
+		size += c.size
+	}
+	if size != stats.Size {
+		t.Fatalf("Expected total size %v, got %v", size, stats.Size)
+	}
+}
+
+func TestConfigureShardedLocalCache(t *testing.T) {
+	g := FromContext(offlineContext())
+	g.ConfigureLocalCache(LocalCacheOptions{Shards: 16})
+	sc, ok := g.cache.(*shardedCache)
+	if !ok || len(sc.shards) != 16 {
+		t.Fatalf("Expected 16 shards, got %#v", g.cache)
+	}
+	if stats := g.CacheStats(); stats.Limit != defaultCacheLimit {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// benchmarkCacheParallel runs GetMulti batches from many goroutines,
+// mixed with the occasional SetMulti, like a Goon shared by workers.
+func benchmarkCacheParallel(b *testing.B, c localCache) {
+	const keyCount, batchSize = 1000, 20
+	items := make([]*cacheItem, keyCount)
+	for i := range items {
+		items[i] = &cacheItem{key: fmt.Sprintf("key-%d", i), value: make([]byte, 100)}
+	}
+	c.SetMulti(items)
+	var seed uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := int(atomic.AddUint32(&seed, 1)) * 7919
+		keys := make([]string, batchSize)
+		batch := make([]*cacheItem, batchSize)
+		for pb.Next() {
+			for i := range keys {
+				n = (n + 31) % keyCount
+				keys[i] = items[n].key
+				batch[i] = items[n]
+			}
+			c.GetMulti(keys)
+			if n%10 == 0 {
+				c.SetMulti(batch)
+			}
+		}
+	})
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	benchmarkCacheParallel(b, newCache(defaultCacheLimit))
+}
+
+func BenchmarkShardedCacheParallel(b *testing.B) {
+	benchmarkCacheParallel(b, newShardedCache(defaultCacheLimit, 16, NewLRUPolicy))
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+)
+
+// The attributes that goon sets on its spans.
+const (
+	SpanAttrKeys         = "goon.keys"          // int, number of keys requested
+	SpanAttrHits         = "goon.hits"          // int, number of keys found
+	SpanAttrPayloadBytes = "goon.payload_bytes" // int, size of the data transferred
+	SpanAttrAttempt      = "goon.attempt"       // int, 1-based attempt number of a retried call
+	SpanAttrError        = "goon.error"         // string, error message if the call failed
+)
+
+// Span is a single traced unit of work.
+type Span interface {
+	// SetAttribute attaches a key-value pair to the span.
+	SetAttribute(key string, value interface{})
+	// End marks the span as finished. No methods are called after End.
+	End()
+}
+
+// Tracer creates spans around the storage tier calls that goon makes.
+// StartSpan may be called concurrently from multiple goroutines.
+type Tracer interface {
+	// StartSpan starts a new span as a child of any span carried by c.
+	// The returned context carries the new span and is used for the traced call.
+	StartSpan(c context.Context, name string) (context.Context, Span)
+}
+
+// NoopTracer is a Tracer that records nothing. It is used when Goon.Tracer is nil.
+var NoopTracer Tracer = noopTracer{}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(c context.Context, name string) (context.Context, Span) {
+	return c, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
+
+func (g *Goon) startSpan(c context.Context, name string) (context.Context, Span) {
+	if g.Tracer == nil {
+		return c, noopSpan{}
+	}
+	return g.Tracer.StartSpan(c, name)
+}
+
+// endSpan records err on span, if there is one, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetAttribute(SpanAttrError, err.Error())
+	}
+	span.End()
+}
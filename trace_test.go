@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/memcache"
+)
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (rs *recordedSpan) SetAttribute(key string, value interface{}) {
+	rs.attrs[key] = value
+}
+
+func (rs *recordedSpan) End() {
+	rs.ended = true
+}
+
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpanKey struct{}
+
+func (rt *recordingTracer) StartSpan(c context.Context, name string) (context.Context, Span) {
+	parent, _ := c.Value(recordedSpanKey{}).(*recordedSpan)
+	rs := &recordedSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	rt.lock.Lock()
+	rt.spans = append(rt.spans, rs)
+	rt.lock.Unlock()
+	return context.WithValue(c, recordedSpanKey{}, rs), rs
+}
+
+func (rt *recordingTracer) byName(name string) []*recordedSpan {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	var result []*recordedSpan
+	for _, rs := range rt.spans {
+		if rs.name == name {
+			result = append(result, rs)
+		}
+	}
+	return result
+}
+
+func TestTracerLocalCache(t *testing.T) {
+	g := FromContext(offlineContext())
+	rt := &recordingTracer{}
+	g.Tracer = rt
+
+	src := []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}
+	for _, hi := range src {
+		data, err := serializeStruct(hi)
+		if err != nil {
+			t.Fatalf("Unexpected error serializing: %v", err)
+		}
+		g.cache.Set(&cacheItem{key: cacheKey(g.Key(hi)), value: data})
+	}
+
+	// Everything is in the local cache, so no other tier is involved
+	dst := []*HasId{{Id: 1}, {Id: 2}}
+	if err := g.GetMulti(dst); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+	if dst[1].Name != "two" {
+		t.Fatalf("Expected name to be 'two', got %v", dst[1].Name)
+	}
+	if len(rt.spans) != 1 {
+		t.Fatalf("Expected a single span, got %v", len(rt.spans))
+	}
+	rs := rt.spans[0]
+	if rs.name != "goon.GetMulti.local" || !rs.ended || rs.attrs[SpanAttrKeys] != 2 || rs.attrs[SpanAttrHits] != 2 {
+		t.Fatalf("Unexpected span: %+v", rs)
+	}
+
+	// Without a tracer nothing breaks
+	g.Tracer = nil
+	if err := g.GetMulti(dst); err != nil {
+		t.Fatalf("Unexpected error on GetMulti: %v", err)
+	}
+
+	// The span is ended even when corrupt cache data aborts the call
+	g.Tracer = rt
+	g.Logger = &recordingLogger{}
+	rt.spans = nil
+	// The header claims one property, which is missing
+	g.cache.Set(&cacheItem{key: cacheKey(g.Key(src[0])), value: []byte{1, 0, 0, 0x40}})
+	if err := g.GetMulti([]*HasId{{Id: 1}}); err == nil {
+		t.Fatalf("Expected an error for corrupt cache data")
+	}
+	if len(rt.spans) != 1 || !rt.spans[0].ended {
+		t.Fatalf("Expected a single ended span, got %+v", rt.spans)
+	}
+}
+
+func TestTracerTiers(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+	rt := &recordingTracer{}
+	g.Tracer = rt
+
+	if _, err := g.PutMulti([]*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	memcache.Flush(c)
+	g.FlushLocalCache()
+	if err := g.GetMulti([]*HasId{{Id: 1}, {Id: 2}}); err != nil {
+		t.Fatalf("Unexpected error on GetMulti - %v", err)
+	}
+
+	mcs := rt.byName("goon.GetMulti.memcache")
+	if len(mcs) != 1 || mcs[0].attrs[SpanAttrKeys] != 2 || mcs[0].attrs[SpanAttrHits] != 0 || !mcs[0].ended {
+		t.Fatalf("Unexpected memcache spans: %+v", mcs)
+	}
+	attempts := rt.byName("goon.memcache.GetMulti")
+	if len(attempts) != 1 || attempts[0].parent != mcs[0] || attempts[0].attrs[SpanAttrAttempt] != 1 {
+		t.Fatalf("Unexpected memcache attempt spans: %+v", attempts)
+	}
+	dss := rt.byName("goon.GetMulti.datastore")
+	if len(dss) != 1 || dss[0].attrs[SpanAttrKeys] != 2 || dss[0].attrs[SpanAttrPayloadBytes].(int) == 0 || !dss[0].ended {
+		t.Fatalf("Unexpected datastore spans: %+v", dss)
+	}
+	puts := rt.byName("goon.putMemcache")
+	if len(puts) != 1 || puts[0].parent != dss[0] || puts[0].attrs[SpanAttrKeys] != 2 || !puts[0].ended {
+		t.Fatalf("Unexpected putMemcache spans: %+v", puts)
+	}
+	if _, ok := puts[0].attrs[SpanAttrError]; ok {
+		t.Fatalf("Unexpected putMemcache error: %v", puts[0].attrs[SpanAttrError])
+	}
+}
+
+func TestTracerContext(t *testing.T) {
+	g := FromContext(offlineContext())
+	rt := &recordingTracer{}
+	g.Tracer = rt
+
+	hi := &HasId{Id: 1, Name: "one"}
+	data, err := serializeStruct(hi)
+	if err != nil {
+		t.Fatalf("Unexpected error serializing: %v", err)
+	}
+	g.cache.Set(&cacheItem{key: cacheKey(g.Key(hi)), value: data})
+
+	// The spans are children of the span in the context given to GetMultiContext
+	c, parent := rt.StartSpan(g.Context, "request")
+	if err := g.GetMultiContext(c, []*HasId{{Id: 1}}); err != nil {
+		t.Fatalf("Unexpected error on GetMultiContext: %v", err)
+	}
+	local := rt.byName("goon.GetMulti.local")
+	if len(local) != 1 || local[0].parent != parent {
+		t.Fatalf("Unexpected local spans: %+v", local)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"google.golang.org/appengine/datastore"
+)
+
+// The functions in this file are a typed layer on top of the Goon methods.
+// The entity type T is a struct type with goon key fields, and is checked
+// at compile time to be used consistently, e.g. GetMulti only accepts a []*T
+// and GetAll returns a []*T.
+
+// Get is a typed version of Goon.Get.
+func Get[T any](g *Goon, dst *T) error {
+	return g.Get(dst)
+}
+
+// GetMulti is a typed version of Goon.GetMulti.
+func GetMulti[T any](g *Goon, dst []*T) error {
+	return g.GetMulti(dst)
+}
+
+// Put is a typed version of Goon.Put.
+func Put[T any](g *Goon, src *T) (*datastore.Key, error) {
+	return g.Put(src)
+}
+
+// PutMulti is a typed version of Goon.PutMulti.
+func PutMulti[T any](g *Goon, src []*T) ([]*datastore.Key, error) {
+	return g.PutMulti(src)
+}
+
+// Delete is a typed version of Goon.Delete.
+func Delete[T any](g *Goon, src *T) error {
+	return g.Delete(src)
+}
+
+// DeleteMulti is a typed version of Goon.DeleteMulti.
+func DeleteMulti[T any](g *Goon, src []*T) error {
+	return g.DeleteMulti(src)
+}
+
+// TypedQuery is a query whose results are entities of type T.
+type TypedQuery[T any] struct {
+	g *Goon
+	q *datastore.Query
+}
+
+// Query returns a TypedQuery that runs q with g.
+func Query[T any](g *Goon, q *datastore.Query) *TypedQuery[T] {
+	return &TypedQuery[T]{g: g, q: q}
+}
+
+// Count returns the number of results for the query.
+func (tq *TypedQuery[T]) Count() (int, error) {
+	return tq.g.Count(tq.q)
+}
+
+// GetAll runs the query and returns all the entities and keys that match it,
+// with the same semantics as Goon.GetAll. For keys-only queries the entities
+// only have their goon key fields set.
+func (tq *TypedQuery[T]) GetAll() ([]*T, []*datastore.Key, error) {
+	var dst []*T
+	keys, err := tq.g.GetAll(tq.q, &dst)
+	return dst, keys, err
+}
+
+// ForEach calls fn for every result of the query, with the same semantics
+// as Goon.ForEach. The entity given to fn is reused for every result.
+func (tq *TypedQuery[T]) ForEach(fn func(dst *T, key *datastore.Key, cursor func() (datastore.Cursor, error)) error) error {
+	dst := new(T)
+	return tq.g.ForEach(tq.q, dst, func(key *datastore.Key, cursor func() (datastore.Cursor, error)) error {
+		return fn(dst, key, cursor)
+	})
+}
+
+// Run runs the query.
+func (tq *TypedQuery[T]) Run() *TypedIterator[T] {
+	return &TypedIterator[T]{t: tq.g.Run(tq.q)}
+}
+
+// TypedIterator is the result of running a TypedQuery.
+type TypedIterator[T any] struct {
+	t *Iterator
+}
+
+// Cursor returns a cursor for the iterator's current location.
+func (ti *TypedIterator[T]) Cursor() (datastore.Cursor, error) {
+	return ti.t.Cursor()
+}
+
+// Next returns the entity and key of the next result, with the same semantics
+// as Iterator.Next. When there are no more results, datastore.Done is returned
+// as the error. The entity may be non-nil together with a field mismatch error.
+func (ti *TypedIterator[T]) Next() (*T, *datastore.Key, error) {
+	dst := new(T)
+	k, err := ti.t.Next(dst)
+	if err != nil && !errFieldMismatch(err) {
+		return nil, k, err
+	}
+	return dst, k, err
+}
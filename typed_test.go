@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2012 The Goon Authors
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goon
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestTypedGetLocal(t *testing.T) {
+	g := FromContext(offlineContext())
+	for _, hi := range []*HasId{{Id: 1, Name: "one"}, {Id: 2, Name: "two"}} {
+		data, err := serializeStruct(hi)
+		if err != nil {
+			t.Fatalf("Unexpected error serializing: %v", err)
+		}
+		g.cache.Set(&cacheItem{key: cacheKey(g.Key(hi)), value: data})
+	}
+
+	hi := &HasId{Id: 1}
+	if err := Get(g, hi); err != nil || hi.Name != "one" {
+		t.Fatalf("Unexpected result %+v (%v)", hi, err)
+	}
+	his := []*HasId{{Id: 2}, {Id: 1}}
+	if err := GetMulti(g, his); err != nil || his[0].Name != "two" || his[1].Name != "one" {
+		t.Fatalf("Unexpected result %+v %+v (%v)", his[0], his[1], err)
+	}
+}
+
+func TestTypedRoundTrip(t *testing.T) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("Could not start aetest - %v", err)
+	}
+	defer done()
+	g := FromContext(c)
+
+	key, err := Put(g, &HasId{Name: "first"})
+	if err != nil {
+		t.Fatalf("Unexpected error on Put - %v", err)
+	}
+	if _, err := PutMulti(g, []*HasId{{Id: key.IntID() + 1, Name: "second"}}); err != nil {
+		t.Fatalf("Unexpected error on PutMulti - %v", err)
+	}
+	hi := &HasId{Id: key.IntID()}
+	if err := Get(g, hi); err != nil || hi.Name != "first" {
+		t.Fatalf("Unexpected result %+v (%v)", hi, err)
+	}
+
+	q := Query[HasId](g, datastore.NewQuery("HasId").Order("Name"))
+	if n, err := q.Count(); err != nil || n != 2 {
+		t.Fatalf("Expected 2 results, got %v (%v)", n, err)
+	}
+	his, keys, err := q.GetAll()
+	if err != nil || len(his) != 2 || len(keys) != 2 {
+		t.Fatalf("Unexpected GetAll results %v %v (%v)", his, keys, err)
+	}
+	if his[0].Name != "first" || his[0].Id != key.IntID() || his[1].Name != "second" {
+		t.Fatalf("Unexpected GetAll results %+v %+v", his[0], his[1])
+	}
+
+	it := q.Run()
+	var names []string
+	for {
+		hi, _, err := it.Next()
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error on Next - %v", err)
+		}
+		names = append(names, hi.Name)
+	}
+	if len(names) != 2 || names[0] != "first" || names[1] != "second" {
+		t.Fatalf("Unexpected Run results %v", names)
+	}
+
+	if err := Delete(g, &HasId{Id: key.IntID()}); err != nil {
+		t.Fatalf("Unexpected error on Delete - %v", err)
+	}
+	if err := Get(g, &HasId{Id: key.IntID()}); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected ErrNoSuchEntity, got %v", err)
+	}
+}